@@ -0,0 +1,523 @@
+package main
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// cacheBundleManifestName is the name of the first entry of a cache bundle, which contains the CacheBundleManifest
+const cacheBundleManifestName = "g10k-cache-manifest.json"
+
+// CacheBundleManifest describes the cache entries of a cache bundle written by -cache-export
+type CacheBundleManifest struct {
+	G10kVersion string    `json:"g10k_version"`
+	CreatedAt   time.Time `json:"created_at"`
+	// Target is the g10k config or the Puppetfile the cache entries were exported for
+	Target string `json:"target"`
+	// Environments contains the source/branch names of the exported control repository branches
+	Environments []string           `json:"environments,omitempty"`
+	Entries      []CacheBundleEntry `json:"entries"`
+}
+
+// CacheBundleEntry is a cached git repository, Forge module archive, directory, -latest symlink or last-checked file or Git LFS object of a cache bundle
+type CacheBundleEntry struct {
+	// Path is relative to the cachedir, e.g. modules/https-__github.com_puppetlabs_puppetlabs-apt.git
+	Path string `json:"path"`
+	// Type is git, forge or lfs
+	Type string `json:"type"`
+	// URL is the remote URL of a cached git repository
+	URL string `json:"url,omitempty"`
+}
+
+// runCacheExport writes a cache bundle with the cache entries the Puppetfiles of target need to the file bundle.
+// Without Puppetfiles the Puppetfiles of the branches of the control repositories of the g10k config are used
+func runCacheExport(bundle string, target string, puppetfiles map[string]Puppetfile) {
+	defer timeTrack(time.Now(), funcName())
+	refs := cacheReferences{paths: make(map[string]bool), submodulesChecked: make(map[string]bool)}
+	manifest := CacheBundleManifest{G10kVersion: buildversion, CreatedAt: time.Now().UTC(), Target: target}
+	if puppetfiles == nil {
+		puppetfiles = controlRepoPuppetfiles(config.Sources, func(workDir string, branch string, sa Source) {
+			refs.paths[workDir] = true
+			if sa.Submodules {
+				commit, _ := gitBackend.resolveRef(workDir, branch, true)
+				refs.addSubmodules(workDir, commit, sa.Remote)
+			}
+		})
+		for environment := range puppetfiles {
+			manifest.Environments = append(manifest.Environments, environment)
+		}
+		sort.Strings(manifest.Environments)
+	}
+	for _, puppetfile := range puppetfiles {
+		refs.addPuppetfile(puppetfile, func(gitName string, gm GitModule) string {
+			commit, _ := gitBackend.resolveRef(gitCacheDir(gm.git), moduleTree(gm), true)
+			return commit
+		})
+		missing := refs.addLFSObjects(puppetfile, func(gitName string, gm GitModule) string {
+			return moduleTree(gm)
+		})
+		for gitURL, oids := range missing {
+			for _, oid := range oids {
+				Warnf("WARN: Git LFS object " + oid + " of " + redactGitURL(gitURL) + " is not in the cachedir " + config.CacheDir + " and can not be exported")
+			}
+		}
+	}
+	archives := []string{}
+	for path := range refs.paths {
+		// the Forge module archives are needed by -checksum, :sha256sum and -cache-verify
+		if strings.HasPrefix(path, config.ForgeCacheDir) && !strings.HasSuffix(path, "-latest") && isDir(path) {
+			archives = append(archives, path+".tar.gz", forgeArchiveChecksumFile(path+".tar.gz"))
+		}
+	}
+	for _, archive := range archives {
+		if fileExists(archive) {
+			refs.paths[archive] = true
+		}
+	}
+
+	paths := []string{}
+	for path := range refs.paths {
+		if _, err := os.Lstat(path); err != nil {
+			// Forge modules extracted by older g10k versions have no recorded checksums
+			if strings.HasSuffix(path, "-latest-last-checked") || strings.HasSuffix(path, ".sha256sums") {
+				continue
+			}
+			Fatalf("Error: " + path + " is not in the cachedir " + config.CacheDir + ", run g10k with " + target + " first to fill the cache")
+		}
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		entry := CacheBundleEntry{Path: cacheRelativePath(path), Type: "forge"}
+		if strings.HasPrefix(path, config.EnvCacheDir+string(filepath.Separator)) || strings.HasPrefix(path, config.ModulesCacheDir+string(filepath.Separator)) {
+			entry.Type = "git"
+			entry.URL, _ = gitBackend.remoteURL(path)
+		} else if strings.HasPrefix(path, config.LFSCacheDir+string(filepath.Separator)) {
+			entry.Type = "lfs"
+		}
+		manifest.Entries = append(manifest.Entries, entry)
+	}
+
+	tmpFile := bundle + ".tmp"
+	f, err := os.Create(tmpFile)
+	if err != nil {
+		Fatalf("runCacheExport(): Could not create cache bundle " + tmpFile + " Error: " + err.Error())
+	}
+	defer os.Remove(tmpFile)
+	zw, err := zstd.NewWriter(f)
+	if err != nil {
+		Fatalf("runCacheExport(): Could not create zstd writer for " + tmpFile + " Error: " + err.Error())
+	}
+	tw := tar.NewWriter(zw)
+	manifestJSON, _ := json.MarshalIndent(manifest, "", "  ")
+	if err := tw.WriteHeader(&tar.Header{Name: cacheBundleManifestName, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(manifestJSON)), ModTime: manifest.CreatedAt}); err != nil {
+		Fatalf("runCacheExport(): Could not write " + cacheBundleManifestName + " to " + tmpFile + " Error: " + err.Error())
+	}
+	tw.Write(manifestJSON)
+	var size int64
+	for _, path := range paths {
+		Debugf("Adding " + path + " to cache bundle " + bundle)
+		written, err := writeBundleEntry(tw, path)
+		if err != nil {
+			Fatalf("runCacheExport(): Could not add " + path + " to cache bundle " + tmpFile + " Error: " + err.Error())
+		}
+		size += written
+	}
+	if err := tw.Close(); err != nil {
+		Fatalf("runCacheExport(): Could not write cache bundle " + tmpFile + " Error: " + err.Error())
+	}
+	if err := zw.Close(); err != nil {
+		Fatalf("runCacheExport(): Could not write cache bundle " + tmpFile + " Error: " + err.Error())
+	}
+	if err := f.Close(); err != nil {
+		Fatalf("runCacheExport(): Could not write cache bundle " + tmpFile + " Error: " + err.Error())
+	}
+	if err := os.Rename(tmpFile, bundle); err != nil {
+		Fatalf("runCacheExport(): Could not rename " + tmpFile + " to " + bundle + " Error: " + err.Error())
+	}
+	if !quiet {
+		bundleSize := int64(0)
+		if fi, err := os.Stat(bundle); err == nil {
+			bundleSize = fi.Size()
+		}
+		fmt.Println("Exported " + strconv.Itoa(len(manifest.Entries)) + " cache entries (" + formatSize(size) + ") from " + config.CacheDir + " to " + bundle + " (" + formatSize(bundleSize) + ")")
+	}
+}
+
+// controlRepoPuppetfiles returns the Puppetfiles of the branches of the cached control repositories of the sources by source/branch,
+// which would be deployed with the filter_regex, filter_command, -branch and -tags settings,
+// and calls branchFunc for each of these branches
+func controlRepoPuppetfiles(sources map[string]Source, branchFunc func(workDir string, branch string, sa Source)) map[string]Puppetfile {
+	puppetfiles := make(map[string]Puppetfile)
+	for source, sa := range sources {
+		workDir := filepath.Join(config.EnvCacheDir, source+".git")
+		if !isDir(workDir) {
+			Fatalf("Error: control repository " + sa.Remote + " of source " + source + " is not in the cachedir " + config.CacheDir + ", run g10k with " + configFile + " first to fill the cache")
+		}
+		branches, err := gitBackend.listBranches(workDir)
+		if err != nil {
+			Fatalf("Error: Could not list branches of git repository " + workDir + " Error: " + err.Error())
+		}
+		if tags {
+			foundTags, err := gitBackend.listTags(workDir)
+			if err != nil {
+				Fatalf("Error: Could not list tags of git repository " + workDir + " Error: " + err.Error())
+			}
+			branches = append(branches, foundTags...)
+		}
+		for _, branch := range branches {
+			if len(branchParam) > 0 && branch != branchParam {
+				continue
+			}
+			if len(sa.FilterCommand) > 0 && skipBasedOnFilterCommand(branch, source, sa, workDir) {
+				Debugf("Skipping branch " + branch + " of source " + source + ", because of filter_command setting")
+				continue
+			}
+			if len(sa.FilterRegex) > 0 && skipBasedOnFilterRegex(branch, source, sa, workDir) {
+				Debugf("Skipping branch " + branch + " of source " + source + ", because of filter_regex setting")
+				continue
+			}
+			branchFunc(workDir, branch, sa)
+			puppetfile, ok := readPuppetfileFromGit(workDir, branch, sa.PrivateKey, source, sa.ForceForgeVersions)
+			if !ok {
+				Debugf("Skipping branch " + branch + " of source " + source + ", because it does not contain a Puppetfile")
+				continue
+			}
+			puppetfile.controlRepoBranch = branch
+			puppetfiles[source+"/"+branch] = puppetfile
+		}
+	}
+	return puppetfiles
+}
+
+// moduleTree returns the branch, tag or commit of the git module, the default branch of its cached git repository if it has none
+func moduleTree(gm GitModule) string {
+	if len(gm.tree) > 0 {
+		return gm.tree
+	}
+	return detectDefaultBranch(gm, gitCacheDir(gm.git))
+}
+
+// addLFSObjects adds the cached Git LFS objects of the git modules of the Puppetfile with :lfs,
+// moduleCommit returns the commit of the git module whose Git LFS objects are needed
+// It returns the Git LFS objects which are not in the cachedir by the git URL of their git module
+func (refs cacheReferences) addLFSObjects(puppetfile Puppetfile, moduleCommit func(gitName string, gm GitModule) string) map[string][]string {
+	missing := make(map[string][]string)
+	for gitName, gm := range puppetfile.gitModules {
+		if !gm.lfs || gm.local {
+			continue
+		}
+		commit := moduleCommit(gitName, gm)
+		if len(commit) == 0 {
+			continue
+		}
+		pointers, err := gitBackend.lfsPointers(gitCacheDir(gm.git), commit)
+		if err != nil {
+			Warnf("WARN: Could not find the Git LFS pointer files of " + redactGitURL(gm.git) + " Error: " + err.Error())
+			continue
+		}
+		for _, pointer := range pointers {
+			if file := lfsObjectFile(pointer.oid); fileExists(file) {
+				refs.paths[file] = true
+			} else {
+				missing[gm.git] = append(missing[gm.git], pointer.oid)
+			}
+		}
+	}
+	return missing
+}
+
+// cacheRelativePath returns path relative to the cachedir with slashes, like it is stored in cache bundles
+func cacheRelativePath(path string) string {
+	rel, err := filepath.Rel(config.CacheDir, path)
+	if err != nil {
+		Fatalf("cacheRelativePath(): " + path + " is not inside of the cachedir " + config.CacheDir)
+	}
+	return filepath.ToSlash(rel)
+}
+
+// writeBundleEntry writes the file, symlink or directory tree path to the tar stream and returns the number of written bytes
+func writeBundleEntry(tw *tar.Writer, root string) (int64, error) {
+	var written int64
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		link := ""
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+			if path == root {
+				// Forge -latest symlinks point to the absolute path of a version in the Forge cache directory
+				link = filepath.Base(link)
+			}
+		}
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		header.Name = cacheRelativePath(path)
+		if d.IsDir() {
+			header.Name += "/"
+		}
+		header.Uid, header.Gid, header.Uname, header.Gname = 0, 0, "", ""
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		n, err := io.Copy(tw, f)
+		written += n
+		return err
+	})
+	return written, err
+}
+
+// runCacheImport merges the cache entries of the cache bundle written by -cache-export into the cachedir.
+// Cached git repositories and Forge -latest symlinks and last-checked files are replaced, existing Forge module versions and Git LFS objects are kept
+func runCacheImport(bundle string) {
+	defer timeTrack(time.Now(), funcName())
+	f, err := os.Open(bundle)
+	if err != nil {
+		Fatalf("runCacheImport(): Could not open cache bundle " + bundle + " Error: " + err.Error())
+	}
+	defer f.Close()
+	zr, err := zstd.NewReader(f)
+	if err != nil {
+		Fatalf("runCacheImport(): Could not read cache bundle " + bundle + " Error: " + err.Error())
+	}
+	defer zr.Close()
+	tr := tar.NewReader(zr)
+
+	header, err := tr.Next()
+	if err != nil || header.Name != cacheBundleManifestName {
+		Fatalf("runCacheImport(): " + bundle + " is not a cache bundle written by -cache-export, because it does not start with " + cacheBundleManifestName)
+	}
+	manifestJSON, err := io.ReadAll(tr)
+	if err != nil {
+		Fatalf("runCacheImport(): Could not read " + cacheBundleManifestName + " of cache bundle " + bundle + " Error: " + err.Error())
+	}
+	var manifest CacheBundleManifest
+	if err := json.Unmarshal(manifestJSON, &manifest); err != nil {
+		Fatalf("runCacheImport(): Could not parse " + cacheBundleManifestName + " of cache bundle " + bundle + " Error: " + err.Error())
+	}
+	entries := make(map[string]CacheBundleEntry)
+	for _, entry := range manifest.Entries {
+		if !validBundleEntry(entry) {
+			Fatalf("runCacheImport(): Refusing to import cache bundle " + bundle + ", because its manifest contains the invalid " + entry.Type + " entry " + entry.Path)
+		}
+		entries[entry.Path] = entry
+	}
+	Debugf("Importing cache bundle " + bundle + " created at " + manifest.CreatedAt.String() + " by g10k " + manifest.G10kVersion + " for " + manifest.Target)
+
+	// extract the bundle next to the cache entries, so that they can be moved into place
+	stagingDir, err := os.MkdirTemp(config.CacheDir, ".import-")
+	if err != nil {
+		Fatalf("runCacheImport(): Could not create temporary directory in " + config.CacheDir + " Error: " + err.Error())
+	}
+	defer purgeDir(stagingDir, "runCacheImport()")
+	resolvedStagingDir, err := filepath.EvalSymlinks(stagingDir)
+	if err != nil {
+		Fatalf("runCacheImport(): Failed to resolve possible symlink " + stagingDir + " Error: " + err.Error())
+	}
+	// parent directories which are known to resolve to a path inside of their entry, this needs to be reset after each created symlink
+	verifiedDirs := make(map[string]bool)
+	// symlinks are checked again after the extraction, because later entries can change where a relative symlink leads to
+	createdSymlinks := make(map[string]string)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			Fatalf("runCacheImport(): Could not read cache bundle " + bundle + " Error: " + err.Error())
+		}
+		entry, ok := bundleEntryOf(header.Name, entries)
+		targetFile, safe := safeJoin(stagingDir, header.Name)
+		if !ok || !safe {
+			Fatalf("runCacheImport(): Refusing to import " + header.Name + " of cache bundle " + bundle + ", because it is not part of an entry of its manifest")
+		}
+		if entry.Type == "git" && !importedGitFile(header.Name, entry.Path) {
+			Debugf("Skipping " + header.Name + " of cache bundle " + bundle + ", because only the objects and refs of cached git repositories get imported")
+			continue
+		}
+		entryRoot := filepath.Join(stagingDir, entry.Path)
+		resolvedEntryRoot := filepath.Join(resolvedStagingDir, entry.Path)
+		// the parent of an entry is one of the cache directories inside of the staging directory
+		parentRoot := resolvedEntryRoot
+		if targetFile == entryRoot {
+			parentRoot = resolvedStagingDir
+		}
+		if !verifyParentDir(targetFile, parentRoot, verifiedDirs) {
+			Fatalf("runCacheImport(): Refusing to import " + header.Name + " of cache bundle " + bundle + ", because one of its parent directories is a symlink pointing outside of " + entry.Path)
+		}
+		if fi, err := os.Lstat(targetFile); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+			// never write through a symlink of an earlier file of the bundle
+			Fatalf("runCacheImport(): Refusing to import " + header.Name + " of cache bundle " + bundle + ", because it replaces an already imported symlink")
+		}
+		if err := os.MkdirAll(filepath.Dir(targetFile), 0755); err != nil {
+			Fatalf("runCacheImport(): Could not create directory " + filepath.Dir(targetFile) + " Error: " + err.Error())
+		}
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(targetFile, 0755); err != nil {
+				Fatalf("runCacheImport(): Could not create directory " + targetFile + " Error: " + err.Error())
+			}
+		case tar.TypeReg:
+			out, err := os.OpenFile(targetFile, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(header.Mode).Perm())
+			if err != nil {
+				Fatalf("runCacheImport(): Could not create file " + targetFile + " Error: " + err.Error())
+			}
+			_, err = io.Copy(out, tr)
+			out.Close()
+			if err != nil {
+				Fatalf("runCacheImport(): Could not extract " + header.Name + " of cache bundle " + bundle + " Error: " + err.Error())
+			}
+			os.Chtimes(targetFile, header.ModTime, header.ModTime)
+		case tar.TypeSymlink:
+			if targetFile == entryRoot {
+				// a Forge -latest symlink, which gets pointed to the Forge cache directory when it is moved into place
+				if entry.Type != "forge" || !strings.HasSuffix(entry.Path, "-latest") || header.Linkname != filepath.Base(header.Linkname) {
+					Fatalf("runCacheImport(): Refusing to import the symlink " + header.Name + " pointing to " + header.Linkname + " of cache bundle " + bundle)
+				}
+			} else if filepath.IsAbs(header.Linkname) || !isInsideDir(filepath.Join(filepath.Dir(targetFile), header.Linkname), entryRoot) {
+				Fatalf("runCacheImport(): Refusing to import the symlink " + header.Name + " of cache bundle " + bundle + ", because it points to " + header.Linkname + " outside of " + entry.Path)
+			}
+			if err := os.Symlink(header.Linkname, targetFile); err != nil {
+				Fatalf("runCacheImport(): Could not create symlink " + targetFile + " Error: " + err.Error())
+			}
+			clear(verifiedDirs)
+			if targetFile != entryRoot {
+				createdSymlinks[targetFile] = resolvedEntryRoot
+			}
+		default:
+			Fatalf("runCacheImport(): Refusing to import " + header.Name + " of cache bundle " + bundle + ", because of its unsupported type " + string(header.Typeflag))
+		}
+	}
+
+	for symlink, resolvedEntryRoot := range createdSymlinks {
+		if _, ok := resolveSymlink(symlink, resolvedEntryRoot); !ok {
+			Fatalf("runCacheImport(): Refusing to import " + strings.TrimPrefix(symlink, stagingDir+"/") + " of cache bundle " + bundle + ", because it is a symlink which resolves to a path outside of its cache entry")
+		}
+	}
+
+	imported, kept := 0, 0
+	for _, entry := range manifest.Entries {
+		src := filepath.Join(stagingDir, entry.Path)
+		dst := filepath.Join(config.CacheDir, entry.Path)
+		if _, err := os.Lstat(src); err != nil {
+			Fatalf("runCacheImport(): Cache bundle " + bundle + " does not contain " + entry.Path + ", which is listed in its manifest")
+		}
+		if entry.Type == "git" {
+			if err := writeGitMirrorConfig(src, entry.URL); err != nil {
+				Fatalf("runCacheImport(): Could not write the git config of " + entry.Path + " Error: " + err.Error())
+			}
+		}
+		_, err := os.Lstat(dst)
+		exists := err == nil
+		replace := entry.Type == "git" || strings.HasSuffix(entry.Path, "-latest") || strings.HasSuffix(entry.Path, "-latest-last-checked")
+		if exists && !replace {
+			Debugf("Keeping existing cache entry " + dst)
+			kept++
+			continue
+		}
+		if exists {
+			Infof("Replacing cache entry "+dst+" with the one of cache bundle "+bundle, slog.String("path", dst))
+			purgeDir(dst, "runCacheImport()")
+		} else {
+			Infof("Importing cache entry "+dst+" from cache bundle "+bundle, slog.String("path", dst))
+		}
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			Fatalf("runCacheImport(): Could not create directory " + filepath.Dir(dst) + " Error: " + err.Error())
+		}
+		if link, err := os.Readlink(src); err == nil && entry.Type == "forge" {
+			err = os.Symlink(filepath.Join(config.ForgeCacheDir, link), dst)
+			if err != nil {
+				Fatalf("runCacheImport(): Could not create symlink " + dst + " Error: " + err.Error())
+			}
+		} else if err := os.Rename(src, dst); err != nil {
+			Fatalf("runCacheImport(): Could not move " + src + " to " + dst + " Error: " + err.Error())
+		}
+		imported++
+	}
+	if !quiet {
+		fmt.Println("Imported " + strconv.Itoa(imported) + " cache entries from " + bundle + " into " + config.CacheDir + " and kept " + strconv.Itoa(kept) + " existing cache entries")
+	}
+}
+
+// validBundleEntry returns true if the cache bundle entry is a git repository, Forge module file or directory or Git LFS object in the matching cache directory
+func validBundleEntry(entry CacheBundleEntry) bool {
+	cleaned := filepath.Clean(filepath.FromSlash(entry.Path))
+	if filepath.IsAbs(cleaned) || cleaned != filepath.FromSlash(entry.Path) || strings.HasPrefix(cleaned, "..") {
+		return false
+	}
+	dst := filepath.Join(config.CacheDir, cleaned)
+	switch entry.Type {
+	case "git":
+		// the URL gets written into the git config of the imported repository
+		if len(entry.URL) == 0 || strings.ContainsAny(entry.URL, "\x00\n\r") {
+			return false
+		}
+		return filepath.Dir(dst) == config.EnvCacheDir || filepath.Dir(dst) == config.ModulesCacheDir
+	case "forge":
+		return filepath.Dir(dst) == config.ForgeCacheDir
+	case "lfs":
+		return isInsideDir(dst, filepath.Join(config.LFSCacheDir, "objects")) && dst != filepath.Join(config.LFSCacheDir, "objects")
+	}
+	return false
+}
+
+// importedGitFile returns true if the file name of a cache bundle is part of the objects or refs of the cached git repository entryPath,
+// everything else like the config and hooks of the exporting host is not imported
+func importedGitFile(name string, entryPath string) bool {
+	rel := strings.TrimPrefix(strings.TrimPrefix(strings.TrimSuffix(name, "/"), entryPath), "/")
+	switch rel {
+	case "", "HEAD", "packed-refs", "objects", "refs":
+		return true
+	case "objects/info/alternates", "objects/info/http-alternates":
+		// alternates could point to any git repository of the host
+		return false
+	}
+	return strings.HasPrefix(rel, "objects/") || strings.HasPrefix(rel, "refs/")
+}
+
+// writeGitMirrorConfig writes the git config git clone --mirror would write for the remote url to the imported git repository gitDir
+func writeGitMirrorConfig(gitDir string, url string) error {
+	quotedURL := `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(url) + `"`
+	content := "[core]\n\trepositoryformatversion = 0\n\tfilemode = true\n\tbare = true\n" +
+		"[remote \"origin\"]\n\turl = " + quotedURL + "\n\tfetch = +refs/*:refs/*\n\tmirror = true\n"
+	return os.WriteFile(filepath.Join(gitDir, "config"), []byte(content), 0644)
+}
+
+// bundleEntryOf returns the manifest entry the file name of a cache bundle belongs to
+func bundleEntryOf(name string, entries map[string]CacheBundleEntry) (CacheBundleEntry, bool) {
+	name = strings.TrimSuffix(name, "/")
+	for candidate := name; candidate != "." && candidate != "/"; candidate = filepath.Dir(candidate) {
+		if entry, ok := entries[candidate]; ok {
+			return entry, true
+		}
+	}
+	return CacheBundleEntry{}, false
+}
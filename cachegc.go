@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// defaultCacheGCMaxAge is the minimum age of unreferenced cache entries which -cache-gc removes if cache_gc_max_age is not set
+const defaultCacheGCMaxAge = 24 * time.Hour
+
+// cacheReferences contains the cache entries the sources of the g10k config and their deployed Puppet environments still need
+type cacheReferences struct {
+	// paths contains the referenced git repositories in the environments and modules cache directories and the referenced Forge cache entries
+	paths map[string]bool
+	// submodulesChecked contains the cached git repositories and commits whose submodules were already added to paths
+	submodulesChecked map[string]bool
+}
+
+// runCacheGC removes all cached git repositories, Forge module versions, Forge -latest symlinks and last-checked files and Git LFS objects,
+// which are not referenced by the sources of the g10k config and their deployed Puppet environments anymore
+// and whose modification time is older than cache_gc_max_age
+func runCacheGC() {
+	defer timeTrack(time.Now(), funcName())
+	maxAge := config.CacheGCMaxAge
+	if maxAge == 0 {
+		maxAge = defaultCacheGCMaxAge
+	}
+	refs := collectCacheReferences()
+	removed := 0
+	var reclaimed int64
+	for _, cacheDir := range []string{config.EnvCacheDir, config.ModulesCacheDir, config.ForgeCacheDir} {
+		entries, err := os.ReadDir(cacheDir)
+		if err != nil {
+			Debugf("Skipping " + cacheDir + " Error: " + err.Error())
+			continue
+		}
+		for _, e := range entries {
+			entry := filepath.Join(cacheDir, e.Name())
+			if refs.paths[entry] {
+				continue
+			}
+			info, err := e.Info()
+			if err != nil || time.Since(info.ModTime()) < maxAge {
+				Debugf("Keeping unreferenced cache entry " + entry + ", because it is not older than " + maxAge.String())
+				continue
+			}
+			size := reclaimableSize(entry)
+			if dryRun {
+				Infof("Would remove unreferenced cache entry "+entry+" ("+formatSize(size)+")", slog.String("path", entry), slog.Int64("size", size))
+			} else {
+				Infof("Removing unreferenced cache entry "+entry+" ("+formatSize(size)+")", slog.String("path", entry), slog.Int64("size", size))
+				purgeDir(entry, "runCacheGC()")
+			}
+			removed++
+			reclaimed += size
+		}
+	}
+	// the Git LFS objects are stored in the same nested layout as git-lfs uses
+	filepath.WalkDir(filepath.Join(config.LFSCacheDir, "objects"), func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() || refs.paths[path] {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil || time.Since(info.ModTime()) < maxAge {
+			Debugf("Keeping unreferenced Git LFS object " + path + ", because it is not older than " + maxAge.String())
+			return nil
+		}
+		size := reclaimableSize(path)
+		if dryRun {
+			Infof("Would remove unreferenced Git LFS object "+path+" ("+formatSize(size)+")", slog.String("path", path), slog.Int64("size", size))
+		} else {
+			Infof("Removing unreferenced Git LFS object "+path+" ("+formatSize(size)+")", slog.String("path", path), slog.Int64("size", size))
+			purgeDir(path, "runCacheGC()")
+		}
+		removed++
+		reclaimed += size
+		return nil
+	})
+	if !dryRun {
+		gcContentStore()
+	}
+	if !quiet {
+		if dryRun {
+			fmt.Println("Would remove " + strconv.Itoa(removed) + " unreferenced cache entries from " + config.CacheDir + " and reclaim " + formatSize(reclaimed))
+		} else {
+			fmt.Println("Removed " + strconv.Itoa(removed) + " unreferenced cache entries from " + config.CacheDir + " and reclaimed " + formatSize(reclaimed))
+		}
+	}
+}
+
+// collectCacheReferences returns the cache entries of the control repositories of all sources
+// and of the git and Forge modules in the Puppetfiles of their deployed Puppet environments
+func collectCacheReferences() cacheReferences {
+	refs := cacheReferences{paths: make(map[string]bool), submodulesChecked: make(map[string]bool)}
+	for source, sa := range config.Sources {
+		controlRepoDir := filepath.Join(config.EnvCacheDir, source+".git")
+		refs.paths[controlRepoDir] = true
+		environments, _ := filepath.Glob(filepath.Join(normalizeDir(sa.Basedir), resolveSourcePrefix(source, sa)+"*"))
+		for _, env := range environments {
+			pf := filepath.Join(env, "Puppetfile")
+			if !fileExists(pf) {
+				continue
+			}
+			if sa.Submodules {
+				deployFile := filepath.Join(env, ".g10k-deploy.json")
+				if fileExists(deployFile) {
+					refs.addSubmodules(controlRepoDir, readDeployResultFile(deployFile).Signature, sa.Remote)
+				}
+			}
+			Debugf("Collecting the cache entries used by " + pf)
+			branch := strings.TrimPrefix(filepath.Base(env), resolveSourcePrefix(source, sa))
+			puppetfile := readPuppetfile(pf, sa.PrivateKey, source, branch, sa.ForceForgeVersions, false)
+			deployedCommit := func(gitName string, gm GitModule) string {
+				// the submodules and Git LFS objects of the deployed commit of the git module
+				targetDir := filepath.Join(env, gm.moduleDir, gitName)
+				if len(gm.installPath) > 0 {
+					targetDir = filepath.Join(env, gm.installPath, gitName)
+				}
+				commit, _ := os.ReadFile(filepath.Join(targetDir, ".latest_commit"))
+				return string(commit)
+			}
+			refs.addPuppetfile(puppetfile, deployedCommit)
+			refs.addLFSObjects(puppetfile, deployedCommit)
+		}
+	}
+	return refs
+}
+
+// addPuppetfile adds the cache entries of the git and Forge modules of the Puppetfile,
+// moduleCommit returns the commit of a git module with submodules whose submodules are needed
+func (refs cacheReferences) addPuppetfile(puppetfile Puppetfile, moduleCommit func(gitName string, gm GitModule) string) {
+	for gitName, gm := range puppetfile.gitModules {
+		if gm.local {
+			continue
+		}
+		refs.paths[gitCacheDir(gm.git)] = true
+		if gm.submodules {
+			refs.addSubmodules(gitCacheDir(gm.git), moduleCommit(gitName, gm), gm.git)
+		}
+	}
+	for _, fm := range puppetfile.forgeModules {
+		moduleName := fm.author + "-" + fm.name
+		// the Forge API response is used to check for deprecations of all versions
+		refs.paths[filepath.Join(config.ForgeCacheDir, moduleName+"-latest-last-checked")] = true
+		if fm.version == "latest" || fm.version == "present" {
+			latest := filepath.Join(config.ForgeCacheDir, moduleName+"-latest")
+			refs.paths[latest] = true
+			if target, err := filepath.EvalSymlinks(latest); err == nil {
+				refs.paths[filepath.Join(config.ForgeCacheDir, filepath.Base(target))] = true
+				refs.paths[forgeModuleChecksumFile(filepath.Join(config.ForgeCacheDir, filepath.Base(target)))] = true
+			}
+			continue
+		}
+		refs.paths[filepath.Join(config.ForgeCacheDir, moduleName+"-"+fm.version)] = true
+		// -cache-verify needs the recorded checksums of the extracted Forge module, because the archive is usually removed
+		refs.paths[forgeModuleChecksumFile(filepath.Join(config.ForgeCacheDir, moduleName+"-"+fm.version))] = true
+		if checkSum || len(fm.sha256sum) > 0 {
+			// the integrity check needs the archive
+			archive := filepath.Join(config.ForgeCacheDir, moduleName+"-"+fm.version+".tar.gz")
+			refs.paths[archive] = true
+			refs.paths[forgeArchiveChecksumFile(archive)] = true
+		}
+	}
+}
+
+// addSubmodules adds the cached git repositories of the submodules of commit of the cached git repository gitDir and their submodules
+func (refs cacheReferences) addSubmodules(gitDir string, commit string, gitURL string) {
+	if len(commit) == 0 || refs.submodulesChecked[gitDir+" "+commit] || !isDir(gitDir) {
+		return
+	}
+	refs.submodulesChecked[gitDir+" "+commit] = true
+	commits, err := gitBackend.listSubmodules(gitDir, commit)
+	if err != nil || len(commits) == 0 {
+		return
+	}
+	content, _ := gitBackend.showFile(gitDir, commit, ".gitmodules")
+	urls := parseGitmodules(content)
+	for submodulePath, submoduleCommit := range commits {
+		if url, ok := urls[submodulePath]; ok {
+			submoduleURL := resolveSubmoduleURL(gitURL, url)
+			refs.paths[gitCacheDir(submoduleURL)] = true
+			refs.addSubmodules(gitCacheDir(submoduleURL), submoduleCommit, submoduleURL)
+		}
+	}
+}
+
+// reclaimableSize returns the size of all files of path which are not hardlinked anywhere else,
+// because removing hardlinked files does not free any disk space
+func reclaimableSize(path string) int64 {
+	var size int64
+	filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok && info.Mode().IsRegular() && uint64(stat.Nlink) > 1 {
+			return nil
+		}
+		size += info.Size()
+		return nil
+	})
+	return size
+}
+
+// formatSize returns the number of bytes in MiB
+func formatSize(size int64) string {
+	return strconv.FormatFloat(float64(size)/1024/1024, 'f', 1, 64) + " MiB"
+}
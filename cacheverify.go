@@ -0,0 +1,468 @@
+package main
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/pgzip"
+	"github.com/remeh/sizedwaitgroup"
+)
+
+// cacheVerification contains the broken cache entries -cache-verify found and the problem of each entry
+// and the cache entries which could not be verified and the reason
+type cacheVerification struct {
+	sync.Mutex
+	verified     int
+	broken       map[string]string
+	unverifiable map[string]string
+}
+
+// forgeArchiveChecksumFile returns the file with the sha256 sum recorded for the downloaded Forge module archive
+func forgeArchiveChecksumFile(archive string) string {
+	return archive + ".sha256"
+}
+
+// forgeModuleChecksumFile returns the file with the checksums recorded for the files of the extracted Forge module moduleDir,
+// which does not need the Forge module archive, because -cache-gc removes it unless -checksum or :sha256sum is used
+func forgeModuleChecksumFile(moduleDir string) string {
+	return moduleDir + ".sha256sums"
+}
+
+// runCacheVerify checks the cached git repositories, Forge module archives and extracted Forge modules
+// and re-fetches broken entries if repair is true.
+// It returns the number of broken cache entries which are left
+func runCacheVerify(repair bool) int {
+	defer timeTrack(time.Now(), funcName())
+	cv := verifyCacheEntries()
+
+	brokenEntries := []string{}
+	for entry := range cv.broken {
+		brokenEntries = append(brokenEntries, entry)
+	}
+	sort.Strings(brokenEntries)
+	repaired := 0
+	if repair {
+		for _, entry := range brokenEntries {
+			if repairCacheEntry(entry, cv.broken) {
+				repaired++
+			}
+		}
+	}
+
+	if !quiet {
+		fmt.Println("Verified " + strconv.Itoa(cv.verified) + " cache entries in " + config.CacheDir + " and found " + strconv.Itoa(len(brokenEntries)) + " broken and " + strconv.Itoa(len(cv.unverifiable)) + " unverifiable entries")
+		if repair {
+			if dryRun {
+				fmt.Println("Would repair " + strconv.Itoa(repaired) + " broken cache entries")
+			} else {
+				fmt.Println("Repaired " + strconv.Itoa(repaired) + " broken cache entries")
+			}
+		}
+		for _, entry := range brokenEntries {
+			fmt.Println(entry + ": " + cv.broken[entry])
+		}
+	}
+	if dryRun {
+		return len(brokenEntries)
+	}
+	return len(brokenEntries) - repaired
+}
+
+// verifyCacheEntries checks all cache entries in parallel with -maxworker workers
+func verifyCacheEntries() *cacheVerification {
+	cv := &cacheVerification{broken: make(map[string]string), unverifiable: make(map[string]string)}
+	wg := sizedwaitgroup.New(config.Maxworker)
+	for _, cacheDir := range []string{config.EnvCacheDir, config.ModulesCacheDir} {
+		entries, err := os.ReadDir(cacheDir)
+		if err != nil {
+			Debugf("Skipping " + cacheDir + " Error: " + err.Error())
+			continue
+		}
+		for _, e := range entries {
+			if !e.IsDir() {
+				continue
+			}
+			gitDir := filepath.Join(cacheDir, e.Name())
+			wg.Add()
+			go func(gitDir string) {
+				defer wg.Done()
+				cv.check(gitDir, gitBackend.fsck(gitDir))
+			}(gitDir)
+		}
+	}
+	if entries, err := os.ReadDir(config.ForgeCacheDir); err != nil {
+		Debugf("Skipping " + config.ForgeCacheDir + " Error: " + err.Error())
+	} else {
+		for _, e := range entries {
+			entry := filepath.Join(config.ForgeCacheDir, e.Name())
+			if strings.HasSuffix(e.Name(), ".tar.gz") && e.Type().IsRegular() {
+				if !fileExists(forgeArchiveChecksumFile(entry)) {
+					cv.skip(entry, "it has no recorded sha256 sum")
+					continue
+				}
+				wg.Add()
+				go func(archive string) {
+					defer wg.Done()
+					cv.check(archive, verifyForgeArchive(archive))
+				}(entry)
+			} else if e.IsDir() {
+				if fileExists(forgeModuleChecksumFile(entry)) {
+					wg.Add()
+					go func(moduleDir string) {
+						defer wg.Done()
+						cv.check(moduleDir, verifyForgeModuleChecksums(moduleDir))
+					}(entry)
+					continue
+				}
+				if !fileExists(entry + ".tar.gz") {
+					cv.skip(entry, "it has no recorded checksums and its Forge module archive "+entry+".tar.gz does not exist")
+					continue
+				}
+				wg.Add()
+				go func(moduleDir string) {
+					defer wg.Done()
+					cv.check(moduleDir, verifyForgeModuleDir(moduleDir, moduleDir+".tar.gz"))
+				}(entry)
+			}
+		}
+	}
+	wg.Wait()
+	return cv
+}
+
+// check records the cache entry as broken if err is not nil
+func (cv *cacheVerification) check(entry string, err error) {
+	cv.Lock()
+	defer cv.Unlock()
+	cv.verified++
+	if err != nil {
+		Warnf("WARN: cache entry "+entry+" is broken: "+err.Error(), slog.String("path", entry), slog.String("error", err.Error()))
+		cv.broken[entry] = err.Error()
+		return
+	}
+	Debugf("cache entry " + entry + " is ok")
+}
+
+// skip records the cache entry as unverifiable, because nothing was recorded to verify it against
+func (cv *cacheVerification) skip(entry string, reason string) {
+	cv.Lock()
+	defer cv.Unlock()
+	Infof("cache entry "+entry+" is unverifiable, because "+reason, slog.String("path", entry))
+	cv.unverifiable[entry] = reason
+}
+
+// verifyForgeArchive compares the sha256 sum of the Forge module archive with the sha256 sum recorded when it was downloaded
+func verifyForgeArchive(archive string) error {
+	recorded, err := os.ReadFile(forgeArchiveChecksumFile(archive))
+	if err != nil {
+		return err
+	}
+	calculated, err := sha256File(archive)
+	if err != nil {
+		return err
+	}
+	if calculated != strings.TrimSpace(string(recorded)) {
+		return errors.New("calculated sha256sum " + calculated + " does not match the recorded sha256sum " + strings.TrimSpace(string(recorded)))
+	}
+	return nil
+}
+
+// sha256File returns the sha256 sum of file
+func sha256File(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// forgeModuleChecksums returns the type, file mode and sha256 sum or symlink target of every entry of the extracted Forge module moduleDir
+// by its path relative to moduleDir
+func forgeModuleChecksums(moduleDir string) (map[string]string, error) {
+	checksums := make(map[string]string)
+	err := filepath.WalkDir(moduleDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(moduleDir, path)
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		switch {
+		case d.IsDir():
+			checksums[rel] = "dir"
+		case d.Type()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			checksums[rel] = "symlink " + link
+		case d.Type().IsRegular():
+			sum, err := sha256File(path)
+			if err != nil {
+				return err
+			}
+			checksums[rel] = fmt.Sprintf("file %o %s", info.Mode().Perm(), sum)
+		default:
+			checksums[rel] = "other " + info.Mode().Type().String()
+		}
+		return nil
+	})
+	return checksums, err
+}
+
+// recordForgeModuleChecksums writes the checksums of the freshly extracted Forge module moduleDir for -cache-verify
+func recordForgeModuleChecksums(moduleDir string) {
+	checksums, err := forgeModuleChecksums(moduleDir)
+	if err == nil {
+		var content []byte
+		content, err = json.Marshal(checksums)
+		if err == nil {
+			err = os.WriteFile(forgeModuleChecksumFile(moduleDir), content, 0644)
+		}
+	}
+	if err != nil {
+		Warnf("WARN: Could not record the checksums of Forge module " + moduleDir + " Error: " + err.Error())
+	}
+}
+
+// verifyForgeModuleChecksums compares the extracted Forge module moduleDir with the checksums recorded when it was extracted
+// and reports missing, modified and unexpected files
+func verifyForgeModuleChecksums(moduleDir string) error {
+	content, err := os.ReadFile(forgeModuleChecksumFile(moduleDir))
+	if err != nil {
+		return err
+	}
+	recorded := make(map[string]string)
+	if err := json.Unmarshal(content, &recorded); err != nil {
+		return errors.New("could not read the recorded checksums " + forgeModuleChecksumFile(moduleDir) + ": " + err.Error())
+	}
+	current, err := forgeModuleChecksums(moduleDir)
+	if err != nil {
+		return err
+	}
+	paths := []string{}
+	for path := range recorded {
+		paths = append(paths, path)
+	}
+	for path := range current {
+		if _, ok := recorded[path]; !ok {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		want, ok := recorded[path]
+		got, exists := current[path]
+		switch {
+		case !ok:
+			return errors.New("unexpected " + filepath.Join(moduleDir, path))
+		case !exists:
+			return errors.New("missing " + filepath.Join(moduleDir, path))
+		case want != got:
+			return errors.New("modified " + filepath.Join(moduleDir, path))
+		}
+	}
+	return nil
+}
+
+// verifyForgeModuleDir compares the extracted Forge module moduleDir with the entries of its Forge module archive,
+// which unTar would extract, and reports missing, modified and unexpected files
+func verifyForgeModuleDir(moduleDir string, archive string) error {
+	f, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gzipReader, err := pgzip.NewReader(f)
+	if err != nil {
+		return errors.New("could not read Forge module archive " + archive + ": " + err.Error())
+	}
+	defer gzipReader.Close()
+	tarReader := tar.NewReader(gzipReader)
+	expected := map[string]bool{moduleDir: true}
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return errors.New("could not read Forge module archive " + archive + ": " + err.Error())
+		}
+		if header.Typeflag == tar.TypeXGlobalHeader {
+			continue
+		}
+		skiplistFilename := header.Name
+		if components := strings.SplitAfterN(header.Name, "/", 2); len(components) > 1 {
+			skiplistFilename = components[1]
+		}
+		if matchSkiplistContent(skiplistFilename) {
+			continue
+		}
+		target, ok := safeJoin(config.ForgeCacheDir, header.Name)
+		if !ok || !isInsideDir(target, moduleDir) {
+			return errors.New("archive entry " + header.Name + " leads outside of " + moduleDir)
+		}
+		expected[target] = true
+		// archives do not need to contain entries for all parent directories
+		for dir := filepath.Dir(target); !expected[dir] && isInsideDir(dir, moduleDir); dir = filepath.Dir(dir) {
+			expected[dir] = true
+		}
+		fi, err := os.Lstat(target)
+		if err != nil {
+			return errors.New("missing " + target)
+		}
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if !fi.IsDir() {
+				return errors.New(target + " is not a directory")
+			}
+		case tar.TypeReg:
+			if !fi.Mode().IsRegular() || fi.Size() != header.Size {
+				return errors.New("modified " + target)
+			}
+			if fi.Mode().Perm() != os.FileMode(header.Mode).Perm() {
+				return errors.New("modified file mode of " + target)
+			}
+			archived := sha256.New()
+			if _, err := io.Copy(archived, tarReader); err != nil {
+				return errors.New("could not read " + header.Name + " of Forge module archive " + archive + ": " + err.Error())
+			}
+			extracted, err := sha256File(target)
+			if err != nil {
+				return err
+			}
+			if extracted != hex.EncodeToString(archived.Sum(nil)) {
+				return errors.New("modified " + target)
+			}
+		case tar.TypeSymlink:
+			if link, err := os.Readlink(target); err != nil || link != header.Linkname {
+				return errors.New("modified symlink " + target)
+			}
+		case tar.TypeLink:
+			linkTarget, _ := safeJoin(config.ForgeCacheDir, header.Linkname)
+			if linkInfo, err := os.Lstat(linkTarget); err != nil || !os.SameFile(fi, linkInfo) {
+				return errors.New("modified hardlink " + target)
+			}
+		}
+	}
+	var unexpected error
+	filepath.WalkDir(moduleDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if !expected[path] {
+			unexpected = errors.New("unexpected " + path)
+			return filepath.SkipAll
+		}
+		return nil
+	})
+	return unexpected
+}
+
+// repairCacheEntry re-fetches the broken cache entry and returns true if it is not broken anymore
+func repairCacheEntry(entry string, broken map[string]string) bool {
+	if dryRun {
+		Infof("Would repair broken cache entry "+entry, slog.String("path", entry))
+		return true
+	}
+	Infof("Repairing broken cache entry "+entry, slog.String("path", entry))
+	switch {
+	case strings.HasPrefix(entry, config.EnvCacheDir+string(filepath.Separator)) || strings.HasPrefix(entry, config.ModulesCacheDir+string(filepath.Separator)):
+		return repairGitRepository(entry)
+	case strings.HasSuffix(entry, ".tar.gz"):
+		return repairForgeArchive(entry)
+	default:
+		if _, ok := broken[entry+".tar.gz"]; ok {
+			// the extracted Forge module gets replaced together with its broken archive
+			return true
+		}
+		if !fileExists(entry + ".tar.gz") {
+			// the Forge module archive was removed by -cache-gc, download the Forge module again
+			return repairForgeArchive(entry+".tar.gz") && verifyForgeModuleChecksums(entry) == nil
+		}
+		purgeDir(entry, "repairCacheEntry()")
+		f, err := os.Open(entry + ".tar.gz")
+		if err != nil {
+			Warnf("WARN: Could not repair " + entry + " Error: " + err.Error())
+			return false
+		}
+		defer f.Close()
+		gzipReader, err := pgzip.NewReader(f)
+		if err != nil {
+			Warnf("WARN: Could not repair " + entry + " Error: " + err.Error())
+			return false
+		}
+		defer gzipReader.Close()
+		unTar(gzipReader, config.ForgeCacheDir, filepath.Base(entry)+".tar.gz", false)
+		if err := verifyForgeModuleDir(entry, entry+".tar.gz"); err != nil {
+			return false
+		}
+		recordForgeModuleChecksums(entry)
+		return true
+	}
+}
+
+// repairGitRepository replaces the broken cached git repository gitDir with a new mirror of its remote
+func repairGitRepository(gitDir string) bool {
+	gitModule := GitModule{}
+	if strings.HasPrefix(gitDir, config.EnvCacheDir+string(filepath.Separator)) {
+		source := strings.TrimSuffix(filepath.Base(gitDir), ".git")
+		sa, ok := config.Sources[source]
+		if !ok {
+			Warnf("WARN: Could not repair " + gitDir + ", because the source " + source + " is not in the g10k config " + configFile)
+			return false
+		}
+		gitModule.git = sa.Remote
+		gitModule.privateKey = sa.PrivateKey
+	} else {
+		remote, err := gitBackend.remoteURL(gitDir)
+		if err != nil {
+			Warnf("WARN: Could not repair " + gitDir + ", because its remote URL could not be read Error: " + err.Error())
+			return false
+		}
+		gitModule.git = remote
+	}
+	purgeDir(gitDir, "repairGitRepository()")
+	if !doMirrorOrUpdate(gitModule, gitDir, 0) {
+		Warnf("WARN: Could not repair " + gitDir + ", because " + gitModule.git + " could not be cloned")
+		return false
+	}
+	return gitBackend.fsck(gitDir) == nil
+}
+
+// repairForgeArchive downloads the broken Forge module archive and extracts it again
+func repairForgeArchive(archive string) bool {
+	// e.g. puppetlabs-stdlib-6.0.0.tar.gz, Forge module names and authors do not contain dashes
+	nameParts := strings.SplitN(strings.TrimSuffix(filepath.Base(archive), ".tar.gz"), "-", 3)
+	if len(nameParts) != 3 {
+		Warnf("WARN: Could not repair " + archive + ", because it is not named like a Forge module archive")
+		return false
+	}
+	purgeDir(archive, "repairForgeArchive()")
+	purgeDir(forgeArchiveChecksumFile(archive), "repairForgeArchive()")
+	purgeDir(strings.TrimSuffix(archive, ".tar.gz"), "repairForgeArchive()")
+	purgeDir(forgeModuleChecksumFile(strings.TrimSuffix(archive, ".tar.gz")), "repairForgeArchive()")
+	fm := ForgeModule{author: nameParts[0], name: nameParts[1], version: nameParts[2]}
+	downloadForgeModule(nameParts[0]+"-"+nameParts[1], nameParts[2], fm, 1)
+	return verifyForgeArchive(archive) == nil
+}
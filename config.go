@@ -53,6 +53,8 @@ func readConfigfile(configFile string) ConfigSettings {
 	config.ForgeCacheDir = checkDirAndCreate(filepath.Join(config.CacheDir, "forge"), "cachedir/forge")
 	config.ModulesCacheDir = checkDirAndCreate(filepath.Join(config.CacheDir, "modules"), "cachedir/modules")
 	config.EnvCacheDir = checkDirAndCreate(filepath.Join(config.CacheDir, "environments"), "cachedir/environments")
+	config.StoreCacheDir = checkDirAndCreate(filepath.Join(config.CacheDir, "store"), "cachedir/store")
+	config.LFSCacheDir = checkDirAndCreate(filepath.Join(config.CacheDir, "lfs"), "cachedir/lfs")
 
 	if len(config.ForgeBaseURL) == 0 {
 		config.ForgeBaseURL = "https://forgeapi.puppet.com"
@@ -77,6 +79,11 @@ func readConfigfile(configFile string) ConfigSettings {
 		config.GitObjectSyntaxNotSupported = true
 	}
 
+	if len(populationStrategy) > 0 {
+		config.PopulationStrategy = populationStrategy
+	}
+	checkPopulationStrategy(config.PopulationStrategy, configFile)
+
 	// set default max Go routines for Forge and Git module resolution if none is given
 	if !(config.Maxworker > 0) {
 		config.Maxworker = maxworker
@@ -109,6 +116,14 @@ func readConfigfile(configFile string) ConfigSettings {
 		config.ForgeCacheTTL = ttl
 	}
 
+	if len(config.CacheGCMaxAgeString) != 0 {
+		maxAge, err := time.ParseDuration(config.CacheGCMaxAgeString)
+		if err != nil {
+			Fatalf("Error: Can not convert value " + config.CacheGCMaxAgeString + " of config setting cache_gc_max_age to a golang Duration. Valid time units are 300ms, 1.5h or 2h45m. In " + configFile)
+		}
+		config.CacheGCMaxAge = maxAge
+	}
+
 	// check for non-empty config.Deploy which takes precedence over the non-deploy scoped settings
 	// See https://github.com/puppetlabs/r10k/blob/master/doc/dynamic-environments/configuration.mkd#deploy
 	emptyDeploy := DeploySettings{}
@@ -124,6 +139,8 @@ func readConfigfile(configFile string) ConfigSettings {
 		config.Deploy = emptyDeploy
 	}
 
+	config.Hooks = validateHooks(config.Hooks, "hooks", configFile)
+
 	if len(config.PurgeLevels) == 0 {
 		config.PurgeLevels = []string{"deployment", "puppetfile"}
 	}
@@ -136,9 +153,33 @@ func readConfigfile(configFile string) ConfigSettings {
 		if len(sa.AutoCorrectEnvironmentNames) == 0 {
 			sa.AutoCorrectEnvironmentNames = "correct_and_warn"
 		}
+		checkSignatureMode(sa.VerifySignatures, "source "+source+" of "+configFile)
+		if signatureModeLevel(sa.VerifySignatures) > 0 && len(config.Git.GPGKeyring) == 0 && len(config.Git.AllowedSigners) == 0 {
+			Fatalf("Error: verify_signatures of source " + source + " needs the gpg_keyring or allowed_signers setting in the git section. In " + configFile)
+		}
+		sa.Hooks = validateHooks(sa.Hooks, "hooks of source "+source, configFile)
+		if sa.Hooks.MaxConcurrency != 0 {
+			Fatalf("Error: max_concurrency of the hooks can only be set in the global hooks section, not in source " + source + ". In " + configFile)
+		}
 		config.Sources[source] = sa
 	}
 
+	switch config.Git.StrictHostKeyChecking {
+	case "", "yes", "no", "accept-new":
+	default:
+		Fatalf("Error: Invalid value " + config.Git.StrictHostKeyChecking + " for config setting git strict_host_key_checking, valid values are yes, no or accept-new. In " + configFile)
+	}
+	switch config.Git.Backend {
+	case "", "cli", "go-git":
+	default:
+		Fatalf("Error: Invalid value " + config.Git.Backend + " for config setting git backend, valid values are cli or go-git. In " + configFile)
+	}
+	gitBackend = newGitBackend(config.Git.Backend)
+	validateSSHKeys(config.SSHKeys, configFile)
+	validateHTTPSCredentials(config.HTTPSCredentials, configFile)
+	config.HostLimits = validateHostLimits(config.HostLimits, configFile)
+	loadSignatureKeys(config.Git, configFile)
+
 	if validate {
 		Validatef()
 	}
@@ -207,7 +248,7 @@ func readPuppetfile(pf string, sshKey string, source string, branch string, forc
 	reForgeModule := regexp.MustCompile(`^\s*(?:mod)\s+['\"]?([^'\"]+[-/][^'\"]+)['\"](?:\s*)[,]?(.*)`)
 	reForgeAttribute := regexp.MustCompile(`\s*['\"]?([^\s'\"]+)\s*['\"]?(?:=>)?\s*['\"]?([^'\"]+)?`)
 	reGitModule := regexp.MustCompile(`^\s*(?:mod)\s+['\"]?([^'\"/]+)['\"]\s*,(.*)`)
-	reGitAttribute := regexp.MustCompile(`\s*:(git|commit|tag|branch|ref|link|ignore[-_]unreachable|fallback|install_path|default_branch|local|use_ssh_agent)\s*=>\s*['\"]?([^'\"]+)['\"]?`)
+	reGitAttribute := regexp.MustCompile(`\s*:(git|commit|tag|branch|ref|link|ignore[-_]unreachable|fallback|install_path|default_branch|local|use_ssh_agent|ssh_key|submodules|lfs|verify_signatures)\s*=>\s*['\"]?([^'\"]+)['\"]?`)
 	reUniqueGitAttribute := regexp.MustCompile(`\s*:(?:commit|tag|branch|ref|link)\s*=>`)
 	reDanglingAttribute := regexp.MustCompile(`^\s*:[^ ]+\s*=>`)
 	moduleDir := "modules"
@@ -330,7 +371,7 @@ func readPuppetfile(pf string, sshKey string, source string, branch string, forc
 				if strings.Count(gitModuleAttributes, ":git") < 1 && strings.Count(gitModuleAttributes, ":local") < 1 {
 					Fatalf("Error: Missing :git url in " + pf + " for module " + gitModuleName + " line: " + line)
 				}
-				if strings.Count(gitModuleAttributes, ",") > 3 {
+				if strings.Count(gitModuleAttributes, ",") > 7 {
 					Fatalf("Error: Too many attributes in " + pf + " for module " + gitModuleName + " line: " + line)
 				}
 				if _, ok := puppetFile.gitModules[gitModuleName]; ok {
@@ -345,7 +386,7 @@ func readPuppetfile(pf string, sshKey string, source string, branch string, forc
 					Fatalf("Error: Found conflicting git attributes " + cga + "in " + pf + " for module " + gitModuleName + " line: " + line)
 				}
 				puppetFile.gitModules[gitModuleName] = GitModule{}
-				gm := GitModule{moduleDir: moduleDir}
+				gm := GitModule{moduleDir: moduleDir, submodules: config.Sources[source].Submodules, lfs: config.Git.LFS, verifySignatures: config.Sources[source].VerifySignatures}
 				gitModuleAttributesArray := strings.Split(gitModuleAttributes, ",")
 				//fmt.Println("found git mod attribute array ---> ", gitModuleAttributesArray)
 				//fmt.Println("len(gitModuleAttributesArray) --> ", len(gitModuleAttributesArray))
@@ -412,6 +453,26 @@ func readPuppetfile(pf string, sshKey string, source string, branch string, forc
 							Fatalf("Error: Can not convert value " + a[2] + " of parameter " + gitModuleAttribute + " to boolean. In " + pf + " for module " + gitModuleName + " line: " + line)
 						}
 						gm.useSSHAgent = useSSHAgent
+					} else if gitModuleAttribute == "ssh_key" {
+						if _, ok := config.SSHKeys[a[2]]; !ok {
+							Fatalf("Error: Could not find ssh_keys entry " + a[2] + " in the g10k config for parameter " + gitModuleAttribute + ". In " + pf + " for module " + gitModuleName + " line: " + line)
+						}
+						gm.sshKey = a[2]
+					} else if gitModuleAttribute == "submodules" {
+						submodules, err := strconv.ParseBool(a[2])
+						if err != nil {
+							Fatalf("Error: Can not convert value " + a[2] + " of parameter " + gitModuleAttribute + " to boolean. In " + pf + " for module " + gitModuleName + " line: " + line)
+						}
+						gm.submodules = submodules
+					} else if gitModuleAttribute == "lfs" {
+						lfs, err := strconv.ParseBool(a[2])
+						if err != nil {
+							Fatalf("Error: Can not convert value " + a[2] + " of parameter " + gitModuleAttribute + " to boolean. In " + pf + " for module " + gitModuleName + " line: " + line)
+						}
+						gm.lfs = lfs
+					} else if gitModuleAttribute == "verify_signatures" {
+						checkSignatureMode(a[2], pf+" for module "+gitModuleName)
+						gm.verifySignatures = stricterSignatureMode(gm.verifySignatures, a[2])
 					}
 
 				}
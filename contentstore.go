@@ -0,0 +1,335 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// reObjectName matches the SHA-1 and SHA-256 object names g10k writes to the .latest_commit files
+var reObjectName = regexp.MustCompile(`^[0-9a-f]{40}([0-9a-f]{24})?$`)
+
+// contentStoreLocks makes sure that every content store entry gets extracted only once, even if many Puppet environments need it at the same time
+var contentStoreLocks sync.Map
+
+// contentStoreEntry returns the directory of the content store entry that contains the extracted tree of the object name of the git module
+// trees with submodules or LFS objects are stored separately, because their files differ from the same tree without them
+func contentStoreEntry(gitModule GitModule, objectName string) string {
+	repoDir := filepath.Base(gitCacheDir(gitModule.git))
+	if gitModule.submodules {
+		repoDir += "-submodules"
+	}
+	if gitModule.lfs {
+		repoDir += "-lfs"
+	}
+	return filepath.Join(config.StoreCacheDir, repoDir, objectName)
+}
+
+// populateFromContentStore populates targetDir with hardlinks, reflinks or copies of the files of the content store entry of the object name of the git module
+// and extracts the entry from the cached git repository srcDir first if it does not exist yet
+func populateFromContentStore(gitModule GitModule, srcDir string, objectName string, targetDir string) error {
+	entry, err := ensureContentStoreEntry(gitModule, srcDir, objectName)
+	if err != nil {
+		return err
+	}
+	Debugf("Populating " + targetDir + " from content store entry " + entry)
+	if err := linkContentStoreEntry(entry, targetDir); err != nil {
+		return err
+	}
+	return addContentStoreRef(entry, targetDir)
+}
+
+// ensureContentStoreEntry returns the content store entry of the object name of the git module
+// and extracts it from the cached git repository srcDir first if it does not exist yet
+func ensureContentStoreEntry(gitModule GitModule, srcDir string, objectName string) (string, error) {
+	entry := contentStoreEntry(gitModule, objectName)
+	lock, _ := contentStoreLocks.LoadOrStore(entry, &sync.Mutex{})
+	lock.(*sync.Mutex).Lock()
+	defer lock.(*sync.Mutex).Unlock()
+	if !isDir(entry) {
+		if err := createContentStoreEntry(gitModule, srcDir, objectName, entry); err != nil {
+			return "", err
+		}
+	}
+	return entry, nil
+}
+
+// updateFromContentStore updates targetDir, which contains the object name oldObjectName of the git module, to objectName
+// by only replacing and deleting the files that changed between both trees with the files of the content store entry of objectName
+func updateFromContentStore(gitModule GitModule, srcDir string, oldObjectName string, objectName string, targetDir string) error {
+	if !reObjectName.MatchString(oldObjectName) {
+		return errors.New("invalid object name " + oldObjectName + " in " + targetDir)
+	}
+	files, err := gitBackend.changedFiles(srcDir, oldObjectName, objectName)
+	if err != nil {
+		return err
+	}
+	entry, err := ensureContentStoreEntry(gitModule, srcDir, objectName)
+	if err != nil {
+		return err
+	}
+	Debugf("Updating " + strconv.Itoa(len(files)) + " changed files of " + targetDir + " from content store entry " + entry)
+	for _, file := range files {
+		if !filepath.IsLocal(file) {
+			return errors.New("invalid path " + file + " in " + objectName)
+		}
+	}
+	// delete the files first, so that their paths can become directories
+	for _, file := range files {
+		if interrupted() {
+			return runCtx.Err()
+		}
+		if _, err := os.Lstat(filepath.Join(entry, file)); errors.Is(err, fs.ErrNotExist) {
+			if err := os.RemoveAll(filepath.Join(targetDir, file)); err != nil {
+				return err
+			}
+			removeEmptyDirs(targetDir, filepath.Dir(file))
+		}
+	}
+	for _, file := range files {
+		if interrupted() {
+			return runCtx.Err()
+		}
+		if err := updateContentStoreFile(entry, targetDir, file); err != nil {
+			return err
+		}
+	}
+	return addContentStoreRef(entry, targetDir)
+}
+
+// updateContentStoreFile replaces file in targetDir with the file of the content store entry
+// the new file gets populated next to the old one and renamed, so that it never disappears
+func updateContentStoreFile(entry string, targetDir string, file string) error {
+	info, err := os.Lstat(filepath.Join(entry, file))
+	if errors.Is(err, fs.ErrNotExist) {
+		// deleted
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if err := mkdirFromContentStore(entry, targetDir, filepath.Dir(file)); err != nil {
+		return err
+	}
+	target := filepath.Join(targetDir, file)
+	if info.IsDir() {
+		// a submodule, which gets replaced completely
+		if err := os.RemoveAll(target); err != nil {
+			return err
+		}
+		if err := os.Mkdir(target, info.Mode().Perm()); err != nil {
+			return err
+		}
+		return linkContentStoreEntry(filepath.Join(entry, file), target)
+	}
+	if targetInfo, err := os.Lstat(target); err == nil && os.SameFile(info, targetInfo) {
+		// already hardlinked, e.g. with the directory of a submodule or by an interrupted update
+		return nil
+	}
+	tmp := target + ".g10k-tmp"
+	os.Remove(tmp)
+	if info.Mode()&fs.ModeSymlink != 0 {
+		link, err := os.Readlink(filepath.Join(entry, file))
+		if err != nil {
+			return err
+		}
+		err = os.Symlink(link, tmp)
+	} else {
+		err = populateFile(filepath.Join(entry, file), tmp)
+	}
+	if err != nil {
+		return err
+	}
+	if targetInfo, err := os.Lstat(target); err == nil && targetInfo.IsDir() {
+		os.RemoveAll(target)
+	}
+	return os.Rename(tmp, target)
+}
+
+// mkdirFromContentStore creates dir and its parents in targetDir with the permissions of the directories of the content store entry
+// and replaces files that are in the way
+func mkdirFromContentStore(entry string, targetDir string, dir string) error {
+	if dir == "." {
+		return nil
+	}
+	if err := mkdirFromContentStore(entry, targetDir, filepath.Dir(dir)); err != nil {
+		return err
+	}
+	target := filepath.Join(targetDir, dir)
+	if info, err := os.Lstat(target); err == nil {
+		if info.IsDir() {
+			return nil
+		}
+		if err := os.Remove(target); err != nil {
+			return err
+		}
+	}
+	info, err := os.Stat(filepath.Join(entry, dir))
+	if err != nil {
+		return err
+	}
+	return os.Mkdir(target, info.Mode().Perm())
+}
+
+// removeEmptyDirs removes dir and its parents in targetDir as long as they are empty
+func removeEmptyDirs(targetDir string, dir string) {
+	for dir != "." {
+		if err := os.Remove(filepath.Join(targetDir, dir)); err != nil {
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+// createContentStoreEntry extracts the object name of the git repository srcDir into a temporary directory and renames it to entry,
+// so that an interrupted extraction never leaves an incomplete entry behind
+func createContentStoreEntry(gitModule GitModule, srcDir string, objectName string, entry string) error {
+	checkDirAndCreate(filepath.Dir(entry), "content store directory for "+redactGitURL(gitModule.git))
+	tmpDir, err := os.MkdirTemp(filepath.Dir(entry), objectName+".tmp-")
+	if err != nil {
+		return err
+	}
+	Debugf("Extracting " + gitModule.tree + " (" + objectName + ") of " + srcDir + " to content store entry " + entry)
+	if err := extractGitTree(gitModule, srcDir, objectName, tmpDir); err != nil {
+		os.RemoveAll(tmpDir)
+		return err
+	}
+	if interrupted() {
+		os.RemoveAll(tmpDir)
+		return runCtx.Err()
+	}
+	if err := os.Chmod(tmpDir, 0755); err != nil {
+		os.RemoveAll(tmpDir)
+		return err
+	}
+	return os.Rename(tmpDir, entry)
+}
+
+// linkContentStoreEntry recreates the directories and symlinks of the content store entry in targetDir and populates all files with populateFile
+func linkContentStoreEntry(entry string, targetDir string) error {
+	return filepath.WalkDir(entry, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if interrupted() {
+			return runCtx.Err()
+		}
+		rel, err := filepath.Rel(entry, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(targetDir, rel)
+		switch {
+		case d.IsDir():
+			if rel == "." {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			return os.Mkdir(target, info.Mode().Perm())
+		case d.Type()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		default:
+			return populateFile(path, target)
+		}
+	})
+}
+
+// addContentStoreRef records that targetDir uses the content store entry
+// the reference is a symlink to targetDir and only counts as long as the .latest_commit file of targetDir contains the object name of the entry
+func addContentStoreRef(entry string, targetDir string) error {
+	refsDir := checkDirAndCreate(entry+".refs", "references of content store entry")
+	ref := filepath.Join(refsDir, fmt.Sprintf("%x", sha256.Sum256([]byte(targetDir))))
+	os.Remove(ref)
+	return os.Symlink(targetDir, ref)
+}
+
+// gcContentStore removes all content store entries that are not used by any git module directory anymore
+func gcContentStore() {
+	if len(config.StoreCacheDir) == 0 || !isDir(config.StoreCacheDir) {
+		return
+	}
+	defer timeTrack(time.Now(), funcName())
+	repoDirs, err := os.ReadDir(config.StoreCacheDir)
+	if err != nil {
+		Warnf("WARN: Could not read content store " + config.StoreCacheDir + " Error: " + err.Error())
+		return
+	}
+	removed := 0
+	for _, repoDir := range repoDirs {
+		repoPath := filepath.Join(config.StoreCacheDir, repoDir.Name())
+		entries, err := os.ReadDir(repoPath)
+		if err != nil {
+			continue
+		}
+		for _, e := range entries {
+			entry := filepath.Join(repoPath, e.Name())
+			if strings.HasSuffix(e.Name(), ".refs") {
+				if isDir(entry) && !isDir(strings.TrimSuffix(entry, ".refs")) {
+					purgeDir(entry, "gcContentStore(), because the content store entry does not exist")
+				}
+				continue
+			}
+			if strings.Contains(e.Name(), ".tmp-") {
+				// leftover of an interrupted or concurrent extraction
+				if info, err := e.Info(); err == nil && time.Since(info.ModTime()) > time.Hour {
+					purgeDir(entry, "gcContentStore(), because of an incomplete content store entry")
+				}
+				continue
+			}
+			if contentStoreRefs(entry) == 0 {
+				purgeDir(entry, "gcContentStore(), because the content store entry is unused")
+				purgeDir(entry+".refs", "gcContentStore(), because the content store entry is unused")
+				removed++
+			}
+		}
+		if entries, err := os.ReadDir(repoPath); err == nil && len(entries) == 0 {
+			os.Remove(repoPath)
+		}
+	}
+	if removed > 0 {
+		Infof("Removed " + strconv.Itoa(removed) + " unused content store entries from " + config.StoreCacheDir)
+	}
+}
+
+// contentStoreRefs returns the number of git module directories that still use the content store entry and removes stale references
+func contentStoreRefs(entry string) int {
+	refsDir := entry + ".refs"
+	refs, err := os.ReadDir(refsDir)
+	if err != nil {
+		return 0
+	}
+	objectName := filepath.Base(entry)
+	used := 0
+	for _, r := range refs {
+		ref := filepath.Join(refsDir, r.Name())
+		targetDir, err := os.Readlink(ref)
+		if err == nil {
+			content, err := os.ReadFile(filepath.Join(targetDir, ".latest_commit"))
+			if err == nil && string(content) == objectName {
+				used++
+				continue
+			} else if err != nil && !errors.Is(err, fs.ErrNotExist) {
+				// keep the entry if we can not tell
+				used++
+				continue
+			}
+		}
+		Debugf("Removing stale content store reference " + ref + " to " + targetDir)
+		os.Remove(ref)
+	}
+	return used
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+)
+
+// credentialHelper is the git credential helper which answers with the credentials from the environment variables set by credentialEnv
+const credentialHelper = `!f() { test "$1" = get && printf 'username=%s\npassword=%s\n' "$G10K_GIT_USERNAME" "$G10K_GIT_PASSWORD"; }; f`
+
+// credentialEnvVars contains the environment variables which pass the credentials to the credential helper,
+// their values are never logged
+var credentialEnvVars = []string{"G10K_GIT_USERNAME", "G10K_GIT_PASSWORD"}
+
+// HTTPSCredential contains the credentials g10k uses for git repositories with http(s) URLs matching the pattern
+// The password or token is read from a file or an environment variable, so that it does not need to be part of the g10k config
+type HTTPSCredential struct {
+	GitURLPattern `yaml:",inline"`
+	Username      string `yaml:"username"`
+	UsernameEnv   string `yaml:"username_env"`
+	PasswordFile  string `yaml:"password_file"`
+	PasswordEnv   string `yaml:"password_env"`
+	TokenFile     string `yaml:"token_file"`
+	TokenEnv      string `yaml:"token_env"`
+	username      string
+	password      string
+}
+
+// validateHTTPSCredentials checks the https_credentials config settings and reads the configured passwords and tokens
+func validateHTTPSCredentials(credentials map[string]HTTPSCredential, configFile string) {
+	for name, c := range credentials {
+		c.compile("https_credentials", name, configFile)
+		if c.empty() {
+			Fatalf("Error: https_credentials entry " + name + " needs at least one of host, path or regex in config file " + configFile)
+		}
+		secretSources := 0
+		for _, s := range []string{c.PasswordFile, c.PasswordEnv, c.TokenFile, c.TokenEnv} {
+			if len(s) > 0 {
+				secretSources++
+			}
+		}
+		if secretSources != 1 {
+			Fatalf("Error: https_credentials entry " + name + " needs exactly one of password_file, password_env, token_file or token_env in config file " + configFile)
+		}
+
+		c.username = c.Username
+		if len(c.UsernameEnv) > 0 {
+			c.username = os.Getenv(c.UsernameEnv)
+		}
+		isToken := len(c.TokenFile) > 0 || len(c.TokenEnv) > 0
+		if len(c.username) == 0 {
+			if !isToken {
+				Fatalf("Error: https_credentials entry " + name + " needs username or a non-empty username_env for its password in config file " + configFile)
+			}
+			// most git servers accept any username together with an access token
+			c.username = "git"
+		}
+
+		secretFile := c.PasswordFile + c.TokenFile
+		secretEnv := c.PasswordEnv + c.TokenEnv
+		if len(secretFile) > 0 {
+			content, err := os.ReadFile(secretFile)
+			if err != nil {
+				Fatalf("Error: could not read " + secretFile + " of https_credentials entry " + name + " in config file " + configFile + " Error: " + err.Error())
+			}
+			c.password = strings.TrimSpace(string(content))
+		} else {
+			c.password = os.Getenv(secretEnv)
+		}
+		if len(c.password) == 0 {
+			Fatalf("Error: found empty password or token for https_credentials entry " + name + " in config file " + configFile)
+		}
+		registerSecret(c.password)
+		credentials[name] = c
+	}
+}
+
+// httpsCredentialsForGitURL returns the username and password for the http(s) git URL
+// credentials inside of the git URL take precedence over the first https_credentials entry in alphabetical order of their names that matches the git URL
+func httpsCredentialsForGitURL(gitURL string) (string, string, bool) {
+	if !isHTTPGitURL(gitURL) {
+		return "", "", false
+	}
+	if _, username, password, ok := splitGitURLCredentials(gitURL); ok {
+		registerSecret(password)
+		if len(password) == 0 {
+			// e.g. https://<token>@github.com/foo/bar.git
+			registerSecret(username)
+		}
+		return username, password, true
+	}
+	names := []string{}
+	for name := range config.HTTPSCredentials {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		c := config.HTTPSCredentials[name]
+		if c.matches(gitURL) {
+			Debugf("Using https_credentials entry " + name + " for git repo url " + redactGitURL(gitURL))
+			return c.username, c.password, true
+		}
+	}
+	return "", "", false
+}
+
+// credentialEnv returns the environment variables which make git use the credentials for the http(s) git URL
+// The credentials are passed to a git credential helper with environment variables, so that they do not end up in the command line,
+// the git config of the cached repository or the logs. The helper only applies to the scheme and host of the git URL
+func credentialEnv(gitURL string) []string {
+	username, password, ok := httpsCredentialsForGitURL(gitURL)
+	if !ok {
+		return nil
+	}
+	u, err := url.Parse(redactGitURL(gitURL))
+	if err != nil {
+		return nil
+	}
+	helperKey := "credential." + u.Scheme + "://" + u.Host + ".helper"
+	return []string{
+		"GIT_TERMINAL_PROMPT=0",
+		"GIT_CONFIG_COUNT=2",
+		// the empty helper resets all credential helpers configured for this host before
+		"GIT_CONFIG_KEY_0=" + helperKey,
+		"GIT_CONFIG_VALUE_0=",
+		"GIT_CONFIG_KEY_1=" + helperKey,
+		"GIT_CONFIG_VALUE_1=" + credentialHelper,
+		"G10K_GIT_USERNAME=" + username,
+		"G10K_GIT_PASSWORD=" + password,
+	}
+}
@@ -6,16 +6,15 @@ import (
 	"encoding/hex"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
-	"syscall"
 	"time"
 
-	"github.com/fatih/color"
 	"github.com/klauspost/pgzip"
 	"github.com/tidwall/gjson"
 	"github.com/xorpaul/uiprogress"
@@ -169,7 +168,7 @@ func queryForgeAPI(fm ForgeModule) ForgeResult {
 		baseURL = fm.baseURL
 	}
 	url := baseURL + "/v3/modules/" + fm.author + "-" + fm.name + "?exclude_fields=changelog+readme+license+releases"
-	req, err := http.NewRequest("GET", url, nil)
+	req, err := http.NewRequestWithContext(runCtx, "GET", url, nil)
 	if err != nil {
 		Fatalf("queryForgeAPI(): Error creating GET request for Puppetlabs forge API" + err.Error())
 	}
@@ -181,18 +180,23 @@ func queryForgeAPI(fm ForgeModule) ForgeResult {
 		Fatalf("queryForgeAPI(): Error while getting http proxy with golang http.ProxyFromEnvironment()" + err.Error())
 	}
 	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	defer acquireHostLimit(url)()
 	before := time.Now()
 	resp, err := client.Do(req)
+	countForgeHTTPRequest(resp, err)
 	if err != nil {
+		if interrupted() {
+			return ForgeResult{false, "", "", 0}
+		}
 		if config.UseCacheFallback {
-			Warnf("Forge API error, trying to use cache for module " + fm.author + "/" + fm.author + "-" + fm.name)
+			Warnf("Forge API error, trying to use cache for module "+fm.author+"/"+fm.author+"-"+fm.name, slog.String("module", fm.author+"-"+fm.name), slog.String("url", url), slog.String("error", err.Error()))
 			_ = getLatestCachedModule(fm)
 			return ForgeResult{false, "", "", 0}
 		}
 		Fatalf("queryForgeAPI(): Error while issuing the HTTP request to " + url + " Error: " + err.Error())
 	}
 	duration := time.Since(before).Seconds()
-	Verbosef("Querying Forge API " + url + " took " + strconv.FormatFloat(duration, 'f', 5, 64) + "s")
+	Verbosef("Querying Forge API "+url+" took "+strconv.FormatFloat(duration, 'f', 5, 64)+"s", slog.String("module", fm.author+"-"+fm.name), slog.String("url", url), slog.Float64("duration", duration))
 
 	mutex.Lock()
 	syncForgeTime += duration
@@ -253,7 +257,7 @@ func parseForgeAPIResult(json string, fm ForgeModule) ForgeResult {
 		// check the verbosity level
 		// otherwise these warnings mess up the progress bars
 		if info || debug {
-			Warnf("WARN: Forge module " + fm.author + "-" + fm.name + " has been deprecated by its author since " + deprecatedTimestamp.String() + supersededText)
+			Warnf("WARN: Forge module "+fm.author+"-"+fm.name+" has been deprecated by its author since "+deprecatedTimestamp.String()+supersededText, slog.String("module", fm.author+"-"+fm.name))
 		} else {
 			mutex.Lock()
 			forgeModuleDeprecationNotice += "WARN: Forge module " + fm.author + "-" + fm.name + " has been deprecated by its author since " + deprecatedTimestamp.String() + supersededText + "\n"
@@ -280,7 +284,7 @@ func getMetadataForgeModule(fm ForgeModule) ForgeModule {
 		baseURL = fm.baseURL
 	}
 	url := baseURL + "/v3/releases/" + fm.author + "-" + fm.name + "-" + fm.version
-	req, err := http.NewRequest("GET", url, nil)
+	req, err := http.NewRequestWithContext(runCtx, "GET", url, nil)
 	if err != nil {
 		Fatalf("getMetadataForgeModule(): Error while creating GET http request with url " + url + " Error: " + err.Error())
 	}
@@ -291,15 +295,20 @@ func getMetadataForgeModule(fm ForgeModule) ForgeModule {
 		Fatalf("getMetadataForgeModule(): Error while getting http proxy with golang http.ProxyFromEnvironment()" + err.Error())
 	}
 	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	defer acquireHostLimit(url)()
 	before := time.Now()
 	Debugf("GETing " + url)
 	resp, err := client.Do(req)
+	countForgeHTTPRequest(resp, err)
 	duration := time.Since(before).Seconds()
-	Verbosef("GETing Forge metadata from " + url + " took " + strconv.FormatFloat(duration, 'f', 5, 64) + "s")
+	Verbosef("GETing Forge metadata from "+url+" took "+strconv.FormatFloat(duration, 'f', 5, 64)+"s", slog.String("module", fm.author+"-"+fm.name), slog.String("version", fm.version), slog.String("url", url), slog.Float64("duration", duration))
 	mutex.Lock()
 	syncForgeTime += duration
 	mutex.Unlock()
 	if err != nil {
+		if interrupted() {
+			return ForgeModule{}
+		}
 		Fatalf("getMetadataForgeModule(): Error while querying metadata for Forge module " + fm.name + " from " + url + ": " + err.Error())
 	}
 	defer resp.Body.Close()
@@ -334,16 +343,23 @@ func extractForgeModule(wgForgeModule *sync.WaitGroup, file *io.PipeReader, file
 
 	before := time.Now()
 	fileReader, err := pgzip.NewReader(file)
-
-	unTar(fileReader, config.ForgeCacheDir)
-
 	if err != nil {
+		// drain the pipe, otherwise the download gets stuck
+		io.Copy(io.Discard, file)
+		if interrupted() {
+			return
+		}
 		Fatalf(funcName + "(): pgzip reader error for module " + fileName + " error:" + err.Error())
 	}
 	defer fileReader.Close()
 
+	unTar(fileReader, config.ForgeCacheDir, fileName, false)
+	if !interrupted() {
+		recordForgeModuleChecksums(filepath.Join(config.ForgeCacheDir, strings.TrimSuffix(fileName, ".tar.gz")))
+	}
+
 	duration := time.Since(before).Seconds()
-	Verbosef("Extracting " + filepath.Join(config.ForgeCacheDir, fileName) + " took " + strconv.FormatFloat(duration, 'f', 5, 64) + "s")
+	Verbosef("Extracting "+filepath.Join(config.ForgeCacheDir, fileName)+" took "+strconv.FormatFloat(duration, 'f', 5, 64)+"s", slog.String("file", fileName), slog.Float64("duration", duration))
 	mutex.Lock()
 	ioForgeTime += duration
 	mutex.Unlock()
@@ -358,6 +374,8 @@ func downloadForgeModule(name string, version string, fm ForgeModule, retryCount
 
 	//url := "https://forgeapi.puppet.com/v3/files/puppetlabs-apt-2.1.1.tar.gz"
 	fileName := name + "-" + version + ".tar.gz"
+	// the download holds its host_limits slot until the archive is written and extracted
+	release := func() {}
 
 	if !isDir(filepath.Join(config.ForgeCacheDir, name+"-"+version)) {
 		baseURL := config.ForgeBaseURL
@@ -365,7 +383,7 @@ func downloadForgeModule(name string, version string, fm ForgeModule, retryCount
 			baseURL = fm.baseURL
 		}
 		url := baseURL + "/v3/files/" + fileName
-		req, err := http.NewRequest("GET", url, nil)
+		req, err := http.NewRequestWithContext(runCtx, "GET", url, nil)
 		if err != nil {
 			Fatalf("getMetadataForgeModule(): Error while creating GET http request with url " + url + " Error: " + err.Error())
 		}
@@ -376,15 +394,21 @@ func downloadForgeModule(name string, version string, fm ForgeModule, retryCount
 			Fatalf(funcName + "(): Error while getting http proxy with golang http.ProxyFromEnvironment()" + err.Error())
 		}
 		client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+		release = acquireHostLimit(url)
 		before := time.Now()
 		Debugf("GETing " + url)
 		resp, err := client.Do(req)
+		countForgeHTTPRequest(resp, err)
 		duration := time.Since(before).Seconds()
-		Verbosef("GETing " + url + " took " + strconv.FormatFloat(duration, 'f', 5, 64) + "s")
+		Verbosef("GETing "+url+" took "+strconv.FormatFloat(duration, 'f', 5, 64)+"s", slog.String("module", name), slog.String("version", version), slog.String("url", url), slog.Float64("duration", duration))
 		mutex.Lock()
 		syncForgeTime += duration
 		mutex.Unlock()
 		if err != nil {
+			if interrupted() {
+				release()
+				return
+			}
 			Fatalf(funcName + "(): Error while GETing Forge module " + name + " from " + url + ": " + err.Error())
 		}
 		defer resp.Body.Close()
@@ -400,7 +424,13 @@ func downloadForgeModule(name string, version string, fm ForgeModule, retryCount
 					Fatalf(funcName + "(): Error while creating file for Forge module " + targetFileName + " Error: " + err.Error())
 				}
 				defer out.Close()
-				io.Copy(out, saveFileR)
+				// record the sha256 sum of the archive for -cache-verify
+				hashSha256 := sha256.New()
+				if _, err := io.Copy(io.MultiWriter(out, hashSha256), saveFileR); err == nil {
+					if err := os.WriteFile(forgeArchiveChecksumFile(targetFileName), []byte(hex.EncodeToString(hashSha256.Sum(nil))+"\n"), 0644); err != nil {
+						Warnf("WARN: Could not write sha256 sum of Forge module archive " + targetFileName + " Error: " + err.Error())
+					}
+				}
 				Debugf(funcName + "(): Finished creating " + targetFileName)
 			}()
 			wgForgeModule.Add(1)
@@ -419,7 +449,7 @@ func downloadForgeModule(name string, version string, fm ForgeModule, retryCount
 				mw := io.MultiWriter(extractW, saveFileW)
 
 				// copy the data into the multiwriter
-				if _, err := io.Copy(mw, resp.Body); err != nil {
+				if _, err := io.Copy(mw, resp.Body); err != nil && !interrupted() {
 					Fatalf("Error while writing to MultiWriter " + err.Error())
 				}
 			}()
@@ -434,6 +464,16 @@ func downloadForgeModule(name string, version string, fm ForgeModule, retryCount
 		Debugf("Using cache for Forge module " + name + " version: " + version)
 	}
 	wgForgeModule.Wait()
+	release()
+
+	if interrupted() {
+		// remove the partially downloaded archive and extracted module, which would otherwise be used as cache
+		purgeDir(filepath.Join(config.ForgeCacheDir, fileName), "downloadForgeModule(), because g10k was interrupted")
+		purgeDir(forgeArchiveChecksumFile(filepath.Join(config.ForgeCacheDir, fileName)), "downloadForgeModule(), because g10k was interrupted")
+		purgeDir(filepath.Join(config.ForgeCacheDir, name+"-"+version), "downloadForgeModule(), because g10k was interrupted")
+		purgeDir(forgeModuleChecksumFile(filepath.Join(config.ForgeCacheDir, name+"-"+version)), "downloadForgeModule(), because g10k was interrupted")
+		return
+	}
 
 	if checkSum || fm.sha256sum != "" {
 		fm.version = version
@@ -443,7 +483,9 @@ func downloadForgeModule(name string, version string, fm ForgeModule, retryCount
 			}
 			Warnf("Retrying...")
 			purgeDir(filepath.Join(config.ForgeCacheDir, fileName), "downloadForgeModule()")
+			purgeDir(forgeArchiveChecksumFile(filepath.Join(config.ForgeCacheDir, fileName)), "downloadForgeModule()")
 			purgeDir(strings.Replace(filepath.Join(config.ForgeCacheDir, fileName), ".tar.gz", "/", -1), "downloadForgeModule()")
+			purgeDir(forgeModuleChecksumFile(filepath.Join(config.ForgeCacheDir, name+"-"+version)), "downloadForgeModule()")
 			// retry if hash sum mismatch found
 			downloadForgeModule(name, version, fm, retryCount-1)
 		}
@@ -476,7 +518,8 @@ func readModuleMetadata(file string) ForgeModule {
 	return ForgeModule{name: moduleName, version: version, author: strings.ToLower(author)}
 }
 
-func resolveForgeModules(modules map[string]ForgeModule) {
+// resolveForgeModules downloads the Forge modules and calls ready with the name of each resolved one
+func resolveForgeModules(modules map[string]ForgeModule, ready func(name string)) {
 	defer timeTrack(time.Now(), funcName())
 	if len(modules) <= 0 {
 		Debugf("empty ForgeModule[] found, skipping...")
@@ -526,8 +569,13 @@ func resolveForgeModules(modules map[string]ForgeModule) {
 			<-concurrentGoroutines
 			defer bar.Incr()
 			defer wg.Done()
-			Debugf("resolveForgeModules(): Trying to get forge module " + m + " with Forge base url " + fm.baseURL + " and CacheTtl set to " + fm.cacheTTL.String())
-			doModuleInstallOrNothing(fm)
+			if !interrupted() {
+				Debugf("resolveForgeModules(): Trying to get forge module " + m + " with Forge base url " + fm.baseURL + " and CacheTtl set to " + fm.cacheTTL.String())
+				before := time.Now()
+				doModuleInstallOrNothing(fm)
+				runReport.recordFetch(forgeFetchKey(fm), time.Since(before).Seconds())
+			}
+			ready(m)
 			done <- true
 		}(m, fm, bar)
 	}
@@ -540,7 +588,7 @@ func check4ForgeUpdate(moduleName string, currentVersion string, latestVersion s
 	Verbosef("found currently deployed Forge module " + moduleName + " in version: " + currentVersion)
 	Verbosef("found latest Forge module of " + moduleName + " in version: " + latestVersion)
 	if currentVersion != latestVersion {
-		color.Yellow("ATTENTION: Forge module: " + moduleName + " latest: " + latestVersion + " currently deployed: " + currentVersion)
+		Warnf("ATTENTION: Forge module: "+moduleName+" latest: "+latestVersion+" currently deployed: "+currentVersion, slog.String("module", moduleName), slog.String("version", currentVersion), slog.String("latest_version", latestVersion))
 		needSyncForgeCount++
 	}
 }
@@ -675,11 +723,18 @@ func syncForgeToModuleDir(name string, m ForgeModule, moduleDir string, correspo
 	//Debugf("m.name " + m.name + " m.version " + m.version + " moduleName " + moduleName)
 	targetDir := filepath.Join(moduleDir, m.name)
 	metadataFile := filepath.Join(targetDir, "metadata.json")
+	fetchKey := forgeFetchKey(m)
+	report := func(action string, version string, oldVersion string, extractDuration float64, errorMessage string) {
+		runReport.recordModule(correspondingPuppetEnvironment, ReportModule{Name: moduleName, Type: "forge", Dir: targetDir, Action: action, Version: version, OldVersion: oldVersion, ExtractDuration: extractDuration, Error: errorMessage, fetchKey: fetchKey})
+	}
+	action := actionCreated
+	oldVersion := ""
 	if m.version == "present" {
 		if fileExists(metadataFile) {
 			Debugf("Nothing to do, found existing Forge module: " + targetDir)
+			me := readModuleMetadata(metadataFile)
+			report(actionUnchanged, me.version, "", 0, "")
 			if check4update {
-				me := readModuleMetadata(metadataFile)
 				latestForgeModules.RLock()
 				check4ForgeUpdate(m.name, me.version, latestForgeModules.m[moduleName])
 				latestForgeModules.RUnlock()
@@ -710,12 +765,16 @@ func syncForgeToModuleDir(name string, m ForgeModule, moduleDir string, correspo
 			}
 			if me.version == m.version {
 				Debugf("Nothing to do, existing Forge module: " + targetDir + " has the same version " + me.version + " as the to be synced version: " + m.version)
+				report(actionUnchanged, me.version, "", 0, "")
 				return
 			}
-			Infof("Need to sync, because existing Forge module: " + targetDir + " has version " + me.version + " and the to be synced version is: " + m.version)
+			action = actionUpdated
+			oldVersion = me.version
+			Infof("Need to sync, because existing Forge module: "+targetDir+" has version "+me.version+" and the to be synced version is: "+m.version, slog.String("environment", correspondingPuppetEnvironment), slog.String("module", moduleName), slog.String("version", m.version), slog.String("old_version", me.version), slog.String("dir", targetDir))
 			createOrPurgeDir(targetDir, "targetDir for module "+me.name)
 		} else {
 			Debugf("Need to purge " + targetDir + ", because it exists without a metadata.json. This shouldn't happen!")
+			action = actionUpdated
 			createOrPurgeDir(targetDir, "targetDir for module "+m.name+" with missing metadata.json")
 		}
 	}
@@ -726,7 +785,7 @@ func syncForgeToModuleDir(name string, m ForgeModule, moduleDir string, correspo
 	}
 	if !isDir(resolvedWorkDir) {
 		if config.UseCacheFallback {
-			Warnf("Failed to use " + resolvedWorkDir + " Trying to use latest cached version of module " + moduleName)
+			Warnf("Failed to use "+resolvedWorkDir+" Trying to use latest cached version of module "+moduleName, slog.String("environment", correspondingPuppetEnvironment), slog.String("module", moduleName), slog.String("version", m.version))
 			resolvedWorkDir = getLatestCachedModule(m)
 		} else {
 			Fatalf(funcName + "(): Forge module not found in dir: " + resolvedWorkDir)
@@ -737,29 +796,18 @@ func syncForgeToModuleDir(name string, m ForgeModule, moduleDir string, correspo
 		Fatalf(funcName + "(): Forge module not found in dir: " + resolvedWorkDir)
 	}
 
-	Infof("Need to sync " + targetDir)
-	if !dryRun {
+	Infof("Need to sync "+targetDir, slog.String("environment", correspondingPuppetEnvironment), slog.String("module", moduleName), slog.String("version", m.version), slog.String("dir", targetDir))
+	version := m.version
+	if version == "latest" {
+		version = readModuleMetadata(filepath.Join(resolvedWorkDir, "metadata.json")).version
+	}
+	if dryRun {
+		mutex.Lock()
+		needSyncForgeCount++
+		mutex.Unlock()
+		report(action, version, oldVersion, 0, "")
+	} else {
 		targetDir = checkDirAndCreate(targetDir, "as targetDir for module "+name)
-		var targetDirDevice, workDirDevice uint64
-		if fileInfo, err := os.Stat(targetDir); err == nil {
-			if fileInfo.Sys() != nil {
-				targetDirDevice = uint64(fileInfo.Sys().(*syscall.Stat_t).Dev)
-			}
-		} else {
-			Fatalf(funcName + "(): Error while os.Stat file " + targetDir)
-		}
-		if fileInfo, err := os.Stat(resolvedWorkDir); err == nil {
-			if fileInfo.Sys() != nil {
-				workDirDevice = uint64(fileInfo.Sys().(*syscall.Stat_t).Dev)
-			}
-		} else {
-			Fatalf(funcName + "(): Error while os.Stat file " + resolvedWorkDir)
-		}
-
-		if targetDirDevice != workDirDevice && !usemove {
-			Fatalf("Error: Can't hardlink Forge module files over different devices. Please consider changing the cachedir setting. ForgeCachedir: " + config.ForgeCacheDir + " target dir: " + targetDir)
-		}
-
 		mutex.Lock()
 		needSyncDirs = append(needSyncDirs, targetDir)
 		if _, ok := needSyncEnvs[correspondingPuppetEnvironment]; !ok {
@@ -768,6 +816,9 @@ func syncForgeToModuleDir(name string, m ForgeModule, moduleDir string, correspo
 		needSyncForgeCount++
 		mutex.Unlock()
 		destination := func(path string, info os.FileInfo, err error) error {
+			if interrupted() {
+				return runCtx.Err()
+			}
 			if err != nil {
 				Fatalf(funcName + "(): Error while calling generic func() Error " + err.Error())
 			}
@@ -793,10 +844,10 @@ func syncForgeToModuleDir(name string, m ForgeModule, moduleDir string, correspo
 						Fatalf(funcName + "(): Failed to helper.moveFile " + path + " to " + targetDir + "/" + target + " Error: " + err.Error())
 					}
 				} else {
-					//Debugf(funcName + "() Trying to hardlink " + path + " to " + filepath.Join(targetDir, target))
-					err = os.Link(path, filepath.Join(targetDir, target))
+					//Debugf(funcName + "() Trying to populate " + path + " to " + filepath.Join(targetDir, target))
+					err = populateFile(path, filepath.Join(targetDir, target))
 					if err != nil {
-						Fatalf(funcName + "(): Failed to hardlink " + path + " to " + targetDir + "/" + target + " Error: " + err.Error())
+						Fatalf(funcName + "(): Failed to populate " + path + " to " + targetDir + "/" + target + " Error: " + err.Error())
 					}
 				}
 			}
@@ -807,12 +858,18 @@ func syncForgeToModuleDir(name string, m ForgeModule, moduleDir string, correspo
 		Debugf(funcName + "() filepath.Walk'ing directory " + resolvedWorkDir)
 		before := time.Now()
 		go func() { c <- filepath.Walk(resolvedWorkDir, destination) }()
-		<-c // Walk done
+		if err := <-c; err != nil && interrupted() {
+			// a partially populated module with a metadata.json would be trusted by the next run
+			purgeDir(targetDir, funcName+"(), because g10k was interrupted")
+			report(actionFailed, version, oldVersion, time.Since(before).Seconds(), "g10k was interrupted while populating")
+			return
+		}
 		duration := time.Since(before).Seconds()
+		report(action, version, oldVersion, duration, "")
 		mutex.Lock()
 		ioForgeTime += duration
 		mutex.Unlock()
-		Verbosef("Populating " + targetDir + " took " + strconv.FormatFloat(duration, 'f', 5, 64) + "s")
+		Verbosef("Populating "+targetDir+" took "+strconv.FormatFloat(duration, 'f', 5, 64)+"s", slog.String("environment", correspondingPuppetEnvironment), slog.String("module", moduleName), slog.String("version", m.version), slog.String("dir", targetDir), slog.Float64("duration", duration))
 	}
 }
 
@@ -872,7 +929,7 @@ func getLatestCachedModule(m ForgeModule) string {
 	latestForgeModules.m[m.author+"-"+m.name] = version
 	latestForgeModules.Unlock()
 
-	Warnf("Using cached version " + version + " for " + m.author + "-" + m.name + "-latest")
+	Warnf("Using cached version "+version+" for "+m.author+"-"+m.name+"-latest", slog.String("module", m.author+"-"+m.name), slog.String("version", version))
 
 	return latest
 }
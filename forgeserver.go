@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+var (
+	// reForgeSlug matches Forge module slugs like puppetlabs-stdlib or puppetlabs/stdlib
+	reForgeSlug = regexp.MustCompile(`^([a-zA-Z0-9]+)[-/]([a-z][a-z0-9_]*)$`)
+	// reForgeReleaseSlug matches Forge release slugs like puppetlabs-stdlib-9.4.1
+	reForgeReleaseSlug = regexp.MustCompile(`^([a-zA-Z0-9]+)[-/]([a-z][a-z0-9_]*)-([0-9][0-9A-Za-z.+-]*)$`)
+)
+
+// ForgeAPIOwner is the owner of a Forge module in the responses of the Forge v3 API
+type ForgeAPIOwner struct {
+	Slug     string `json:"slug"`
+	Username string `json:"username"`
+}
+
+// ForgeAPIModuleSummary is the short form of a Forge module in the responses of the Forge v3 API
+type ForgeAPIModuleSummary struct {
+	Slug  string        `json:"slug"`
+	Name  string        `json:"name"`
+	Owner ForgeAPIOwner `json:"owner"`
+}
+
+// ForgeAPIModule is the response of the /v3/modules/<slug> endpoint of the Forge v3 API
+type ForgeAPIModule struct {
+	ForgeAPIModuleSummary
+	CurrentRelease *ForgeAPIRelease  `json:"current_release"`
+	Releases       []ForgeAPIRelease `json:"releases"`
+	DeprecatedAt   *string           `json:"deprecated_at"`
+	SupersededBy   json.RawMessage   `json:"superseded_by,omitempty"`
+}
+
+// ForgeAPIRelease is the response of the /v3/releases/<slug>-<version> endpoint of the Forge v3 API
+type ForgeAPIRelease struct {
+	Slug       string                 `json:"slug"`
+	Version    string                 `json:"version"`
+	Module     *ForgeAPIModuleSummary `json:"module,omitempty"`
+	Metadata   json.RawMessage        `json:"metadata,omitempty"`
+	FileURI    string                 `json:"file_uri"`
+	FileSize   int64                  `json:"file_size"`
+	FileMd5    string                 `json:"file_md5"`
+	FileSha256 string                 `json:"file_sha256"`
+}
+
+// forgeServer serves the Forge module archives of the Forge cache directory with the subset of the Forge v3 API g10k uses
+type forgeServer struct {
+	// checksums contains the forgeArchiveChecksums of the Forge module archives by path
+	checksums sync.Map
+}
+
+// forgeArchiveChecksums contains the md5 and sha256 sums of a Forge module archive with the size and modification time they were calculated for
+type forgeArchiveChecksums struct {
+	size    int64
+	modTime time.Time
+	md5sum  string
+	sha256  string
+}
+
+// runForgeServer serves the Forge cache directory as a read-only Forge API on address until g10k is interrupted
+func runForgeServer(address string) {
+	server := &http.Server{Addr: address, Handler: newForgeServer(), ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-runCtx.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		server.Shutdown(ctx)
+	}()
+	Infof("Serving the Forge modules of "+config.ForgeCacheDir+" on "+address, slog.String("dir", config.ForgeCacheDir), slog.String("address", address))
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		Fatalf("Error: Could not serve the Forge cache on " + address + " Error: " + err.Error())
+	}
+}
+
+// newForgeServer returns the handler of the Forge v3 API endpoints and of the Prometheus metrics
+func newForgeServer() http.Handler {
+	s := &forgeServer{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /v3/modules/{slug}", s.module)
+	mux.HandleFunc("GET /v3/releases/{slug}", s.release)
+	mux.HandleFunc("GET /v3/files/{file}", s.file)
+	mux.HandleFunc("GET /metrics", serveMetrics)
+	return mux
+}
+
+func (s *forgeServer) module(w http.ResponseWriter, r *http.Request) {
+	m := reForgeSlug.FindStringSubmatch(r.PathValue("slug"))
+	if m == nil {
+		forgeAPIError(w, r, http.StatusBadRequest, "invalid module slug "+r.PathValue("slug"))
+		return
+	}
+	author, name := m[1], m[2]
+	versions := cachedForgeVersions(author, name)
+	if len(versions) == 0 {
+		forgeAPIError(w, r, http.StatusNotFound, "module "+author+"-"+name+" is not cached")
+		return
+	}
+	module := ForgeAPIModule{ForgeAPIModuleSummary: forgeModuleSummary(author, name)}
+	for i := len(versions) - 1; i >= 0; i-- {
+		release, err := s.releaseOf(author, name, versions[i])
+		if err != nil {
+			forgeAPIError(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+		module.Releases = append(module.Releases, release)
+	}
+	current, err := s.releaseOf(author, name, versions[len(versions)-1])
+	if err != nil {
+		forgeAPIError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	current.Metadata = cachedForgeMetadata(author, name, current.Version)
+	module.CurrentRelease = &current
+	// pass on the deprecation of the module from the last response of the Forge API
+	if lastChecked, err := os.ReadFile(filepath.Join(config.ForgeCacheDir, author+"-"+name+"-latest-last-checked")); err == nil {
+		if deprecatedAt := gjson.GetBytes(lastChecked, "deprecated_at"); deprecatedAt.Type == gjson.String {
+			module.DeprecatedAt = &deprecatedAt.Str
+		}
+		if supersededBy := gjson.GetBytes(lastChecked, "superseded_by"); supersededBy.IsObject() {
+			module.SupersededBy = json.RawMessage(supersededBy.Raw)
+		}
+	}
+	forgeAPIResponse(w, r, module)
+}
+
+func (s *forgeServer) release(w http.ResponseWriter, r *http.Request) {
+	m := reForgeReleaseSlug.FindStringSubmatch(r.PathValue("slug"))
+	if m == nil {
+		forgeAPIError(w, r, http.StatusBadRequest, "invalid release slug "+r.PathValue("slug"))
+		return
+	}
+	author, name, version := m[1], m[2], m[3]
+	if !fileExists(forgeArchive(author, name, version)) {
+		forgeAPIError(w, r, http.StatusNotFound, "release "+author+"-"+name+"-"+version+" is not cached")
+		return
+	}
+	release, err := s.releaseOf(author, name, version)
+	if err != nil {
+		forgeAPIError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	summary := forgeModuleSummary(author, name)
+	release.Module = &summary
+	release.Metadata = cachedForgeMetadata(author, name, version)
+	forgeAPIResponse(w, r, release)
+}
+
+func (s *forgeServer) file(w http.ResponseWriter, r *http.Request) {
+	m := reForgeReleaseSlug.FindStringSubmatch(strings.TrimSuffix(r.PathValue("file"), ".tar.gz"))
+	if m == nil || !strings.HasSuffix(r.PathValue("file"), ".tar.gz") {
+		forgeAPIError(w, r, http.StatusNotFound, "invalid file name "+r.PathValue("file"))
+		return
+	}
+	archive := forgeArchive(m[1], m[2], m[3])
+	f, err := os.Open(archive)
+	if err != nil {
+		forgeAPIError(w, r, http.StatusNotFound, "file "+r.PathValue("file")+" is not cached")
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil || !fi.Mode().IsRegular() {
+		forgeAPIError(w, r, http.StatusNotFound, "file "+r.PathValue("file")+" is not cached")
+		return
+	}
+	Verbosef("Serving "+archive+" to "+r.RemoteAddr, slog.String("file", archive), slog.String("remote", r.RemoteAddr))
+	w.Header().Set("Content-Type", "application/gzip")
+	http.ServeContent(w, r, filepath.Base(archive), fi.ModTime(), f)
+}
+
+// releaseOf returns the release of the cached Forge module archive with its checksums
+func (s *forgeServer) releaseOf(author string, name string, version string) (ForgeAPIRelease, error) {
+	archive := forgeArchive(author, name, version)
+	fi, err := os.Stat(archive)
+	if err != nil {
+		return ForgeAPIRelease{}, err
+	}
+	checksums, ok := s.checksums.Load(archive)
+	if !ok || checksums.(forgeArchiveChecksums).size != fi.Size() || !checksums.(forgeArchiveChecksums).modTime.Equal(fi.ModTime()) {
+		f, err := os.Open(archive)
+		if err != nil {
+			return ForgeAPIRelease{}, err
+		}
+		defer f.Close()
+		hashMd5 := md5.New()
+		hashSha256 := sha256.New()
+		if _, err := io.Copy(io.MultiWriter(hashMd5, hashSha256), f); err != nil {
+			return ForgeAPIRelease{}, errors.New("could not read " + archive + ": " + err.Error())
+		}
+		checksums = forgeArchiveChecksums{size: fi.Size(), modTime: fi.ModTime(), md5sum: hex.EncodeToString(hashMd5.Sum(nil)), sha256: hex.EncodeToString(hashSha256.Sum(nil))}
+		s.checksums.Store(archive, checksums)
+	}
+	c := checksums.(forgeArchiveChecksums)
+	slug := author + "-" + name + "-" + version
+	return ForgeAPIRelease{Slug: slug, Version: version, FileURI: "/v3/files/" + slug + ".tar.gz", FileSize: c.size, FileMd5: c.md5sum, FileSha256: c.sha256}, nil
+}
+
+// forgeModuleSummary returns the short form of the Forge module
+func forgeModuleSummary(author string, name string) ForgeAPIModuleSummary {
+	return ForgeAPIModuleSummary{Slug: author + "-" + name, Name: name, Owner: ForgeAPIOwner{Slug: author, Username: author}}
+}
+
+// forgeArchive returns the path of the cached Forge module archive
+func forgeArchive(author string, name string, version string) string {
+	return filepath.Join(config.ForgeCacheDir, author+"-"+name+"-"+version+".tar.gz")
+}
+
+// cachedForgeVersions returns the versions of the Forge module with a cached archive in ascending order
+func cachedForgeVersions(author string, name string) []string {
+	entries, err := os.ReadDir(config.ForgeCacheDir)
+	if err != nil {
+		return nil
+	}
+	prefix := author + "-" + name + "-"
+	versions := []string{}
+	for _, e := range entries {
+		if !e.Type().IsRegular() || !strings.HasPrefix(e.Name(), prefix) || !strings.HasSuffix(e.Name(), ".tar.gz") {
+			continue
+		}
+		if m := reForgeReleaseSlug.FindStringSubmatch(strings.TrimSuffix(e.Name(), ".tar.gz")); m != nil && m[1] == author && m[2] == name {
+			versions = append(versions, m[3])
+		}
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		return compareForgeVersions(versions[i], versions[j]) < 0
+	})
+	return versions
+}
+
+// cachedForgeMetadata returns the metadata.json of the extracted Forge module or nil if it is not extracted
+func cachedForgeMetadata(author string, name string, version string) json.RawMessage {
+	metadata, err := os.ReadFile(filepath.Join(config.ForgeCacheDir, author+"-"+name+"-"+version, "metadata.json"))
+	if err != nil || !json.Valid(metadata) {
+		return nil
+	}
+	return json.RawMessage(metadata)
+}
+
+// compareForgeVersions compares two semantic versions of Forge modules and returns -1, 0 or 1,
+// pre-releases like 1.0.0-rc1 are lower than their release
+func compareForgeVersions(a string, b string) int {
+	aVersion, aPre, aIsPre := strings.Cut(strings.SplitN(a, "+", 2)[0], "-")
+	bVersion, bPre, bIsPre := strings.Cut(strings.SplitN(b, "+", 2)[0], "-")
+	aParts := strings.Split(aVersion, ".")
+	bParts := strings.Split(bVersion, ".")
+	for i := 0; i < len(aParts) || i < len(bParts); i++ {
+		aNumber, bNumber := 0, 0
+		if i < len(aParts) {
+			aNumber, _ = strconv.Atoi(aParts[i])
+		}
+		if i < len(bParts) {
+			bNumber, _ = strconv.Atoi(bParts[i])
+		}
+		if aNumber != bNumber {
+			if aNumber < bNumber {
+				return -1
+			}
+			return 1
+		}
+	}
+	switch {
+	case aIsPre && !bIsPre:
+		return -1
+	case !aIsPre && bIsPre:
+		return 1
+	}
+	return strings.Compare(aPre, bPre)
+}
+
+// forgeAPIResponse writes v as JSON response
+func forgeAPIResponse(w http.ResponseWriter, r *http.Request, v interface{}) {
+	Verbosef("Serving "+r.URL.Path+" to "+r.RemoteAddr, slog.String("path", r.URL.Path), slog.String("remote", r.RemoteAddr))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// forgeAPIError writes an error response like the Forge API does
+func forgeAPIError(w http.ResponseWriter, r *http.Request, status int, message string) {
+	Debugf("Responding with " + strconv.Itoa(status) + " to " + r.URL.Path + " from " + r.RemoteAddr + ": " + message)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{"message": strconv.Itoa(status) + " " + http.StatusText(status), "errors": []string{message}})
+}
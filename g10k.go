@@ -3,6 +3,7 @@ package main
 import (
 	"flag"
 	"fmt"
+	"log/slog"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -27,6 +28,13 @@ var (
 	dryRun                       bool
 	validate                     bool
 	check4update                 bool
+	cacheGC                      bool
+	cacheVerify                  bool
+	cacheRepair                  bool
+	cacheExportFile              string
+	cacheImportFile              string
+	serveForgeAddress            string
+	warmCache                    bool
 	checkSum                     bool
 	gitObjectSyntaxNotSupported  bool
 	moduleDirParam               string
@@ -59,6 +67,8 @@ var (
 	maxworker                    int
 	maxExtractworker             int
 	forgeModuleDeprecationNotice string
+	logFormat                    string
+	populationStrategy           string
 )
 
 // LatestForgeModules contains a map of unique Forge modules
@@ -74,28 +84,38 @@ type ConfigSettings struct {
 	ForgeCacheDir               string
 	ModulesCacheDir             string
 	EnvCacheDir                 string
+	StoreCacheDir               string
+	LFSCacheDir                 string
 	Git                         Git
 	Sources                     map[string]Source
-	Timeout                     int            `yaml:"timeout"`
-	IgnoreUnreachableModules    bool           `yaml:"ignore_unreachable_modules"`
-	Maxworker                   int            `yaml:"maxworker"`
-	MaxExtractworker            int            `yaml:"maxextractworker"`
-	UseCacheFallback            bool           `yaml:"use_cache_fallback"`
-	RetryGitCommands            bool           `yaml:"retry_git_commands"`
-	GitObjectSyntaxNotSupported bool           `yaml:"git_object_syntax_not_supported"`
-	PostRunCommand              []string       `yaml:"postrun"`
-	Deploy                      DeploySettings `yaml:"deploy"`
-	PurgeLevels                 []string       `yaml:"purge_levels"`
-	PurgeAllowList              []string       `yaml:"purge_allowlist"`
-	DeploymentPurgeAllowList    []string       `yaml:"deployment_purge_allowlist"`
-	WriteLock                   string         `yaml:"write_lock"`
-	GenerateTypes               bool           `yaml:"generate_types"`
-	PuppetPath                  string         `yaml:"puppet_path"`
-	PurgeSkiplist               []string       `yaml:"purge_skiplist"`
-	CloneGitModules             bool           `yaml:"clone_git_modules"`
-	ForgeBaseURL                string         `yaml:"forge_base_url"`
-	ForgeCacheTTLString         string         `yaml:"forge_cache_ttl"`
+	SSHKeys                     map[string]SSHKey          `yaml:"ssh_keys"`
+	HTTPSCredentials            map[string]HTTPSCredential `yaml:"https_credentials"`
+	HostLimits                  map[string]HostLimit       `yaml:"host_limits"`
+	Timeout                     int                        `yaml:"timeout"`
+	IgnoreUnreachableModules    bool                       `yaml:"ignore_unreachable_modules"`
+	Maxworker                   int                        `yaml:"maxworker"`
+	MaxExtractworker            int                        `yaml:"maxextractworker"`
+	UseCacheFallback            bool                       `yaml:"use_cache_fallback"`
+	RetryGitCommands            bool                       `yaml:"retry_git_commands"`
+	GitObjectSyntaxNotSupported bool                       `yaml:"git_object_syntax_not_supported"`
+	PostRunCommand              []string                   `yaml:"postrun"`
+	Hooks                       Hooks                      `yaml:"hooks"`
+	Deploy                      DeploySettings             `yaml:"deploy"`
+	PurgeLevels                 []string                   `yaml:"purge_levels"`
+	PurgeAllowList              []string                   `yaml:"purge_allowlist"`
+	DeploymentPurgeAllowList    []string                   `yaml:"deployment_purge_allowlist"`
+	WriteLock                   string                     `yaml:"write_lock"`
+	GenerateTypes               bool                       `yaml:"generate_types"`
+	PuppetPath                  string                     `yaml:"puppet_path"`
+	PurgeSkiplist               []string                   `yaml:"purge_skiplist"`
+	CloneGitModules             bool                       `yaml:"clone_git_modules"`
+	ForgeBaseURL                string                     `yaml:"forge_base_url"`
+	ForgeCacheTTLString         string                     `yaml:"forge_cache_ttl"`
 	ForgeCacheTTL               time.Duration
+	PopulationStrategy          string `yaml:"population_strategy"`
+	IncrementalGitUpdates       bool   `yaml:"incremental_git_updates"`
+	CacheGCMaxAgeString         string `yaml:"cache_gc_max_age"`
+	CacheGCMaxAge               time.Duration
 }
 
 // DeploySettings is a struct for settings for controlling how g10k deploys behave.
@@ -117,9 +137,15 @@ type Forge struct {
 }
 
 // Git is a simple struct that contains the optional SSH private key to
-// use for authentication
+// use for authentication and the SSH host key verification settings
 type Git struct {
-	privateKey string `yaml:"private_key"`
+	privateKey            string `yaml:"private_key"`
+	StrictHostKeyChecking string `yaml:"strict_host_key_checking"`
+	KnownHosts            string `yaml:"known_hosts"`
+	Backend               string `yaml:"backend"`
+	LFS                   bool   `yaml:"lfs"`
+	GPGKeyring            string `yaml:"gpg_keyring"`
+	AllowedSigners        string `yaml:"allowed_signers"`
 }
 
 // Source contains basic information about a Puppet environment repository
@@ -136,6 +162,9 @@ type Source struct {
 	FilterCommand               string `yaml:"filter_command"`
 	FilterRegex                 string `yaml:"filter_regex"`
 	StripComponent              string `yaml:"strip_component"`
+	Submodules                  bool   `yaml:"submodules"`
+	VerifySignatures            string `yaml:"verify_signatures"`
+	Hooks                       Hooks  `yaml:"hooks"`
 }
 
 // Puppetfile contains the key value pairs from the Puppetfile
@@ -184,6 +213,12 @@ type GitModule struct {
 	local             bool
 	moduleDir         string
 	useSSHAgent       bool
+	sshKey            string
+	submodules        bool
+	lfs               bool
+	verifySignatures  string
+	// parentRepositories contains the cached git repositories and commits of the parents of a submodule
+	parentRepositories []string
 }
 
 // ForgeResult is returned by queryForgeAPI and contains if and which version of the Puppetlabs Forge module needs to be downloaded
@@ -210,6 +245,20 @@ type DeployResult struct {
 	PuppetfileChecksum string    `json:"puppetfile_checksum"`
 	GitDir             string    `json:"git_dir"`
 	GitURL             string    `json:"git_url"`
+	// SignatureVerification is the result of the signature verification of the control repository branch
+	SignatureVerification *SignatureVerification `json:"signature_verification,omitempty"`
+	// ModuleSignatureVerifications are the results of the signature verification of the git modules by their module directory
+	ModuleSignatureVerifications map[string]SignatureVerification `json:"module_signature_verifications,omitempty"`
+}
+
+// SignatureVerification is the result of the verification of the GPG or SSH signature of a deployed commit or annotated tag
+type SignatureVerification struct {
+	Mode   string `json:"mode"`
+	Object string `json:"object"`
+	Type   string `json:"type,omitempty"`
+	Signer string `json:"signer,omitempty"`
+	Valid  bool   `json:"valid"`
+	Error  string `json:"error,omitempty"`
 }
 
 func init() {
@@ -238,19 +287,33 @@ func main() {
 	flag.BoolVar(&clonegit, "clonegit", false, "populate the Puppet environment with a git clone of each git Puppet module. Helpful when developing locally with -puppetfile")
 	flag.BoolVar(&force, "force", false, "purge the Puppet environment directory and do a full sync")
 	flag.BoolVar(&dryRun, "dryrun", false, "do not modify anything, just print what would be changed")
+	flag.StringVar(&planFormat, "plan", "", "print a deployment plan in the given format, json or text. Requires -dryrun")
 	flag.BoolVar(&validate, "validate", false, "only validate given configuration and exit")
+	flag.StringVar(&populationStrategy, "populationstrategy", "", "how to populate your Puppet environments with the files of cached Forge and git modules, hardlink, reflink or copy. Hardlinks fall back to reflinks or copies if the cachedir is on a different file system. Overrides the population_strategy setting of the g10k config file")
 	flag.BoolVar(&usemove, "usemove", false, "do not use hardlinks to populate your Puppet environments with Puppetlabs Forge modules. Instead uses simple move commands and purges the Forge cache directory after each run! (Useful for g10k runs inside a Docker container)")
+	flag.BoolVar(&cacheGC, "cache-gc", false, "only remove the cached git repositories and Forge modules that are not used by the sources of the g10k config and their deployed Puppet environments anymore and exit. Use with -dryrun to only print what would be removed")
+	flag.StringVar(&cacheExportFile, "cache-export", "", "only write a zstd compressed tar bundle of the cached git repositories, Forge modules and Git LFS objects needed by the g10k config or Puppetfile to this file and exit. Use with -branch to only export a single branch of the control repositories")
+	flag.StringVar(&cacheImportFile, "cache-import", "", "only merge a cache bundle written by -cache-export into the cachedir and exit")
+	flag.BoolVar(&cacheRepair, "cache-repair", false, "like -cache-verify, but re-fetch the broken cached git repositories and Forge modules. Use with -dryrun to only print what would be repaired")
+	flag.BoolVar(&cacheVerify, "cache-verify", false, "only verify the integrity of the cached git repositories, Forge module archives and extracted Forge modules and exit. Exits with 1 if broken cache entries were found")
+	flag.StringVar(&serveForgeAddress, "serve-forge", "", "only serve the Forge module archives of the cachedir as a read-only Forge API on this address, e.g. :8080, until g10k gets interrupted")
+	flag.BoolVar(&warmCache, "warm-cache", false, "only mirror the git repositories and download the Forge modules of the Puppetfiles of all branches of the control repositories or of the Puppetfile into the cachedir and exit, without populating any Puppet environment")
 	flag.BoolVar(&check4update, "check4update", false, "only check if the is newer version of the Puppet module avaialable. Does implicitly set dryrun to true")
 	flag.BoolVar(&checkSum, "checksum", false, "get the md5 check sum for each Puppetlabs Forge module and verify the integrity of the downloaded archive. Increases g10k run time!")
 	flag.BoolVar(&debug, "debug", false, "log debug output, defaults to false")
 	flag.BoolVar(&verbose, "verbose", false, "log verbose output, defaults to false")
 	flag.BoolVar(&info, "info", false, "log info output, defaults to false")
 	flag.BoolVar(&quiet, "quiet", false, "no output, defaults to false")
+	flag.StringVar(&logFormat, "log-format", "text", "log output format, text or json. json writes structured log messages to stderr")
+	flag.StringVar(&reportFile, "report", "", "write a JSON report with the action taken and the time spent for every processed environment and module to this file")
+	flag.StringVar(&metricsFile, "metrics-file", "", "write Prometheus metrics about the run to this file, e.g. for the node_exporter textfile collector")
 	flag.BoolVar(&usecacheFallback, "usecachefallback", false, "if g10k should try to use its cache for sources and modules instead of failing")
 	flag.BoolVar(&retryGitCommands, "retrygitcommands", false, "if g10k should purge the local repository and retry a failed git command (clone or remote update) instead of failing")
 	flag.BoolVar(&gitObjectSyntaxNotSupported, "gitobjectsyntaxnotsupported", false, "if your git version is too old to support reference syntax like master^{object} use this setting to revert to the older syntax")
 	flag.Parse()
 
+	setupLogging(logFormat)
+
 	configFile = *configFileFlag
 	version := *versionFlag
 
@@ -263,13 +326,25 @@ func main() {
 		dryRun = true
 	}
 
+	if len(planFormat) > 0 {
+		if !dryRun {
+			Fatalf("Error: -plan parameter requires -dryrun")
+		}
+		if planFormat != "json" && planFormat != "text" {
+			Fatalf("Error: unknown -plan format " + planFormat + ", must be json or text")
+		}
+	}
+
 	// check for git executable dependency
 	if _, err := exec.LookPath("git"); err != nil {
 		Fatalf("Error: could not find 'git' executable in PATH")
 	}
 
+	handleSignals()
+
 	target := ""
 	before := time.Now()
+	runStartedAt = before
 	if len(configFile) > 0 {
 		if usemove {
 			Fatalf("Error: -usemove parameter is only allowed in -puppetfile mode!")
@@ -286,15 +361,52 @@ func main() {
 		Debugf("Using as config file: " + configFile)
 		config = readConfigfile(configFile)
 		checkDirAndCreate(config.CacheDir, "cachedir configured value")
+		if cacheGC {
+			runCacheGC()
+			os.Exit(0)
+		}
+		if cacheVerify || cacheRepair {
+			if runCacheVerify(cacheRepair) > 0 {
+				os.Exit(1)
+			}
+			os.Exit(0)
+		}
 		target = configFile
+		if len(cacheImportFile) > 0 {
+			runCacheImport(cacheImportFile)
+			os.Exit(0)
+		}
+		if len(cacheExportFile) > 0 {
+			runCacheExport(cacheExportFile, configFile, nil)
+			os.Exit(0)
+		}
+		if len(serveForgeAddress) > 0 {
+			runForgeServer(serveForgeAddress)
+			os.Exit(0)
+		}
+		if warmCache {
+			runWarmCache(configFile, nil)
+			os.Exit(0)
+		}
 		if len(branchParam) > 0 {
-			resolvePuppetEnvironment(tags, outputNameParam)
 			target += " with branch " + branchParam
+			reportTarget = target
+			resolvePuppetEnvironment(tags, outputNameParam)
 		} else {
 			branchParam = ""
+			reportTarget = target
 			resolvePuppetEnvironment(tags, "")
 		}
 	} else {
+		if cacheGC {
+			Fatalf("Error: -cache-gc parameter requires the -config parameter!")
+		}
+		if cacheVerify || cacheRepair {
+			Fatalf("Error: -cache-verify and -cache-repair parameters require the -config parameter!")
+		}
+		if len(serveForgeAddress) > 0 {
+			Fatalf("Error: -serve-forge parameter requires the -config parameter!")
+		}
 		if pfMode {
 			Debugf("Trying to use as Puppetfile: " + pfLocation)
 			sm := make(map[string]Source)
@@ -313,23 +425,45 @@ func main() {
 			forgeCachedir := checkDirAndCreate(filepath.Join(cachedir, "forge"), "default in pfMode")
 			modulesCacheDir := checkDirAndCreate(filepath.Join(cachedir, "modules"), "default in pfMode")
 			envsCacheDir := checkDirAndCreate(filepath.Join(cachedir, "environments"), "default in pfMode")
-			config = ConfigSettings{CacheDir: cachedir, ForgeCacheDir: forgeCachedir, ModulesCacheDir: modulesCacheDir, EnvCacheDir: envsCacheDir, Sources: sm, ForgeBaseURL: "https://forgeapi.puppet.com", Maxworker: maxworker, UseCacheFallback: usecacheFallback, MaxExtractworker: maxExtractworker, RetryGitCommands: retryGitCommands, GitObjectSyntaxNotSupported: gitObjectSyntaxNotSupported}
+			storeCacheDir := checkDirAndCreate(filepath.Join(cachedir, "store"), "default in pfMode")
+			lfsCacheDir := checkDirAndCreate(filepath.Join(cachedir, "lfs"), "default in pfMode")
+			config = ConfigSettings{CacheDir: cachedir, ForgeCacheDir: forgeCachedir, ModulesCacheDir: modulesCacheDir, EnvCacheDir: envsCacheDir, StoreCacheDir: storeCacheDir, LFSCacheDir: lfsCacheDir, Sources: sm, ForgeBaseURL: "https://forgeapi.puppet.com", Maxworker: maxworker, UseCacheFallback: usecacheFallback, MaxExtractworker: maxExtractworker, RetryGitCommands: retryGitCommands, GitObjectSyntaxNotSupported: gitObjectSyntaxNotSupported, PopulationStrategy: populationStrategy}
+			checkPopulationStrategy(config.PopulationStrategy, "-populationstrategy parameter")
 			// default purge_levels
 			config.PurgeLevels = []string{"puppetfile"}
 			if clonegit {
 				config.CloneGitModules = true
 			}
 			target = pfLocation
+			reportTarget = target
+			if len(cacheImportFile) > 0 {
+				runCacheImport(cacheImportFile)
+				os.Exit(0)
+			}
 			puppetfile := readPuppetfile(target, "", "cmdlineparam", "cmdlineparam", false, false)
 			puppetfile.workDir = ""
 			pfm := make(map[string]Puppetfile)
 			pfm["cmdlineparam"] = puppetfile
+			if len(cacheExportFile) > 0 {
+				runCacheExport(cacheExportFile, pfLocation, pfm)
+				os.Exit(0)
+			}
+			if warmCache {
+				runWarmCache(pfLocation, pfm)
+				os.Exit(0)
+			}
 			resolvePuppetfile(pfm)
 		} else {
 			Fatalf("Error: you need to specify at least a config file or use the Puppetfile mode\nExample call: " + os.Args[0] + " -config test.yaml or " + os.Args[0] + " -puppetfile\n")
 		}
 	}
 
+	exitIfInterrupted()
+
+	if !dryRun {
+		gcContentStore()
+	}
+
 	if usemove {
 		// we can not reuse the Forge cache at all when -usemove gets used, because we can not delete the -latest link for some reason
 		defer purgeDir(config.ForgeCacheDir, "main() -puppetfile mode with -usemove parameter")
@@ -338,15 +472,40 @@ func main() {
 	Debugf("Forge response JSON parsing took " + strconv.FormatFloat(forgeJSONParseTime, 'f', 4, 64) + " seconds")
 	Debugf("Forge modules metadata.json parsing took " + strconv.FormatFloat(metadataJSONParseTime, 'f', 4, 64) + " seconds")
 
-	if !check4update && !quiet {
+	if len(planFormat) > 0 {
+		writePlan(os.Stdout, buildPlan())
+	} else if !check4update && !quiet {
 		if len(forgeModuleDeprecationNotice) > 0 {
 			Warnf(strings.TrimSuffix(forgeModuleDeprecationNotice, "\n"))
 		}
-		fmt.Println("Synced", target, "with", syncGitCount, "git repositories and", syncForgeCount, "Forge modules in "+strconv.FormatFloat(time.Since(before).Seconds(), 'f', 1, 64)+"s with git ("+strconv.FormatFloat(syncGitTime, 'f', 1, 64)+"s sync, I/O", strconv.FormatFloat(ioGitTime, 'f', 1, 64)+"s) and Forge ("+strconv.FormatFloat(syncForgeTime, 'f', 1, 64)+"s query+download, I/O", strconv.FormatFloat(ioForgeTime, 'f', 1, 64)+"s) using", strconv.Itoa(config.Maxworker), "resolve and", strconv.Itoa(config.MaxExtractworker), "extract workers")
+		printSyncSummary(target, time.Since(before).Seconds())
 	}
+	writeRunResults("")
+
 	if dryRun && (needSyncForgeCount > 0 || needSyncGitCount > 0) {
 		os.Exit(1)
 	}
 
 	checkForAndExecutePostrunCommand()
+	exitIfHooksFailed()
+}
+
+// printSyncSummary prints how many git repositories and Forge modules got synced in how much time,
+// with -log-format json as a structured event with the event attribute synced
+func printSyncSummary(target string, duration float64) {
+	if !logJSONEvent(slog.LevelInfo, "Synced "+target, []slog.Attr{
+		slog.String("event", "synced"),
+		slog.String("target", target),
+		slog.Int("git_repositories", syncGitCount),
+		slog.Int("forge_modules", syncForgeCount),
+		slog.Float64("duration", duration),
+		slog.Float64("git_sync_duration", syncGitTime),
+		slog.Float64("git_io_duration", ioGitTime),
+		slog.Float64("forge_sync_duration", syncForgeTime),
+		slog.Float64("forge_io_duration", ioForgeTime),
+		slog.Int("resolve_workers", config.Maxworker),
+		slog.Int("extract_workers", config.MaxExtractworker),
+	}) {
+		fmt.Println("Synced", target, "with", syncGitCount, "git repositories and", syncForgeCount, "Forge modules in "+strconv.FormatFloat(duration, 'f', 1, 64)+"s with git ("+strconv.FormatFloat(syncGitTime, 'f', 1, 64)+"s sync, I/O", strconv.FormatFloat(ioGitTime, 'f', 1, 64)+"s) and Forge ("+strconv.FormatFloat(syncForgeTime, 'f', 1, 64)+"s query+download, I/O", strconv.FormatFloat(ioForgeTime, 'f', 1, 64)+"s) using", strconv.Itoa(config.Maxworker), "resolve and", strconv.Itoa(config.MaxExtractworker), "extract workers")
+	}
 }
@@ -100,7 +100,11 @@ func equalGitModule(a, b GitModule) bool {
 		a.ignoreUnreachable != b.ignoreUnreachable ||
 		a.installPath != b.installPath ||
 		a.local != b.local ||
-		a.useSSHAgent != b.useSSHAgent {
+		a.useSSHAgent != b.useSSHAgent ||
+		a.sshKey != b.sshKey ||
+		a.submodules != b.submodules ||
+		a.lfs != b.lfs ||
+		a.verifySignatures != b.verifySignatures {
 		return false
 	}
 	if len(a.fallback) != len(b.fallback) {
@@ -278,7 +282,7 @@ func TestReadPuppetfileMissingGitAttribute(t *testing.T) {
 }
 
 func TestReadPuppetfileTooManyGitAttributes(t *testing.T) {
-	checkExitCodeAndOutputOfReadPuppetfileSubprocess(t, false, 1, "")
+	checkExitCodeAndOutputOfReadPuppetfileSubprocess(t, false, 1, "Error: Too many attributes in tests/TestReadPuppetfileTooManyGitAttributes for module example_module")
 }
 
 func TestReadPuppetfileConflictingGitAttributesTag(t *testing.T) {
@@ -503,6 +507,127 @@ func TestReadPuppetfileGitDashNSlashNotation(t *testing.T) {
 	}
 }
 
+func TestReadPuppetfileSSHKey(t *testing.T) {
+	quiet = true
+	funcName := strings.Split(funcName(), ".")[len(strings.Split(funcName(), "."))-1]
+	oldConfig := config
+	defer func() { config = oldConfig }()
+	config.SSHKeys = map[string]SSHKey{"internal": {PrivateKey: "/etc/g10k/internal_key"}}
+	got := readPuppetfile("tests/"+funcName, "", "test", "test", false, false)
+
+	fm := make(map[string]ForgeModule)
+	gm := make(map[string]GitModule)
+	gm["example_module"] = GitModule{git: "git@git.internal:puppet/example-module.git", branch: "foo", fallback: []string{"main"}, installPath: "external", ignoreUnreachable: true, sshKey: "internal"}
+
+	expected := Puppetfile{source: "test", gitModules: gm, forgeModules: fm}
+
+	if !equalPuppetfile(got, expected) {
+		fmt.Println("Expected:")
+		spew.Dump(expected)
+		fmt.Println("Got:")
+		spew.Dump(got)
+		t.Errorf("Expected Puppetfile: %+v, but got Puppetfile: %+v", expected, got)
+	}
+}
+
+func TestReadPuppetfileSourceSubmodules(t *testing.T) {
+	quiet = true
+	funcName := strings.Split(funcName(), ".")[len(strings.Split(funcName(), "."))-1]
+	oldConfig := config
+	defer func() { config = oldConfig }()
+	config.Sources = map[string]Source{"test": {Submodules: true}}
+	got := readPuppetfile("tests/"+funcName, "", "test", "test", false, false)
+
+	fm := make(map[string]ForgeModule)
+	gm := make(map[string]GitModule)
+	gm["example_module"] = GitModule{git: "git@github.com:foo/example-module.git", branch: "foo", submodules: true}
+	gm["other_module"] = GitModule{git: "git@github.com:foo/other-module.git", branch: "foo", submodules: false}
+
+	expected := Puppetfile{source: "test", gitModules: gm, forgeModules: fm}
+
+	if !equalPuppetfile(got, expected) {
+		fmt.Println("Expected:")
+		spew.Dump(expected)
+		fmt.Println("Got:")
+		spew.Dump(got)
+		t.Errorf("Expected Puppetfile: %+v, but got Puppetfile: %+v", expected, got)
+	}
+}
+
+func TestReadPuppetfileLFS(t *testing.T) {
+	quiet = true
+	funcName := strings.Split(funcName(), ".")[len(strings.Split(funcName(), "."))-1]
+	got := readPuppetfile("tests/"+funcName, "", "test", "test", false, false)
+
+	fm := make(map[string]ForgeModule)
+	gm := make(map[string]GitModule)
+	gm["example_module"] = GitModule{git: "git@github.com:foo/example-module.git", branch: "foo", lfs: true}
+	gm["other_module"] = GitModule{git: "git@github.com:foo/other-module.git", branch: "foo", lfs: false}
+
+	expected := Puppetfile{source: "test", gitModules: gm, forgeModules: fm}
+
+	if !equalPuppetfile(got, expected) {
+		fmt.Println("Expected:")
+		spew.Dump(expected)
+		fmt.Println("Got:")
+		spew.Dump(got)
+		t.Errorf("Expected Puppetfile: %+v, but got Puppetfile: %+v", expected, got)
+	}
+}
+
+func TestReadPuppetfileVerifySignatures(t *testing.T) {
+	quiet = true
+	funcName := strings.Split(funcName(), ".")[len(strings.Split(funcName(), "."))-1]
+	oldConfig := config
+	defer func() { config = oldConfig }()
+	config.Sources = map[string]Source{"test": {VerifySignatures: "warn"}}
+	got := readPuppetfile("tests/"+funcName, "", "test", "test", false, false)
+
+	fm := make(map[string]ForgeModule)
+	gm := make(map[string]GitModule)
+	gm["example_module"] = GitModule{git: "git@github.com:foo/example-module.git", branch: "foo", verifySignatures: "enforce"}
+	// a Puppetfile can not weaken the verify_signatures mode of its source
+	gm["weakened_module"] = GitModule{git: "git@github.com:foo/weakened-module.git", branch: "foo", verifySignatures: "warn"}
+	gm["other_module"] = GitModule{git: "git@github.com:foo/other-module.git", branch: "foo", verifySignatures: "warn"}
+
+	expected := Puppetfile{source: "test", gitModules: gm, forgeModules: fm}
+
+	if !equalPuppetfile(got, expected) {
+		fmt.Println("Expected:")
+		spew.Dump(expected)
+		fmt.Println("Got:")
+		spew.Dump(got)
+		t.Errorf("Expected Puppetfile: %+v, but got Puppetfile: %+v", expected, got)
+	}
+}
+
+func TestReadPuppetfileAllNewGitAttributes(t *testing.T) {
+	quiet = true
+	funcName := strings.Split(funcName(), ".")[len(strings.Split(funcName(), "."))-1]
+	oldConfig := config
+	defer func() { config = oldConfig }()
+	config.SSHKeys = map[string]SSHKey{"internal": {PrivateKey: "/etc/g10k/internal_key"}}
+	got := readPuppetfile("tests/"+funcName, "", "test", "test", false, false)
+
+	fm := make(map[string]ForgeModule)
+	gm := make(map[string]GitModule)
+	gm["example_module"] = GitModule{git: "git@git.internal:puppet/example-module.git", tag: "v1.0.0", sshKey: "internal", submodules: true, lfs: true, verifySignatures: "enforce"}
+
+	expected := Puppetfile{source: "test", gitModules: gm, forgeModules: fm}
+
+	if !equalPuppetfile(got, expected) {
+		fmt.Println("Expected:")
+		spew.Dump(expected)
+		fmt.Println("Got:")
+		spew.Dump(got)
+		t.Errorf("Expected Puppetfile: %+v, but got Puppetfile: %+v", expected, got)
+	}
+}
+
+func TestReadPuppetfileUnknownSSHKey(t *testing.T) {
+	checkExitCodeAndOutputOfReadPuppetfileSubprocess(t, false, 1, "Error: Could not find ssh_keys entry internal in the g10k config for parameter ssh_key. In tests/TestReadPuppetfileUnknownSSHKey for module example_module")
+}
+
 func TestReadPuppetfileSSHKeyAlreadyLoaded(t *testing.T) {
 	quiet = true
 	funcName := strings.Split(funcName(), ".")[len(strings.Split(funcName(), "."))-1]
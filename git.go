@@ -2,10 +2,9 @@ package main
 
 import (
 	"fmt"
+	"log/slog"
 	"os"
-	"os/exec"
 	"path/filepath"
-	"runtime"
 	"strconv"
 	"strings"
 	"sync"
@@ -14,7 +13,10 @@ import (
 	"github.com/xorpaul/uiprogress"
 )
 
-func resolveGitRepositories(uniqueGitModules map[string]GitModule) {
+// resolveGitRepositories mirrors or updates the git repositories of the git modules and resolves all branches, tags and commits
+// gitModuleTrees contains per git repository with one batched git operation
+// ready gets called with the git URL of each git repository as soon as it is resolved
+func resolveGitRepositories(uniqueGitModules map[string]GitModule, gitModuleTrees map[string]map[string]struct{}, ready func(url string)) {
 	defer timeTrack(time.Now(), funcName())
 	if len(uniqueGitModules) <= 0 {
 		Debugf("uniqueGitModules[] is empty, skipping...")
@@ -57,7 +59,7 @@ func resolveGitRepositories(uniqueGitModules map[string]GitModule) {
 	wg.Add(len(uniqueGitModules))
 
 	for url, gm := range uniqueGitModules {
-		privateKey := gm.privateKey
+		privateKey, _ := sshSettingsForGitModule(gm, false)
 		go func(url string, gm GitModule, bar *uiprogress.Bar) {
 			// Try to receive from the concurrentGoroutines channel. When we have something,
 			// it means we can start a new goroutine because another one finished.
@@ -69,21 +71,31 @@ func resolveGitRepositories(uniqueGitModules map[string]GitModule) {
 
 			if gm.useSSHAgent {
 				Debugf("git repo url " + url + " with loaded SSH keys from ssh-agent")
-			} else if len(gm.privateKey) > 0 {
+			} else if len(privateKey) > 0 {
 				Debugf("git repo url " + url + " with SSH key " + privateKey)
 			} else {
 				Debugf("git repo url " + url + " without ssh key")
 			}
 
-			//log.Println(config)
-			// create save directory name from Git repo name
-			repoDir := strings.Replace(strings.Replace(url, "/", "_", -1), ":", "-", -1)
-			workDir := filepath.Join(config.ModulesCacheDir, repoDir)
+			workDir := gitCacheDir(gm.git)
 
-			success := doMirrorOrUpdate(gm, workDir, 0)
-			if !success && !config.UseCacheFallback {
-				Fatalf("Fatal: Failed to clone or pull " + url + " to " + workDir)
+			if !interrupted() {
+				before := time.Now()
+				success := doMirrorOrUpdate(gm, workDir, 0)
+				runReport.recordFetch(url, time.Since(before).Seconds())
+				if !success && !config.UseCacheFallback && !interrupted() {
+					Fatalf("Fatal: Failed to clone or pull " + url + " to " + workDir)
+				}
+				trees := []string{}
+				for tree := range gitModuleTrees[url] {
+					if len(tree) == 0 {
+						tree = detectDefaultBranch(gm, workDir)
+					}
+					trees = append(trees, tree)
+				}
+				resolvedRefs.prefetch(workDir, trees)
 			}
+			ready(url)
 			done <- true
 		}(url, gm, bar)
 	}
@@ -98,67 +110,53 @@ func doMirrorOrUpdate(gitModule GitModule, workDir string, retryCount int) bool
 	isControlRepo := strings.HasPrefix(workDir, config.EnvCacheDir)
 	isInModulesCacheDir := strings.HasPrefix(workDir, config.ModulesCacheDir)
 
-	explicitlyLoadSSHKey := true
-	if len(gitModule.privateKey) == 0 || strings.Contains(gitModule.git, "github.com") || gitModule.useSSHAgent || strings.HasPrefix(gitModule.git, "https://") {
-		if gitModule.useSSHAgent || len(gitModule.privateKey) == 0 {
-			explicitlyLoadSSHKey = false
-		} else if isControlRepo {
-			explicitlyLoadSSHKey = true
-		} else {
-			explicitlyLoadSSHKey = false
-		}
-	}
-	er := ExecResult{}
-	gitCmd := "git clone --mirror " + gitModule.git + " " + workDir
-	if config.CloneGitModules && !isControlRepo && !isInModulesCacheDir {
-		// only clone here, because we can't be sure if a branch is used or a commit hash or tag
-		// we switch to the defined reference later
-		gitCmd = "git clone " + gitModule.git + " " + workDir
-	}
+	resolvedRefs.invalidate(workDir)
+	isClone := true
+	// only clone here for git modules outside of the cache, because we can't be sure if a branch is used or a commit hash or tag
+	// we switch to the defined reference later
+	mirror := !config.CloneGitModules || isControlRepo || isInModulesCacheDir
 	if isDir(workDir) {
-		if detectGitRemoteURLChange(workDir, gitModule.git) && isControlRepo {
+		if detectGitRemoteURLChange(workDir, redactGitURL(gitModule.git)) && isControlRepo {
 			purgeDir(workDir, "git remote url changed")
 		} else {
-			gitCmd = "git --git-dir " + workDir + " remote update --prune"
+			isClone = false
 		}
 	}
 
-	// check if git URL does match NO_PROXY
-	disableHttpProxy := false
-	if matchGitRemoteURLNoProxy(gitModule.git) {
-		disableHttpProxy = true
-	}
-
-	if explicitlyLoadSSHKey {
-		sshAddCmd := "ssh-add "
-		if runtime.GOOS == "darwin" {
-			sshAddCmd = "ssh-add -K "
-		}
-		er = executeCommand("ssh-agent bash -c '"+sshAddCmd+gitModule.privateKey+"; "+gitCmd+"'", "", config.Timeout, gitModule.ignoreUnreachable, disableHttpProxy)
+	var err error
+	release := acquireHostLimit(gitModule.git)
+	if isClone {
+		err = gitBackend.clone(gitModule, workDir, mirror, isControlRepo)
 	} else {
-		er = executeCommand(gitCmd, "", config.Timeout, gitModule.ignoreUnreachable, disableHttpProxy)
+		err = gitBackend.update(gitModule, workDir, isControlRepo)
 	}
-
-	if er.returnCode != 0 {
+	release()
+	if err != nil {
+		if interrupted() {
+			if isClone {
+				// do not leave a partial mirror behind, which the next run would trust
+				purgeDir(workDir, "doMirrorOrUpdate, because g10k was interrupted while cloning")
+			}
+			return false
+		}
 		if config.UseCacheFallback {
-			Warnf("WARN: git repository " + gitModule.git + " does not exist or is unreachable at this moment!")
-			Warnf("WARN: Trying to use cache for " + gitModule.git + " git repository")
+			Warnf("WARN: git repository "+gitModule.git+" does not exist or is unreachable at this moment!", slog.String("git_url", gitModule.git), slog.String("error", err.Error()))
+			Warnf("WARN: Trying to use cache for "+gitModule.git+" git repository", slog.String("git_url", gitModule.git))
 			return false
 		} else if config.RetryGitCommands && retryCount > -1 {
-			Warnf("WARN: git command failed: " + gitCmd + " deleting local cached repository and retrying...")
+			gitCmd := gitErrorCommand(err)
+			Warnf("WARN: git command failed: "+gitCmd+" deleting local cached repository and retrying...", slog.String("git_url", gitModule.git), slog.String("command", gitCmd), slog.String("error", err.Error()))
 			purgeDir(workDir, "doMirrorOrUpdate, because git command failed, retrying")
 			return doMirrorOrUpdate(gitModule, workDir, retryCount-1)
 		}
-		Warnf("WARN: git repository " + gitModule.git + " does not exist or is unreachable at this moment! Error: " + er.output)
+		Warnf("WARN: git repository "+gitModule.git+" does not exist or is unreachable at this moment! Error: "+err.Error(), slog.String("git_url", gitModule.git), slog.String("error", err.Error()))
 		return false
 	}
 
-	if config.CloneGitModules && !isControlRepo && !isInModulesCacheDir {
+	if !mirror {
 		// if clone of git modules was specified, switch to the module and try to switch to the reference commit hash/tag/branch
-		gitCmd = "git checkout " + gitModule.tree
-		er = executeCommand(gitCmd, workDir, config.Timeout, gitModule.ignoreUnreachable, disableHttpProxy)
-		if er.returnCode != 0 {
-			Warnf("WARN: git repository " + gitModule.git + " does not exist or is unreachable at this moment! Error: " + er.output)
+		if err := gitBackend.checkout(gitModule, workDir, isControlRepo); err != nil {
+			Warnf("WARN: git repository "+gitModule.git+" does not exist or is unreachable at this moment! Error: "+err.Error(), slog.String("git_url", gitModule.git), slog.String("ref", gitModule.tree), slog.String("error", err.Error()))
 			return false
 		}
 	}
@@ -168,6 +166,9 @@ func doMirrorOrUpdate(gitModule GitModule, workDir string, retryCount int) bool
 
 func syncToModuleDir(gitModule GitModule, srcDir string, targetDir string, correspondingPuppetEnvironment string) bool {
 	startedAt := time.Now()
+	if interrupted() {
+		return false
+	}
 	mutex.Lock()
 	syncGitCount++
 	mutex.Unlock()
@@ -176,39 +177,53 @@ func syncToModuleDir(gitModule GitModule, srcDir string, targetDir string, corre
 			Fatalf("Could not find cached git module " + srcDir)
 		}
 	}
-	revParseCmd := "git --git-dir " + srcDir + " rev-parse --verify '" + gitModule.tree
-	if !config.GitObjectSyntaxNotSupported {
-		revParseCmd = revParseCmd + "^{object}'"
-	} else {
-		revParseCmd = revParseCmd + "'"
-	}
-
 	isControlRepo := strings.HasPrefix(srcDir, config.EnvCacheDir)
+	logAttrs := []slog.Attr{slog.String("environment", correspondingPuppetEnvironment), slog.String("ref", gitModule.tree), slog.String("dir", targetDir)}
+	if !isControlRepo {
+		logAttrs = append(logAttrs, slog.String("module", filepath.Base(targetDir)), slog.String("git_url", gitModule.git))
+	}
+	report := func(action string, commit string, oldCommit string, extractDuration float64, errorMessage string) {
+		if isControlRepo {
+			runReport.recordEnvironmentSync(correspondingPuppetEnvironment, action, commit, oldCommit, extractDuration, errorMessage)
+		} else {
+			runReport.recordModule(correspondingPuppetEnvironment, ReportModule{Name: filepath.Base(targetDir), Type: "git", Dir: targetDir, Action: action, GitURL: redactGitURL(gitModule.git), Ref: gitModule.tree, Commit: commit, OldCommit: oldCommit, ExtractDuration: extractDuration, Error: errorMessage, fetchKey: redactGitURL(gitModule.git)})
+		}
+	}
 
-	er := executeCommand(revParseCmd, "", config.Timeout, gitModule.ignoreUnreachable, false)
+	commitHash, err := resolvedRefs.resolve(srcDir, gitModule.tree, gitModule.ignoreUnreachable)
 	hashFile := filepath.Join(targetDir, ".latest_commit")
 	deployFile := filepath.Join(targetDir, ".g10k-deploy.json")
 	needToSync := true
-	if er.returnCode != 0 {
-		if gitModule.ignoreUnreachable {
+	if err != nil {
+		if interrupted() {
+			return false
+		}
+		report(actionFailed, "", "", 0, "could not resolve reference "+gitModule.tree+": "+err.Error())
+		if gitModule.ignoreUnreachable && !dryRun {
 			Debugf("Failed to populate module " + targetDir + " but ignore-unreachable is set. Continuing...")
 			purgeDir(targetDir, "syncToModuleDir, because ignore-unreachable is set for this module")
 		}
 		return false
 	}
 
-	if len(er.output) > 0 {
-		commitHash := strings.TrimSuffix(er.output, "\n")
+	action := actionCreated
+	if isDir(targetDir) {
+		action = actionUpdated
+	}
+	oldCommit := ""
+	if len(commitHash) > 0 {
 		if strings.HasPrefix(srcDir, config.EnvCacheDir) {
 			if fileExists(deployFile) {
 				dr := readDeployResultFile(deployFile)
-				if dr.Signature == strings.TrimSuffix(er.output, "\n") && dr.DeploySuccess {
+				oldCommit = dr.Signature
+				if dr.Signature == commitHash && dr.DeploySuccess {
 					needToSync = false
 				}
 			}
 		} else {
 			targetHashByte, _ := os.ReadFile(hashFile)
 			targetHash := string(targetHashByte)
+			oldCommit = targetHash
 			Debugf("string content of " + hashFile + " is: " + targetHash)
 			if targetHash == commitHash {
 				needToSync = false
@@ -217,30 +232,67 @@ func syncToModuleDir(gitModule GitModule, srcDir string, targetDir string, corre
 				Debugf("Need to sync, because existing Git module: " + targetDir + " has commit " + targetHash + " and the to be synced commit is: " + commitHash)
 			}
 		}
-
 	}
-	if needToSync && er.returnCode == 0 {
+	// verify the signature before skipping unchanged modules, so that already deployed commits get checked and recorded as well
+	verification, err := verifySignature(gitModule, srcDir, commitHash)
+	if verification != nil && !isControlRepo {
+		recordSignatureVerification(targetDir, *verification)
+	}
+	if err != nil {
+		report(actionFailed, commitHash, oldCommit, 0, err.Error())
+		if dryRun || gitModule.ignoreUnreachable {
+			Warnf("WARN: Not deploying "+targetDir+", because g10k "+err.Error(), logAttrs...)
+			return false
+		}
+		Fatalf("syncToModuleDir(): Refusing to deploy " + targetDir + ", because g10k " + err.Error())
+	}
+	if !needToSync {
+		report(actionUnchanged, commitHash, "", 0, "")
+	}
+	if needToSync {
 		mutex.Lock()
-		Infof("Need to sync " + targetDir)
+		Infof("Need to sync "+targetDir, logAttrs...)
 		needSyncDirs = append(needSyncDirs, targetDir)
 		if _, ok := needSyncEnvs[correspondingPuppetEnvironment]; !ok {
 			needSyncEnvs[correspondingPuppetEnvironment] = empty
 		}
 		needSyncGitCount++
 		mutex.Unlock()
+		if dryRun {
+			// only report what would have been done, the Puppetfile of a control repository branch gets read with gitShowFile()
+			report(action, commitHash, oldCommit, 0, "")
+			return true
+		}
+		if !isControlRepo && config.IncrementalGitUpdates && !config.CloneGitModules && len(config.StoreCacheDir) > 0 && len(oldCommit) > 0 {
+			before := time.Now()
+			err := updateFromContentStore(gitModule, srcDir, oldCommit, commitHash, targetDir)
+			duration := time.Since(before).Seconds()
+			mutex.Lock()
+			ioGitTime += duration
+			mutex.Unlock()
+			if err == nil {
+				Verbosef("syncToModuleDir(): Updating "+targetDir+" from "+oldCommit+" to "+gitModule.tree+" of "+srcDir+" took "+strconv.FormatFloat(duration, 'f', 5, 64)+"s", append(logAttrs, slog.Float64("duration", duration))...)
+				report(action, commitHash, oldCommit, duration, "")
+				writeLatestCommit(hashFile, commitHash, gitModule.tree)
+				return true
+			}
+			if interrupted() {
+				// .latest_commit still contains the old commit, so the next run applies all changes again
+				report(actionFailed, commitHash, oldCommit, duration, "g10k was interrupted while updating")
+				return false
+			}
+			Debugf("Could not update " + targetDir + " incrementally, extracting " + gitModule.tree + " of " + srcDir + " completely. Error: " + err.Error())
+		}
 		moduleDir := "modules"
 		purgeWholeEnvDir := true
 		// check if it is a control repo and already exists
 		if isControlRepo && isDir(targetDir) {
 			// then check if it contains a Puppetfile
-			gitShowCmd := "git --git-dir " + srcDir + " show " + gitModule.tree + ":Puppetfile"
-			executeResult := executeCommand(gitShowCmd, "", config.Timeout, true, false)
-			Debugf("Executing " + gitShowCmd)
-			if executeResult.returnCode != 0 {
+			if content, ok := gitShowFile(srcDir, gitModule.tree, "Puppetfile"); !ok {
 				purgeWholeEnvDir = true
 			} else {
 				purgeWholeEnvDir = false
-				lines := strings.Split(executeResult.output, "\n")
+				lines := strings.Split(content, "\n")
 				for _, line := range lines {
 					if m := reModuledir.FindStringSubmatch(line); len(m) > 1 {
 						// moduledir CLI parameter override
@@ -258,98 +310,135 @@ func syncToModuleDir(gitModule GitModule, srcDir string, targetDir string, corre
 		if purgeWholeEnvDir {
 			purgeDir(targetDir, "need to sync")
 		} else {
-			Infof("Detected control repo change, but trying to preserve module dir " + filepath.Join(targetDir, moduleDir))
+			Infof("Detected control repo change, but trying to preserve module dir "+filepath.Join(targetDir, moduleDir), logAttrs...)
 			purgeControlRepoExceptModuledir(targetDir, moduleDir)
 		}
 
-		if !dryRun && !config.CloneGitModules || isControlRepo {
+		if !config.CloneGitModules || isControlRepo {
 			if pfMode {
 				purgeDir(targetDir, "git dir with changes in -puppetfile mode")
 			}
 			checkDirAndCreate(targetDir, "git dir")
-			gitArchiveArgs := []string{"--git-dir", srcDir, "archive", gitModule.tree}
-			cmd := exec.Command("git", gitArchiveArgs...)
-			Debugf("Executing git --git-dir " + srcDir + " archive " + gitModule.tree)
-			cmdOut, err := cmd.StdoutPipe()
-			if err != nil {
-				if !gitModule.ignoreUnreachable {
-					Infof("Failed to populate module " + targetDir + " but ignore-unreachable is set. Continuing...")
-				} else {
-					return false
-				}
-				Fatalf("syncToModuleDir(): Failed to execute command: git --git-dir " + srcDir + " archive " + gitModule.tree + " Error: " + err.Error())
-			}
-			cmd.Start()
-
 			before := time.Now()
-			unTar(cmdOut, targetDir)
+			if !isControlRepo && len(config.StoreCacheDir) > 0 {
+				err = populateFromContentStore(gitModule, srcDir, commitHash, targetDir)
+			} else {
+				err = extractGitTree(gitModule, srcDir, gitModule.tree, targetDir)
+			}
 			duration := time.Since(before).Seconds()
 			mutex.Lock()
 			ioGitTime += duration
 			mutex.Unlock()
 
-			err = cmd.Wait()
+			if interrupted() {
+				report(actionFailed, commitHash, oldCommit, duration, "g10k was interrupted while extracting")
+				if isControlRepo {
+					// keep the environment, but make sure the next run syncs it again
+					dr := DeployResult{
+						Name:                  gitModule.tree,
+						Signature:             commitHash,
+						StartedAt:             startedAt,
+						DeploySuccess:         false,
+						SignatureVerification: verification,
+					}
+					writeStructJSONFile(deployFile, dr)
+				} else {
+					purgeDir(targetDir, "syncToModuleDir, because g10k was interrupted while extracting")
+				}
+				return false
+			}
 			if err != nil {
-				Fatalf("syncToModuleDir(): Failed to execute command: git --git-dir " + srcDir + " archive " + gitModule.tree + " Error: " + err.Error())
-				//"\nIf you are using GitLab please ensure that you've added your deploy key to your repository." +
-				//"\nThe Puppet environment which is using this unresolveable repository is " + correspondingPuppetEnvironment)
+				if gitModule.ignoreUnreachable {
+					Debugf("Failed to populate module " + targetDir + " but ignore-unreachable is set. Continuing...")
+					report(actionFailed, commitHash, oldCommit, duration, "could not populate "+targetDir+": "+err.Error())
+					purgeDir(targetDir, "syncToModuleDir, because ignore-unreachable is set for this module")
+					return false
+				}
+				Fatalf("syncToModuleDir(): Failed to populate " + targetDir + " with " + gitModule.tree + " of " + srcDir + " by " + gitErrorCommand(err) + " Error: " + err.Error())
 			}
 
-			Verbosef("syncToModuleDir(): Executing git --git-dir " + srcDir + " archive " + gitModule.tree + " took " + strconv.FormatFloat(duration, 'f', 5, 64) + "s")
+			Verbosef("syncToModuleDir(): Extracting "+gitModule.tree+" of "+srcDir+" took "+strconv.FormatFloat(duration, 'f', 5, 64)+"s", append(logAttrs, slog.Float64("duration", duration))...)
 
-			commitHash := strings.TrimSuffix(er.output, "\n")
+			report(action, commitHash, oldCommit, duration, "")
 			if isControlRepo {
 				Debugf("Writing to deploy file " + deployFile)
 				dr := DeployResult{
-					Name:      gitModule.tree,
-					Signature: commitHash,
-					StartedAt: startedAt,
+					Name:                  gitModule.tree,
+					Signature:             commitHash,
+					StartedAt:             startedAt,
+					SignatureVerification: verification,
 				}
 				writeStructJSONFile(deployFile, dr)
 			} else {
-				Debugf("Writing hash " + commitHash + " from command " + revParseCmd + " to " + hashFile)
-				f, _ := os.Create(hashFile)
-				defer f.Close()
-				f.WriteString(commitHash)
-				f.Sync()
+				writeLatestCommit(hashFile, commitHash, gitModule.tree)
 			}
 
 		} else if config.CloneGitModules {
-			return doMirrorOrUpdate(gitModule, targetDir, 0)
+			before := time.Now()
+			success := doMirrorOrUpdate(gitModule, targetDir, 0)
+			if success {
+				report(action, commitHash, oldCommit, time.Since(before).Seconds(), "")
+			} else {
+				report(actionFailed, commitHash, oldCommit, time.Since(before).Seconds(), "could not clone "+redactGitURL(gitModule.git))
+			}
+			return success
 		}
 	}
 	return true
 }
 
-func detectDefaultBranch(gitDir string) string {
-	remoteShowOriginCmd := "git ls-remote --symref " + gitDir
-	er := executeCommand(remoteShowOriginCmd, "", config.Timeout, false, false)
-	foundRefs := strings.Split(er.output, "\n")
-	if len(foundRefs) < 1 {
-		Fatalf("Unable to detect default branch for git repository with command git ls-remote --symref " + gitDir)
+// writeLatestCommit writes the object name of the tree of the git module to its .latest_commit file
+func writeLatestCommit(hashFile string, commitHash string, tree string) {
+	Debugf("Writing hash " + commitHash + " of " + tree + " to " + hashFile)
+	// never write through a hardlink into the content store
+	os.Remove(hashFile)
+	f, _ := os.Create(hashFile)
+	defer f.Close()
+	f.WriteString(commitHash)
+	f.Sync()
+}
+
+// extractGitTree extracts the branch, tag or commit tree of the git repository srcDir into targetDir
+func extractGitTree(gitModule GitModule, srcDir string, tree string, targetDir string) error {
+	if gitModule.lfs {
+		if err := fetchLFSObjects(gitModule, srcDir, tree); err != nil {
+			return err
+		}
+	}
+	tarStream, err := gitBackend.archive(srcDir, tree)
+	if err != nil {
+		return err
+	}
+	unTar(tarStream, targetDir, gitModule.git+" ("+gitModule.tree+")", gitModule.lfs)
+	if err := tarStream.Close(); err != nil || !gitModule.submodules || interrupted() {
+		return err
 	}
-	// should look like this:
-	// ref: refs/heads/main\tHEAD
-	headBranchParts := strings.Split(foundRefs[0], "\t")
-	defaultBranch := strings.TrimPrefix(string(headBranchParts[0]), "ref: refs/heads/")
-	//fmt.Println(defaultBranch)
-	return defaultBranch
+	return extractSubmodules(gitModule, srcDir, tree, targetDir)
 }
 
-func detectGitRemoteURLChange(d string, url string) bool {
-	gitRemoteCmd := "git --git-dir " + d + " remote -v"
+// gitShowFile returns the content of file in the given branch, tag or commit of the git repository gitDir
+// the bool is false if the file or the reference does not exist
+func gitShowFile(gitDir string, tree string, file string) (string, bool) {
+	return gitBackend.showFile(gitDir, tree, file)
+}
 
-	er := executeCommand(gitRemoteCmd, "", config.Timeout, false, false)
-	if er.returnCode != 0 {
-		Warnf("WARN: Could not detect remote URL for git repository " + d + " trying to purge it and mirror it again")
-		return true
-	}
+// executeGitCommand executes a git command for the git module with the SSH settings and https credentials of the git module
+// and without HTTP proxy if the git URL matches NO_PROXY
+func executeGitCommand(gitModule GitModule, command string, commandDir string, isControlRepo bool, allowFail bool) ExecResult {
+	privateKey, knownHosts := sshSettingsForGitModule(gitModule, isControlRepo)
+	env := append(sshEnv(privateKey, knownHosts), credentialEnv(gitModule.git)...)
+	return executeCommand(command, commandDir, config.Timeout, allowFail, matchGitRemoteURLNoProxy(gitModule.git), env...)
+}
+
+func detectDefaultBranch(gitModule GitModule, gitDir string) string {
+	return resolvedRefs.defaultBranch(gitModule, gitDir)
+}
 
-	f := strings.Fields(er.output)
-	if len(f) < 3 {
+func detectGitRemoteURLChange(d string, url string) bool {
+	configuredRemote, err := gitBackend.remoteURL(d)
+	if err != nil {
 		Warnf("WARN: Could not detect remote URL for git repository " + d + " trying to purge it and mirror it again")
 		return true
 	}
-	configuredRemote := f[1]
 	return configuredRemote != url
 }
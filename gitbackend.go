@@ -0,0 +1,395 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// gitBackend executes all git operations of g10k, see the backend setting in the git section of the g10k config
+var gitBackend GitBackend = cliGitBackend{}
+
+// GitBackend contains the git operations g10k needs to mirror the control repositories and git modules
+// and to populate the Puppet environments from these mirrors
+type GitBackend interface {
+	// clone clones the git repository of the git module to workDir, as a bare mirror if mirror is true
+	clone(gitModule GitModule, workDir string, mirror bool, isControlRepo bool) error
+	// update fetches all branches and tags of the already cloned git repository in workDir and prunes deleted ones
+	update(gitModule GitModule, workDir string, isControlRepo bool) error
+	// checkout switches the working copy in workDir to the branch, tag or commit of the git module
+	checkout(gitModule GitModule, workDir string, isControlRepo bool) error
+	// remoteURL returns the URL of the remote the git repository gitDir was cloned from
+	remoteURL(gitDir string) (string, error)
+	// resolveRef returns the object name of the branch, tag or commit tree in the git repository gitDir
+	resolveRef(gitDir string, tree string, allowFail bool) (string, error)
+	// resolveRefs returns the object names of all trees of the git repository gitDir that could be resolved
+	resolveRefs(gitDir string, trees []string) (map[string]string, error)
+	// listBranches returns the names of all branches of the git repository gitDir
+	listBranches(gitDir string) ([]string, error)
+	// listTags returns the names of all tags of the git repository gitDir
+	listTags(gitDir string) ([]string, error)
+	// defaultBranch returns the branch HEAD of the git repository gitDir points to
+	defaultBranch(gitModule GitModule, gitDir string) string
+	// showFile returns the content of file in the branch, tag or commit tree of the git repository gitDir
+	// the bool is false if the file or the reference does not exist
+	showFile(gitDir string, tree string, file string) (string, bool)
+	// archive returns a tar stream of the branch, tag or commit tree of the git repository gitDir
+	// Close returns the error of the git operation producing the stream
+	archive(gitDir string, tree string) (io.ReadCloser, error)
+	// changedFiles returns the paths of all files that were added, modified, deleted or changed their mode between oldTree and newTree of the git repository gitDir
+	changedFiles(gitDir string, oldTree string, newTree string) ([]string, error)
+	// listSubmodules returns the commits the submodules of the branch, tag or commit tree of the git repository gitDir point to by their path
+	listSubmodules(gitDir string, tree string) (map[string]string, error)
+	// lfsPointers returns the Git LFS pointer files of the branch, tag or commit tree of the git repository gitDir
+	lfsPointers(gitDir string, tree string) ([]lfsPointer, error)
+	// catObject returns the type and the raw content of the object objectName of the git repository gitDir
+	catObject(gitDir string, objectName string) (string, []byte, error)
+	// fsck checks that all objects of the git repository gitDir are readable and match their object name
+	// and that all references point to existing objects
+	fsck(gitDir string) error
+}
+
+// gitCommandError is returned by the GitBackend for a failed git operation
+type gitCommandError struct {
+	// command describes the git operation, e.g. git clone --mirror https://github.com/foo/bar.git /tmp/g10k/modules/https-__github.com_foo_bar.git
+	command string
+	output  string
+}
+
+func (e gitCommandError) Error() string {
+	return e.output
+}
+
+// gitErrorCommand returns the description of the failed git operation or the error message for other errors
+func gitErrorCommand(err error) string {
+	var ge gitCommandError
+	if errors.As(err, &ge) {
+		return ge.command
+	}
+	return err.Error()
+}
+
+// newGitBackend returns the GitBackend for the backend setting in the git section of the g10k config
+func newGitBackend(backend string) GitBackend {
+	switch backend {
+	case "", "cli":
+		return cliGitBackend{}
+	case "go-git":
+		return goGitBackend{}
+	}
+	Fatalf("Error: Unknown git backend " + backend + ", valid values are cli or go-git")
+	return nil
+}
+
+// cliGitBackend executes every git operation with the git command line client
+type cliGitBackend struct{}
+
+func (b cliGitBackend) clone(gitModule GitModule, workDir string, mirror bool, isControlRepo bool) error {
+	// credentials inside of the git URL are passed to git by executeGitCommand and must not end up in the git config of the cached repository
+	gitCmd := "git clone " + redactGitURL(gitModule.git) + " " + workDir
+	if mirror {
+		gitCmd = "git clone --mirror " + redactGitURL(gitModule.git) + " " + workDir
+	}
+	return b.execute(gitModule, gitCmd, "", isControlRepo)
+}
+
+func (b cliGitBackend) update(gitModule GitModule, workDir string, isControlRepo bool) error {
+	return b.execute(gitModule, "git --git-dir "+workDir+" remote update --prune", "", isControlRepo)
+}
+
+func (b cliGitBackend) checkout(gitModule GitModule, workDir string, isControlRepo bool) error {
+	return b.execute(gitModule, "git checkout "+gitModule.tree, workDir, isControlRepo)
+}
+
+// execute executes the git command with executeGitCommand and returns a gitCommandError if it failed
+func (b cliGitBackend) execute(gitModule GitModule, gitCmd string, commandDir string, isControlRepo bool) error {
+	er := executeGitCommand(gitModule, gitCmd, commandDir, isControlRepo, gitModule.ignoreUnreachable)
+	if er.returnCode != 0 {
+		return gitCommandError{command: gitCmd, output: er.output}
+	}
+	return nil
+}
+
+func (b cliGitBackend) remoteURL(gitDir string) (string, error) {
+	gitRemoteCmd := "git --git-dir " + gitDir + " remote -v"
+	er := executeCommand(gitRemoteCmd, "", config.Timeout, false, false)
+	if er.returnCode != 0 {
+		return "", gitCommandError{command: gitRemoteCmd, output: er.output}
+	}
+	f := strings.Fields(er.output)
+	if len(f) < 3 {
+		return "", gitCommandError{command: gitRemoteCmd, output: "no remote found"}
+	}
+	return f[1], nil
+}
+
+func (b cliGitBackend) resolveRef(gitDir string, tree string, allowFail bool) (string, error) {
+	revParseCmd := "git --git-dir " + gitDir + " rev-parse --verify '" + tree
+	if !config.GitObjectSyntaxNotSupported {
+		revParseCmd = revParseCmd + "^{object}'"
+	} else {
+		revParseCmd = revParseCmd + "'"
+	}
+	er := executeCommand(revParseCmd, "", config.Timeout, allowFail, false)
+	if er.returnCode != 0 {
+		return "", gitCommandError{command: revParseCmd, output: strings.TrimSpace(er.output)}
+	}
+	return strings.TrimSuffix(er.output, "\n"), nil
+}
+
+// resolveRefs resolves all trees with one git cat-file --batch-check process instead of one git rev-parse process per tree
+func (b cliGitBackend) resolveRefs(gitDir string, trees []string) (map[string]string, error) {
+	gitCmd := "git --git-dir " + gitDir + " cat-file --batch-check"
+	batch := []string{}
+	input := ""
+	for _, tree := range trees {
+		if strings.ContainsAny(tree, " \t\n") {
+			// cat-file would not print the input for these, so they get resolved with rev-parse
+			continue
+		}
+		batch = append(batch, tree)
+		if config.GitObjectSyntaxNotSupported {
+			input += tree + "\n"
+		} else {
+			input += tree + "^{object}\n"
+		}
+	}
+	resolved := make(map[string]string)
+	if len(batch) == 0 {
+		return resolved, nil
+	}
+	Debugf("Executing " + gitCmd + " for " + strconv.Itoa(len(batch)) + " references")
+	before := time.Now()
+	cmd := newCancelableCommand("git", "--git-dir", gitDir, "cat-file", "--batch-check")
+	cmd.Stdin = strings.NewReader(input)
+	out, err := cmd.Output()
+	Verbosef("Executing " + gitCmd + " took " + strconv.FormatFloat(time.Since(before).Seconds(), 'f', 5, 64) + "s")
+	if err != nil {
+		return nil, gitCommandError{command: gitCmd, output: err.Error()}
+	}
+	lines := strings.Split(strings.TrimSuffix(string(out), "\n"), "\n")
+	if len(lines) != len(batch) {
+		return nil, gitCommandError{command: gitCmd, output: "expected " + strconv.Itoa(len(batch)) + " lines, but got " + strconv.Itoa(len(lines))}
+	}
+	for i, line := range lines {
+		// <object name> <object type> <object size> or <input> missing
+		fields := strings.Fields(line)
+		if len(fields) == 3 {
+			resolved[batch[i]] = fields[0]
+		}
+	}
+	return resolved, nil
+}
+
+func (b cliGitBackend) listBranches(gitDir string) ([]string, error) {
+	return b.listRefs("git --git-dir " + gitDir + " branch")
+}
+
+func (b cliGitBackend) listTags(gitDir string) ([]string, error) {
+	return b.listRefs("git --git-dir " + gitDir + " tag")
+}
+
+// listRefs returns the branch or tag names printed by gitCmd one per line
+func (b cliGitBackend) listRefs(gitCmd string) ([]string, error) {
+	er := executeCommand(gitCmd, "", config.Timeout, false, false)
+	if er.returnCode != 0 {
+		return nil, gitCommandError{command: gitCmd, output: er.output}
+	}
+	refs := []string{}
+	for _, line := range strings.Split(er.output, "\n") {
+		// git branch marks the branch HEAD points to with an asterisk
+		ref := strings.TrimSpace(strings.TrimLeft(line, "* "))
+		if len(ref) > 0 {
+			refs = append(refs, ref)
+		}
+	}
+	return refs, nil
+}
+
+func (b cliGitBackend) defaultBranch(gitModule GitModule, gitDir string) string {
+	remoteShowOriginCmd := "git ls-remote --symref " + gitDir
+	er := executeGitCommand(gitModule, remoteShowOriginCmd, "", false, false)
+	foundRefs := strings.Split(er.output, "\n")
+	if len(foundRefs) < 1 {
+		Fatalf("Unable to detect default branch for git repository with command git ls-remote --symref " + gitDir)
+	}
+	// should look like this:
+	// ref: refs/heads/main\tHEAD
+	headBranchParts := strings.Split(foundRefs[0], "\t")
+	return strings.TrimPrefix(string(headBranchParts[0]), "ref: refs/heads/")
+}
+
+func (b cliGitBackend) showFile(gitDir string, tree string, file string) (string, bool) {
+	gitShowCmd := "git --git-dir " + gitDir + " show " + tree + ":" + file
+	Debugf("Executing " + gitShowCmd)
+	er := executeCommand(gitShowCmd, "", config.Timeout, true, false)
+	return er.output, er.returnCode == 0
+}
+
+func (b cliGitBackend) archive(gitDir string, tree string) (io.ReadCloser, error) {
+	gitArchiveCmd := "git --git-dir " + gitDir + " archive " + tree
+	cmd := newCancelableCommand("git", "--git-dir", gitDir, "archive", tree)
+	Debugf("Executing " + gitArchiveCmd)
+	cmdOut, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, gitCommandError{command: gitArchiveCmd, output: err.Error()}
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, gitCommandError{command: gitArchiveCmd, output: err.Error()}
+	}
+	return commandOutput{ReadCloser: cmdOut, cmd: cmd, command: gitArchiveCmd}, nil
+}
+
+func (b cliGitBackend) changedFiles(gitDir string, oldTree string, newTree string) ([]string, error) {
+	gitCmd := "git --git-dir " + gitDir + " diff-tree -r -z --no-renames --name-only " + oldTree + " " + newTree
+	Debugf("Executing " + gitCmd)
+	before := time.Now()
+	out, err := newCancelableCommand("git", "--git-dir", gitDir, "diff-tree", "-r", "-z", "--no-renames", "--name-only", oldTree, newTree).Output()
+	Verbosef("Executing " + gitCmd + " took " + strconv.FormatFloat(time.Since(before).Seconds(), 'f', 5, 64) + "s")
+	if err != nil {
+		return nil, gitCommandError{command: gitCmd, output: err.Error()}
+	}
+	files := []string{}
+	// -z separates the paths with NUL bytes and prints them without quoting
+	for _, file := range strings.Split(string(out), "\x00") {
+		if len(file) > 0 {
+			files = append(files, file)
+		}
+	}
+	return files, nil
+}
+
+func (b cliGitBackend) listSubmodules(gitDir string, tree string) (map[string]string, error) {
+	gitCmd := "git --git-dir " + gitDir + " ls-tree -r -z " + tree
+	Debugf("Executing " + gitCmd)
+	before := time.Now()
+	out, err := newCancelableCommand("git", "--git-dir", gitDir, "ls-tree", "-r", "-z", tree).Output()
+	Verbosef("Executing " + gitCmd + " took " + strconv.FormatFloat(time.Since(before).Seconds(), 'f', 5, 64) + "s")
+	if err != nil {
+		return nil, gitCommandError{command: gitCmd, output: err.Error()}
+	}
+	submodules := make(map[string]string)
+	for _, entry := range strings.Split(string(out), "\x00") {
+		// <mode> SP <type> SP <object> TAB <path>
+		info, path, found := strings.Cut(entry, "\t")
+		fields := strings.Fields(info)
+		if found && len(fields) == 3 && fields[1] == "commit" {
+			submodules[path] = fields[2]
+		}
+	}
+	return submodules, nil
+}
+
+func (b cliGitBackend) lfsPointers(gitDir string, tree string) ([]lfsPointer, error) {
+	gitCmd := "git --git-dir " + gitDir + " ls-tree -r -l -z " + tree
+	Debugf("Executing " + gitCmd)
+	before := time.Now()
+	out, err := newCancelableCommand("git", "--git-dir", gitDir, "ls-tree", "-r", "-l", "-z", tree).Output()
+	Verbosef("Executing " + gitCmd + " took " + strconv.FormatFloat(time.Since(before).Seconds(), 'f', 5, 64) + "s")
+	if err != nil {
+		return nil, gitCommandError{command: gitCmd, output: err.Error()}
+	}
+	input := ""
+	for _, entry := range strings.Split(string(out), "\x00") {
+		// <mode> SP <type> SP <object> SP+ <size> TAB <path>
+		info, _, found := strings.Cut(entry, "\t")
+		fields := strings.Fields(info)
+		if !found || len(fields) != 4 || fields[1] != "blob" || fields[0] == "120000" {
+			continue
+		}
+		if size, err := strconv.Atoi(fields[3]); err == nil && size <= lfsPointerMaxSize {
+			input += fields[2] + "\n"
+		}
+	}
+	pointers := []lfsPointer{}
+	if len(input) == 0 {
+		return pointers, nil
+	}
+	gitCmd = "git --git-dir " + gitDir + " cat-file --batch"
+	Debugf("Executing " + gitCmd)
+	before = time.Now()
+	cmd := newCancelableCommand("git", "--git-dir", gitDir, "cat-file", "--batch")
+	cmd.Stdin = strings.NewReader(input)
+	out, err = cmd.Output()
+	Verbosef("Executing " + gitCmd + " took " + strconv.FormatFloat(time.Since(before).Seconds(), 'f', 5, 64) + "s")
+	if err != nil {
+		return nil, gitCommandError{command: gitCmd, output: err.Error()}
+	}
+	seen := make(map[string]bool)
+	objects := string(out)
+	for len(objects) > 0 {
+		// <object name> SP <object type> SP <object size> LF <content> LF
+		header, rest, found := strings.Cut(objects, "\n")
+		fields := strings.Fields(header)
+		if !found || len(fields) != 3 {
+			return nil, gitCommandError{command: gitCmd, output: "unexpected output " + header}
+		}
+		size, err := strconv.Atoi(fields[2])
+		if err != nil || size+1 > len(rest) {
+			return nil, gitCommandError{command: gitCmd, output: "unexpected output " + header}
+		}
+		if p, ok := parseLFSPointer([]byte(rest[:size])); ok && !seen[p.oid] {
+			seen[p.oid] = true
+			pointers = append(pointers, p)
+		}
+		objects = rest[size+1:]
+	}
+	return pointers, nil
+}
+
+func (b cliGitBackend) catObject(gitDir string, objectName string) (string, []byte, error) {
+	gitCmd := "git --git-dir " + gitDir + " cat-file --batch"
+	Debugf("Executing " + gitCmd + " for " + objectName)
+	before := time.Now()
+	cmd := newCancelableCommand("git", "--git-dir", gitDir, "cat-file", "--batch")
+	cmd.Stdin = strings.NewReader(objectName + "\n")
+	out, err := cmd.Output()
+	Verbosef("Executing " + gitCmd + " took " + strconv.FormatFloat(time.Since(before).Seconds(), 'f', 5, 64) + "s")
+	if err != nil {
+		return "", nil, gitCommandError{command: gitCmd, output: err.Error()}
+	}
+	// <object name> SP <object type> SP <object size> LF <content> LF or <object name> SP missing LF
+	header, content, _ := strings.Cut(string(out), "\n")
+	fields := strings.Fields(header)
+	if len(fields) != 3 {
+		return "", nil, gitCommandError{command: gitCmd, output: "could not find object " + objectName}
+	}
+	size, err := strconv.Atoi(fields[2])
+	if err != nil || size > len(content) {
+		return "", nil, gitCommandError{command: gitCmd, output: "unexpected output " + header}
+	}
+	return fields[1], []byte(content[:size]), nil
+}
+
+func (b cliGitBackend) fsck(gitDir string) error {
+	gitCmd := "git --git-dir " + gitDir + " fsck --no-progress --no-dangling"
+	Debugf("Executing " + gitCmd)
+	before := time.Now()
+	out, err := newCancelableCommand("git", "--git-dir", gitDir, "fsck", "--no-progress", "--no-dangling").CombinedOutput()
+	Verbosef("Executing " + gitCmd + " took " + strconv.FormatFloat(time.Since(before).Seconds(), 'f', 5, 64) + "s")
+	if err != nil {
+		output := strings.TrimSpace(string(out))
+		if len(output) == 0 {
+			output = err.Error()
+		}
+		return gitCommandError{command: gitCmd, output: output}
+	}
+	return nil
+}
+
+// commandOutput is the stdout of a running command, Close waits for the command to exit
+type commandOutput struct {
+	io.ReadCloser
+	cmd     *exec.Cmd
+	command string
+}
+
+func (c commandOutput) Close() error {
+	if err := c.cmd.Wait(); err != nil {
+		return gitCommandError{command: c.command, output: err.Error()}
+	}
+	return nil
+}
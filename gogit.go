@@ -0,0 +1,672 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/revlist"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/client"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/go-git/go-git/v5/plumbing/transport/server"
+	gitssh "github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+var goGitTransportsOnce sync.Once
+
+// installTransports replaces the transports of go-git once as soon as the go-git backend talks to a git remote,
+// so that they stay untouched as long as the git command line client is used
+// Local git repositories get served in-process instead of spawning git-upload-pack and http(s) remotes
+// use the same NO_PROXY rules as the git command line client
+func (b goGitBackend) installTransports() {
+	goGitTransportsOnce.Do(func() {
+		client.InstallProtocol("file", server.NewServer(localRepositoryLoader{}))
+		httpTransport := http.DefaultTransport.(*http.Transport).Clone()
+		httpTransport.Proxy = goGitProxy
+		httpClient := githttp.NewClient(&http.Client{Transport: httpTransport})
+		client.InstallProtocol("http", httpClient)
+		client.InstallProtocol("https", httpClient)
+	})
+}
+
+// goGitProxy returns the proxy from the environment variables for the request like the git command line client,
+// which does not use a proxy for git URLs matching NO_PROXY
+func goGitProxy(req *http.Request) (*url.URL, error) {
+	if matchGitRemoteURLNoProxy(req.URL.String()) {
+		return nil, nil
+	}
+	return http.ProxyFromEnvironment(req)
+}
+
+// remoteContext returns the context for a git operation on a git remote, which gets cancelled after the timeout of the g10k config
+// like the git command line client would be killed
+func (b goGitBackend) remoteContext() (context.Context, context.CancelFunc) {
+	b.installTransports()
+	return context.WithTimeout(runCtx, time.Duration(config.Timeout)*time.Second)
+}
+
+// localRepositoryLoader loads bare git repositories and the .git directory of working copies for the in-process file transport
+type localRepositoryLoader struct{}
+
+func (l localRepositoryLoader) Load(endpoint *transport.Endpoint) (storer.Storer, error) {
+	e := *endpoint
+	if isDir(filepath.Join(e.Path, ".git")) {
+		e.Path = filepath.Join(e.Path, ".git")
+	}
+	return server.DefaultLoader.Load(&e)
+}
+
+// goGitBackend executes the git operations in-process with go-git instead of spawning a git process for each of them
+type goGitBackend struct{}
+
+func (b goGitBackend) clone(gitModule GitModule, workDir string, mirror bool, isControlRepo bool) error {
+	remoteURL := redactGitURL(gitModule.git)
+	command := "go-git clone " + remoteURL + " " + workDir
+	if mirror {
+		command = "go-git clone --mirror " + remoteURL + " " + workDir
+	}
+	auth, err := b.auth(gitModule, isControlRepo)
+	if err != nil {
+		return gitCommandError{command: command, output: err.Error()}
+	}
+	ctx, cancel := b.remoteContext()
+	defer cancel()
+	before := time.Now()
+	_, err = git.PlainCloneContext(ctx, workDir, mirror, &git.CloneOptions{URL: remoteURL, Auth: auth, Mirror: mirror})
+	return b.result(command, before, err, gitModule.ignoreUnreachable)
+}
+
+func (b goGitBackend) update(gitModule GitModule, workDir string, isControlRepo bool) error {
+	command := "go-git fetch --prune " + workDir
+	auth, err := b.auth(gitModule, isControlRepo)
+	if err != nil {
+		return gitCommandError{command: command, output: err.Error()}
+	}
+	ctx, cancel := b.remoteContext()
+	defer cancel()
+	before := time.Now()
+	repo, err := git.PlainOpen(workDir)
+	if err == nil {
+		err = repo.FetchContext(ctx, &git.FetchOptions{Auth: auth, Force: true, Prune: true, Tags: git.AllTags})
+		if errors.Is(err, git.NoErrAlreadyUpToDate) {
+			err = nil
+		}
+	}
+	return b.result(command, before, err, gitModule.ignoreUnreachable)
+}
+
+func (b goGitBackend) checkout(gitModule GitModule, workDir string, isControlRepo bool) error {
+	command := "go-git checkout " + gitModule.tree + " in " + workDir
+	before := time.Now()
+	repo, err := git.PlainOpen(workDir)
+	if err == nil {
+		var hash plumbing.Hash
+		// branches other than the default branch only exist as remote branches in a fresh clone
+		if hash, err = b.resolve(repo, gitModule.tree, "refs/remotes/origin/"+gitModule.tree); err == nil {
+			var worktree *git.Worktree
+			if worktree, err = repo.Worktree(); err == nil {
+				err = worktree.Checkout(&git.CheckoutOptions{Hash: hash, Force: true})
+			}
+		}
+	}
+	return b.result(command, before, err, gitModule.ignoreUnreachable)
+}
+
+// result logs the duration of the git operation like executeCommand and wraps the error in a gitCommandError
+func (b goGitBackend) result(command string, before time.Time, err error, allowFail bool) error {
+	duration := time.Since(before).Seconds()
+	if err != nil && (allowFail || config.UseCacheFallback) {
+		Debugf("Executing " + command + " took " + strconv.FormatFloat(duration, 'f', 5, 64) + "s")
+	} else {
+		Verbosef("Executing " + command + " took " + strconv.FormatFloat(duration, 'f', 5, 64) + "s")
+	}
+	if err != nil {
+		return gitCommandError{command: command, output: err.Error()}
+	}
+	return nil
+}
+
+func (b goGitBackend) remoteURL(gitDir string) (string, error) {
+	repo, err := git.PlainOpen(gitDir)
+	if err != nil {
+		return "", err
+	}
+	remote, err := repo.Remote(git.DefaultRemoteName)
+	if err != nil {
+		return "", err
+	}
+	if len(remote.Config().URLs) < 1 {
+		return "", errors.New("no URL found for remote " + git.DefaultRemoteName)
+	}
+	return remote.Config().URLs[0], nil
+}
+
+func (b goGitBackend) resolveRef(gitDir string, tree string, allowFail bool) (string, error) {
+	command := "go-git rev-parse --verify " + tree + " in " + gitDir
+	before := time.Now()
+	repo, err := git.PlainOpen(gitDir)
+	if err != nil {
+		return "", b.result(command, before, err, allowFail)
+	}
+	hash, err := b.resolve(repo, tree)
+	if err != nil {
+		return "", b.result(command, before, err, allowFail)
+	}
+	b.result(command, before, nil, allowFail)
+	return hash.String(), nil
+}
+
+func (b goGitBackend) resolveRefs(gitDir string, trees []string) (map[string]string, error) {
+	repo, err := git.PlainOpen(gitDir)
+	if err != nil {
+		return nil, err
+	}
+	resolved := make(map[string]string)
+	for _, tree := range trees {
+		if hash, err := b.resolve(repo, tree); err == nil {
+			resolved[tree] = hash.String()
+		}
+	}
+	return resolved, nil
+}
+
+// resolve returns the object name of the branch, tag or commit tree like git rev-parse --verify tree^{object},
+// which means that annotated tags resolve to the tag object and not to the tagged commit
+func (b goGitBackend) resolve(repo *git.Repository, tree string, extraRefs ...string) (plumbing.Hash, error) {
+	if strings.Contains(tree, "..") || strings.HasPrefix(tree, "/") {
+		return plumbing.ZeroHash, errors.New("invalid reference " + tree)
+	}
+	// same order as in git help revisions
+	refs := []string{"refs/" + tree, "refs/tags/" + tree, "refs/heads/" + tree, "refs/remotes/" + tree}
+	if tree == "HEAD" {
+		refs = []string{"HEAD"}
+	}
+	for _, name := range append(refs, extraRefs...) {
+		if ref, err := repo.Reference(plumbing.ReferenceName(name), true); err == nil {
+			return ref.Hash(), nil
+		}
+	}
+	hash, err := repo.ResolveRevision(plumbing.Revision(tree))
+	if err != nil {
+		return plumbing.ZeroHash, errors.New("could not find reference " + tree)
+	}
+	if _, err := repo.Object(plumbing.AnyObject, *hash); err != nil {
+		return plumbing.ZeroHash, errors.New("could not find reference " + tree)
+	}
+	return *hash, nil
+}
+
+// tree returns the tree of the branch, tag or commit tree and the commit time, which git archive uses for all archive entries
+func (b goGitBackend) tree(gitDir string, tree string) (*object.Tree, time.Time, error) {
+	repo, err := git.PlainOpen(gitDir)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	hash, err := b.resolve(repo, tree)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	obj, err := repo.Object(plumbing.AnyObject, hash)
+	for err == nil {
+		switch o := obj.(type) {
+		case *object.Tag:
+			obj, err = o.Object()
+		case *object.Commit:
+			t, err := o.Tree()
+			return t, o.Committer.When, err
+		case *object.Tree:
+			return o, time.Now(), nil
+		default:
+			return nil, time.Time{}, errors.New(tree + " is a " + obj.Type().String() + " and not a tree")
+		}
+	}
+	return nil, time.Time{}, err
+}
+
+func (b goGitBackend) listBranches(gitDir string) ([]string, error) {
+	repo, err := git.PlainOpen(gitDir)
+	if err != nil {
+		return nil, err
+	}
+	iter, err := repo.Branches()
+	if err != nil {
+		return nil, err
+	}
+	return b.refNames(iter)
+}
+
+func (b goGitBackend) listTags(gitDir string) ([]string, error) {
+	repo, err := git.PlainOpen(gitDir)
+	if err != nil {
+		return nil, err
+	}
+	iter, err := repo.Tags()
+	if err != nil {
+		return nil, err
+	}
+	return b.refNames(iter)
+}
+
+// refNames returns the sorted short names of the references like git branch and git tag
+func (b goGitBackend) refNames(iter storer.ReferenceIter) ([]string, error) {
+	names := []string{}
+	err := iter.ForEach(func(ref *plumbing.Reference) error {
+		names = append(names, ref.Name().Short())
+		return nil
+	})
+	sort.Strings(names)
+	return names, err
+}
+
+func (b goGitBackend) defaultBranch(gitModule GitModule, gitDir string) string {
+	repo, err := git.PlainOpen(gitDir)
+	if err != nil {
+		Debugf("Unable to detect default branch for git repository " + gitDir + " Error: " + err.Error())
+		return ""
+	}
+	head, err := repo.Storer.Reference(plumbing.HEAD)
+	if err != nil || head.Type() != plumbing.SymbolicReference {
+		Debugf("Unable to detect default branch for git repository " + gitDir)
+		return ""
+	}
+	return strings.TrimPrefix(head.Target().String(), "refs/heads/")
+}
+
+func (b goGitBackend) showFile(gitDir string, tree string, file string) (string, bool) {
+	Debugf("Reading " + file + " of " + tree + " in " + gitDir)
+	t, _, err := b.tree(gitDir, tree)
+	if err != nil {
+		return "", false
+	}
+	f, err := t.File(file)
+	if err != nil {
+		return "", false
+	}
+	content, err := f.Contents()
+	return content, err == nil
+}
+
+func (b goGitBackend) archive(gitDir string, tree string) (io.ReadCloser, error) {
+	command := "go-git archive " + tree + " in " + gitDir
+	Debugf("Executing " + command)
+	t, modTime, err := b.tree(gitDir, tree)
+	if err != nil {
+		return nil, gitCommandError{command: command, output: err.Error()}
+	}
+	r, w := io.Pipe()
+	ta := &treeArchive{PipeReader: r, command: command, done: make(chan error, 1)}
+	go func() {
+		err := writeTreeArchive(w, t, modTime)
+		w.CloseWithError(err)
+		ta.done <- err
+	}()
+	return ta, nil
+}
+
+func (b goGitBackend) changedFiles(gitDir string, oldTree string, newTree string) ([]string, error) {
+	command := "go-git diff-tree " + oldTree + " " + newTree + " in " + gitDir
+	Debugf("Executing " + command)
+	before := time.Now()
+	oldT, _, err := b.tree(gitDir, oldTree)
+	if err != nil {
+		return nil, b.result(command, before, err, true)
+	}
+	newT, _, err := b.tree(gitDir, newTree)
+	if err != nil {
+		return nil, b.result(command, before, err, true)
+	}
+	// without options DiffTree does not detect renames, just like git diff-tree --no-renames
+	changes, err := object.DiffTreeContext(runCtx, oldT, newT)
+	if err != nil {
+		return nil, b.result(command, before, err, true)
+	}
+	files := []string{}
+	for _, change := range changes {
+		if len(change.To.Name) > 0 {
+			files = append(files, change.To.Name)
+		} else {
+			files = append(files, change.From.Name)
+		}
+	}
+	return files, b.result(command, before, nil, true)
+}
+
+func (b goGitBackend) listSubmodules(gitDir string, tree string) (map[string]string, error) {
+	command := "go-git ls-tree -r " + tree + " in " + gitDir
+	Debugf("Executing " + command)
+	before := time.Now()
+	t, _, err := b.tree(gitDir, tree)
+	if err != nil {
+		return nil, b.result(command, before, err, false)
+	}
+	submodules := make(map[string]string)
+	walker := object.NewTreeWalker(t, true, nil)
+	defer walker.Close()
+	for {
+		name, entry, err := walker.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, b.result(command, before, err, false)
+		}
+		if entry.Mode == filemode.Submodule {
+			submodules[name] = entry.Hash.String()
+		}
+	}
+	return submodules, b.result(command, before, nil, false)
+}
+
+func (b goGitBackend) lfsPointers(gitDir string, tree string) ([]lfsPointer, error) {
+	command := "go-git ls-tree -r -l " + tree + " in " + gitDir
+	Debugf("Executing " + command)
+	before := time.Now()
+	t, _, err := b.tree(gitDir, tree)
+	if err != nil {
+		return nil, b.result(command, before, err, false)
+	}
+	pointers := []lfsPointer{}
+	seen := make(map[string]bool)
+	walker := object.NewTreeWalker(t, true, nil)
+	defer walker.Close()
+	for {
+		_, entry, err := walker.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, b.result(command, before, err, false)
+		}
+		if entry.Mode != filemode.Regular && entry.Mode != filemode.Executable && entry.Mode != filemode.Deprecated {
+			continue
+		}
+		blob, err := t.TreeEntryFile(&entry)
+		if err != nil {
+			return nil, b.result(command, before, err, false)
+		}
+		if blob.Size > lfsPointerMaxSize {
+			continue
+		}
+		content, err := blob.Contents()
+		if err != nil {
+			return nil, b.result(command, before, err, false)
+		}
+		if p, ok := parseLFSPointer([]byte(content)); ok && !seen[p.oid] {
+			seen[p.oid] = true
+			pointers = append(pointers, p)
+		}
+	}
+	return pointers, b.result(command, before, nil, false)
+}
+
+func (b goGitBackend) catObject(gitDir string, objectName string) (string, []byte, error) {
+	command := "go-git cat-file " + objectName + " in " + gitDir
+	Debugf("Executing " + command)
+	before := time.Now()
+	repo, err := git.PlainOpen(gitDir)
+	if err != nil {
+		return "", nil, b.result(command, before, err, false)
+	}
+	obj, err := repo.Storer.EncodedObject(plumbing.AnyObject, plumbing.NewHash(objectName))
+	if err != nil {
+		return "", nil, b.result(command, before, err, false)
+	}
+	r, err := obj.Reader()
+	if err != nil {
+		return "", nil, b.result(command, before, err, false)
+	}
+	defer r.Close()
+	content, err := io.ReadAll(r)
+	return obj.Type().String(), content, b.result(command, before, err, false)
+}
+
+func (b goGitBackend) fsck(gitDir string) error {
+	command := "go-git fsck " + gitDir
+	Debugf("Executing " + command)
+	before := time.Now()
+	repo, err := git.PlainOpen(gitDir)
+	if err != nil {
+		return b.result(command, before, err, false)
+	}
+	objects, err := repo.Storer.IterEncodedObjects(plumbing.AnyObject)
+	if err != nil {
+		return b.result(command, before, err, false)
+	}
+	err = objects.ForEach(func(obj plumbing.EncodedObject) error {
+		r, err := obj.Reader()
+		if err != nil {
+			return errors.New("could not read object " + obj.Hash().String() + ": " + err.Error())
+		}
+		defer r.Close()
+		hasher := plumbing.NewHasher(obj.Type(), obj.Size())
+		if _, err := io.Copy(hasher, r); err != nil {
+			return errors.New("could not read object " + obj.Hash().String() + ": " + err.Error())
+		}
+		if hasher.Sum() != obj.Hash() {
+			return errors.New("object " + obj.Hash().String() + " does not match its content hash " + hasher.Sum().String())
+		}
+		return nil
+	})
+	if err != nil {
+		return b.result(command, before, err, false)
+	}
+	refs, err := repo.References()
+	if err != nil {
+		return b.result(command, before, err, false)
+	}
+	referenced := []plumbing.Hash{}
+	err = refs.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() != plumbing.HashReference {
+			return nil
+		}
+		if _, err := repo.Storer.EncodedObject(plumbing.AnyObject, ref.Hash()); err != nil {
+			return errors.New("reference " + ref.Name().String() + " points to missing object " + ref.Hash().String())
+		}
+		referenced = append(referenced, ref.Hash())
+		return nil
+	})
+	if err == nil {
+		// all commits, trees and blobs reachable from the references need to exist
+		reachable, walkErr := revlist.Objects(repo.Storer, referenced, nil)
+		if walkErr != nil {
+			err = errors.New("missing objects reachable from the references: " + walkErr.Error())
+		}
+		for _, hash := range reachable {
+			if err != nil {
+				break
+			}
+			if repo.Storer.HasEncodedObject(hash) != nil {
+				err = errors.New("missing object " + hash.String() + " reachable from the references")
+			}
+		}
+	}
+	return b.result(command, before, err, false)
+}
+
+// treeArchive is the tar stream written by writeTreeArchive, Close waits for writeTreeArchive to return
+type treeArchive struct {
+	*io.PipeReader
+	command string
+	done    chan error
+}
+
+func (ta *treeArchive) Close() error {
+	ta.PipeReader.Close()
+	if err := <-ta.done; err != nil && !errors.Is(err, io.ErrClosedPipe) {
+		return gitCommandError{command: ta.command, output: err.Error()}
+	}
+	return nil
+}
+
+// writeTreeArchive writes the tree as tar archive with the same file modes and modification times as git archive
+// Submodules become empty directories and .gitattributes export-ignore and export-subst are not supported
+func writeTreeArchive(w io.Writer, t *object.Tree, modTime time.Time) error {
+	tw := tar.NewWriter(w)
+	walker := object.NewTreeWalker(t, true, nil)
+	defer walker.Close()
+	for {
+		name, entry, err := walker.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if runCtx.Err() != nil {
+			return runCtx.Err()
+		}
+		header := &tar.Header{Name: name, ModTime: modTime, Typeflag: tar.TypeReg, Mode: 0664}
+		var file *object.File
+		if entry.Mode != filemode.Dir && entry.Mode != filemode.Submodule {
+			if file, err = t.TreeEntryFile(&entry); err != nil {
+				return err
+			}
+		}
+		switch entry.Mode {
+		case filemode.Dir, filemode.Submodule:
+			header.Typeflag = tar.TypeDir
+			header.Name = name + "/"
+			header.Mode = 0775
+		case filemode.Symlink:
+			if header.Linkname, err = file.Contents(); err != nil {
+				return err
+			}
+			header.Typeflag = tar.TypeSymlink
+			header.Mode = 0777
+			file = nil
+		case filemode.Executable:
+			header.Mode = 0775
+			header.Size = file.Size
+		default:
+			header.Size = file.Size
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if file != nil {
+			r, err := file.Reader()
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(tw, r)
+			r.Close()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return tw.Close()
+}
+
+// auth returns the https credentials or the SSH key and host key verification for the git module
+// like executeGitCommand does with credentialEnv and sshEnv for the git command line client
+func (b goGitBackend) auth(gitModule GitModule, isControlRepo bool) (transport.AuthMethod, error) {
+	if isHTTPGitURL(gitModule.git) {
+		if username, password, ok := httpsCredentialsForGitURL(gitModule.git); ok {
+			return &githttp.BasicAuth{Username: username, Password: password}, nil
+		}
+		return nil, nil
+	}
+	endpoint, err := transport.NewEndpoint(gitModule.git)
+	if err != nil {
+		return nil, err
+	}
+	if endpoint.Protocol != "ssh" {
+		return nil, nil
+	}
+	user := endpoint.User
+	if len(user) == 0 {
+		user = gitssh.DefaultUsername
+	}
+	privateKey, knownHosts := sshSettingsForGitModule(gitModule, isControlRepo)
+	hostKeyCallback, err := b.hostKeyCallback(knownHosts)
+	if err != nil {
+		return nil, err
+	}
+	if len(privateKey) == 0 {
+		// like ssh without -i try the keys of the SSH agent and then the default keys of the user running g10k
+		if agentAuth, err := gitssh.NewSSHAgentAuth(user); err == nil {
+			agentAuth.HostKeyCallback = hostKeyCallback
+			return agentAuth, nil
+		}
+		home, _ := os.UserHomeDir()
+		for _, keyFile := range []string{"id_ed25519", "id_ecdsa", "id_rsa"} {
+			if fileExists(filepath.Join(home, ".ssh", keyFile)) {
+				privateKey = filepath.Join(home, ".ssh", keyFile)
+				break
+			}
+		}
+		if len(privateKey) == 0 {
+			return nil, errors.New("no SSH key found for " + redactGitURL(gitModule.git) + " and no SSH agent available")
+		}
+	}
+	keys, err := gitssh.NewPublicKeysFromFile(user, privateKey, "")
+	if err != nil {
+		return nil, errors.New("could not load SSH key " + privateKey + " Error: " + err.Error())
+	}
+	keys.HostKeyCallback = hostKeyCallback
+	return keys, nil
+}
+
+// hostKeyCallback verifies the SSH host keys like ssh with the StrictHostKeyChecking option sshEnv would use
+func (b goGitBackend) hostKeyCallback(knownHosts string) (ssh.HostKeyCallback, error) {
+	strictHostKeyChecking := config.Git.StrictHostKeyChecking
+	if strictHostKeyChecking == "no" {
+		return ssh.InsecureIgnoreHostKey(), nil
+	}
+	files := []string{}
+	if len(knownHosts) > 0 {
+		files = append(files, knownHosts)
+	} else if strictHostKeyChecking == "accept-new" {
+		home, _ := os.UserHomeDir()
+		files = append(files, filepath.Join(home, ".ssh", "known_hosts"))
+	}
+	if strictHostKeyChecking == "accept-new" && !fileExists(files[0]) {
+		checkDirAndCreate(filepath.Dir(files[0]), "directory of known_hosts file")
+		if err := os.WriteFile(files[0], nil, 0600); err != nil {
+			return nil, err
+		}
+	}
+	callback, err := gitssh.NewKnownHostsCallback(files...)
+	if err != nil {
+		return nil, err
+	}
+	if strictHostKeyChecking != "accept-new" {
+		return callback, nil
+	}
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := callback(hostname, remote, key)
+		var keyErr *knownhosts.KeyError
+		if !errors.As(err, &keyErr) || len(keyErr.Want) > 0 {
+			// known host or changed host key
+			return err
+		}
+		mutex.Lock()
+		defer mutex.Unlock()
+		Infof("Adding host key of " + hostname + " to " + files[0])
+		f, err := os.OpenFile(files[0], os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = f.WriteString(knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key) + "\n")
+		return err
+	}, nil
+}
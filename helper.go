@@ -7,46 +7,164 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
 	"os"
 	"os/exec"
 	"regexp"
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/fatih/color"
 	"github.com/kballard/go-shellquote"
 	"golang.org/x/sys/unix"
+	"golang.org/x/term"
 )
 
 var validationMessages []string
 
+// levelVerbose is the log level used by Verbosef, which lies between debug and info
+const levelVerbose = slog.Level(-2)
+
+// jsonLogger is used by the logging helper functions if -log-format json is set
+var jsonLogger *slog.Logger
+
+// setupLogging creates the JSON logger if -log-format json is set
+func setupLogging(format string) {
+	switch format {
+	case "", "text":
+		jsonLogger = nil
+	case "json":
+		level := slog.LevelWarn
+		if debug {
+			level = slog.LevelDebug
+		} else if verbose {
+			level = levelVerbose
+		} else if info {
+			level = slog.LevelInfo
+		}
+		jsonLogger = slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{
+			Level: level,
+			ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+				if a.Key == slog.LevelKey && a.Value.Any() == levelVerbose {
+					a.Value = slog.StringValue("VERBOSE")
+				}
+				return a
+			},
+		}))
+	default:
+		Fatalf("Error: unknown -log-format " + format + ", must be text or json")
+	}
+}
+
+// secrets contains the passwords and tokens which must not show up in the log output
+var (
+	secrets          []string
+	secretsMutex     sync.RWMutex
+	reURLCredentials = regexp.MustCompile(`(?i)(https?://)[^/@\s'"]+@`)
+)
+
+// registerSecret adds a password or token, which gets redacted from the log output
+func registerSecret(secret string) {
+	if len(secret) < 4 {
+		// too short to be redacted without mangling the rest of the log output
+		return
+	}
+	secretsMutex.Lock()
+	defer secretsMutex.Unlock()
+	for _, s := range secrets {
+		if s == secret {
+			return
+		}
+	}
+	secrets = append(secrets, secret)
+}
+
+// redactSecrets removes credentials from http(s) URLs and replaces all registered secrets with REDACTED
+func redactSecrets(s string) string {
+	s = reURLCredentials.ReplaceAllString(s, "${1}")
+	secretsMutex.RLock()
+	defer secretsMutex.RUnlock()
+	for _, secret := range secrets {
+		s = strings.ReplaceAll(s, secret, "REDACTED")
+	}
+	return s
+}
+
+// redactAttrs redacts the secrets of the string values of the structured log attributes
+func redactAttrs(attrs []slog.Attr) {
+	for i, a := range attrs {
+		if a.Value.Kind() == slog.KindString {
+			attrs[i].Value = slog.StringValue(redactSecrets(a.Value.String()))
+		}
+	}
+}
+
+// logJSON emits a structured log message if -log-format json is set and returns true if it did
+func logJSON(level slog.Level, s string, attrs []slog.Attr) bool {
+	if jsonLogger == nil {
+		return false
+	}
+	redactAttrs(attrs)
+	jsonLogger.LogAttrs(runCtx, level, s, attrs...)
+	return true
+}
+
+// logJSONEvent emits a structured log message regardless of -info, -verbose and -debug if -log-format json is set and returns true if it did,
+// e.g. for the summary of the run, which the text log format always prints
+func logJSONEvent(level slog.Level, s string, attrs []slog.Attr) bool {
+	if jsonLogger == nil {
+		return false
+	}
+	redactAttrs(attrs)
+	r := slog.NewRecord(time.Now(), level, s, 0)
+	r.AddAttrs(attrs...)
+	jsonLogger.Handler().Handle(runCtx, r)
+	return true
+}
+
 // Debugf is a helper function for debug logging if global variable debug is set to true
-func Debugf(s string) {
+func Debugf(s string, attrs ...slog.Attr) {
 	if debug {
+		s = redactSecrets(s)
 		pc, _, _, _ := runtime.Caller(1)
 		callingFunctionName := strings.Split(runtime.FuncForPC(pc).Name(), ".")[len(strings.Split(runtime.FuncForPC(pc).Name(), "."))-1]
 		if strings.HasPrefix(callingFunctionName, "func") {
 			// check for anonymous function names
+			if logJSON(slog.LevelDebug, s, attrs) {
+				return
+			}
 			log.Print("DEBUG " + fmt.Sprint(s))
 		} else {
+			if logJSON(slog.LevelDebug, s, append(attrs, slog.String("function", callingFunctionName))) {
+				return
+			}
 			log.Print("DEBUG " + callingFunctionName + "(): " + fmt.Sprint(s))
 		}
 	}
 }
 
 // Verbosef is a helper function for verbose logging if global variable verbose is set to true
-func Verbosef(s string) {
+func Verbosef(s string, attrs ...slog.Attr) {
 	if debug || verbose {
+		s = redactSecrets(s)
+		if logJSON(levelVerbose, s, attrs) {
+			return
+		}
 		log.Print(fmt.Sprint(s))
 	}
 }
 
 // Infof is a helper function for info logging if global variable info is set to true
-func Infof(s string) {
+func Infof(s string, attrs ...slog.Attr) {
 	if debug || verbose || info {
+		s = redactSecrets(s)
+		if logJSON(slog.LevelInfo, s, attrs) {
+			return
+		}
 		color.Green(s)
 	}
 }
@@ -65,22 +183,46 @@ func Validatef() {
 }
 
 // Warnf is a helper function for warning logging
-func Warnf(s string) {
+func Warnf(s string, attrs ...slog.Attr) {
+	s = redactSecrets(s)
+	if logJSON(slog.LevelWarn, s, attrs) {
+		return
+	}
 	color.Set(color.FgYellow)
 	fmt.Println(s)
 	color.Unset()
 }
 
 // Fatalf is a helper function for fatal logging
-func Fatalf(s string) {
+func Fatalf(s string, attrs ...slog.Attr) {
+	s = redactSecrets(s)
 	if validate {
 		validationMessages = append(validationMessages, s)
 	} else {
-		color.New(color.FgRed).Fprintln(os.Stderr, s)
+		if !logJSON(slog.LevelError, s, attrs) {
+			color.New(color.FgRed).Fprintln(os.Stderr, s)
+		}
+		writeRunResults(s)
+		if interrupted() {
+			// errors are expected while running commands get terminated
+			os.Exit(int(interruptedExitCode.Load()))
+		}
 		os.Exit(1)
 	}
 }
 
+// writeRunResults writes the -report and -metrics-file files, which also needs to happen if g10k exits early
+func writeRunResults(errorMessage string) {
+	errorMessage = redactSecrets(errorMessage)
+	writeReport(errorMessage)
+	writeMetricsFile(errorMessage)
+}
+
+// showProgressBars returns true if the progress bars should be rendered, which would otherwise mess up the log output
+func showProgressBars() bool {
+	return !debug && !verbose && !info && !quiet && jsonLogger == nil && term.IsTerminal(int(os.Stdout.Fd()))
+}
+
 // fileExists checks if the given file exists and returns a bool
 func fileExists(file string) bool {
 	//Debugf("checking for file existence " + file)
@@ -169,11 +311,32 @@ func purgeDir(dir string, callingFunction string) {
 	}
 }
 
-func executeCommand(command string, commandDir string, timeout int, allowFail bool, disableHttpProxy bool) ExecResult {
+// loggableEnv returns the environment variables for the log output with the values of the credentials masked,
+// because registerSecret ignores short secrets
+func loggableEnv(env []string) string {
+	logged := make([]string, len(env))
+	for i, e := range env {
+		logged[i] = e
+		name, _, _ := strings.Cut(e, "=")
+		for _, credentialEnvVar := range credentialEnvVars {
+			if name == credentialEnvVar {
+				logged[i] = name + "=REDACTED"
+			}
+		}
+	}
+	return strings.Join(logged, " ")
+}
+
+// executeCommand executes the command with optional additional environment variables, e.g. GIT_SSH_COMMAND=ssh -i /etc/g10k/key
+func executeCommand(command string, commandDir string, timeout int, allowFail bool, disableHttpProxy bool, env ...string) ExecResult {
+	envInfo := ""
+	if len(env) > 0 {
+		envInfo = " with " + loggableEnv(env)
+	}
 	if len(commandDir) > 0 {
-		Debugf("Executing " + command + " in cwd " + commandDir)
+		Debugf("Executing " + command + " in cwd " + commandDir + envInfo)
 	} else {
-		Debugf("Executing " + command)
+		Debugf("Executing " + command + envInfo)
 	}
 	parts := strings.SplitN(command, " ", 2)
 	cmd := parts[0]
@@ -188,7 +351,7 @@ func executeCommand(command string, commandDir string, timeout int, allowFail bo
 	}
 
 	before := time.Now()
-	execCommand := exec.Command(cmd, cmdArgs...)
+	execCommand := newCancelableCommand(cmd, cmdArgs...)
 	if len(commandDir) > 0 {
 		execCommand.Dir = commandDir
 	}
@@ -201,17 +364,21 @@ func executeCommand(command string, commandDir string, timeout int, allowFail bo
 		os.Unsetenv("HTTP_PROXY")
 		os.Unsetenv("HTTPS_PROXY")
 	}
-	execCommand.Env = os.Environ()
+	execCommand.Env = append(os.Environ(), env...)
 	out, err := execCommand.CombinedOutput()
 	duration := time.Since(before).Seconds()
 	er := ExecResult{0, string(out)}
 	if msg, ok := err.(*exec.ExitError); ok { // there is error code
 		er.returnCode = msg.Sys().(syscall.WaitStatus).ExitStatus()
 	}
+	logAttrs := []slog.Attr{slog.String("command", command), slog.Float64("duration", duration)}
+	if err != nil {
+		logAttrs = append(logAttrs, slog.String("error", err.Error()))
+	}
 	if (allowFail || config.UseCacheFallback) && err != nil {
-		Debugf("Executing " + command + " took " + strconv.FormatFloat(duration, 'f', 5, 64) + "s")
+		Debugf("Executing "+command+" took "+strconv.FormatFloat(duration, 'f', 5, 64)+"s", logAttrs...)
 	} else {
-		Verbosef("Executing " + command + " took " + strconv.FormatFloat(duration, 'f', 5, 64) + "s")
+		Verbosef("Executing "+command+" took "+strconv.FormatFloat(duration, 'f', 5, 64)+"s", logAttrs...)
 	}
 	if err != nil {
 		er.returnCode = 1
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/kballard/go-shellquote"
+)
+
+// hook names, which are also the config settings of the commands
+const (
+	hookPreDeploy  = "pre_deploy"
+	hookPostDeploy = "post_deploy"
+	hookPostPurge  = "post_purge"
+)
+
+const (
+	defaultHookTimeout        = 5 * time.Minute
+	defaultHookMaxConcurrency = 5
+)
+
+var (
+	hookSlots     chan struct{}
+	hookSlotsOnce sync.Once
+	// failedHookEnvironments contains the Puppet environments which failed because of a hook with on_failure fail_environment
+	failedHookEnvironments = make(map[string]struct{})
+)
+
+// Hooks contains the commands g10k runs for each Puppet environment before it gets deployed, after it got deployed
+// and after unmanaged content got purged. The hooks of a source take precedence over the global hooks
+type Hooks struct {
+	PreDeploy      string        `yaml:"pre_deploy"`
+	PostDeploy     string        `yaml:"post_deploy"`
+	PostPurge      string        `yaml:"post_purge"`
+	TimeoutString  string        `yaml:"timeout"`
+	Timeout        time.Duration `yaml:"-"`
+	MaxConcurrency int           `yaml:"max_concurrency"`
+	OnFailure      string        `yaml:"on_failure"`
+}
+
+// HookPayload is the JSON document a hook gets on stdin
+type HookPayload struct {
+	Hook           string          `json:"hook"`
+	Environment    string          `json:"environment"`
+	Source         string          `json:"source,omitempty"`
+	Dir            string          `json:"dir,omitempty"`
+	GitURL         string          `json:"git_url,omitempty"`
+	Ref            string          `json:"ref,omitempty"`
+	Action         string          `json:"action"`
+	Commit         string          `json:"commit,omitempty"`
+	OldCommit      string          `json:"old_commit,omitempty"`
+	ChangedModules []*ReportModule `json:"changed_modules"`
+	PurgedDirs     []string        `json:"purged_dirs,omitempty"`
+}
+
+// validateHooks checks the hooks settings of the g10k config or of a source and returns them with the parsed timeout
+func validateHooks(hooks Hooks, name string, configFile string) Hooks {
+	if len(hooks.TimeoutString) > 0 {
+		timeout, err := time.ParseDuration(hooks.TimeoutString)
+		if err != nil || timeout <= 0 {
+			Fatalf("Error: Can not convert value " + hooks.TimeoutString + " of config setting timeout of " + name + " to a positive golang Duration. Valid time units are 300ms, 1.5h or 2h45m. In " + configFile)
+		}
+		hooks.Timeout = timeout
+	}
+	if hooks.MaxConcurrency < 0 {
+		Fatalf("Error: max_concurrency of " + name + " must not be negative. In " + configFile)
+	}
+	switch hooks.OnFailure {
+	case "", "warn", "fail_environment", "fail_run":
+	default:
+		Fatalf("Error: Invalid value " + hooks.OnFailure + " for config setting on_failure of " + name + ", valid values are warn, fail_environment or fail_run. In " + configFile)
+	}
+	for hook, command := range map[string]string{hookPreDeploy: hooks.PreDeploy, hookPostDeploy: hooks.PostDeploy, hookPostPurge: hooks.PostPurge} {
+		if _, err := shellquote.Split(command); err != nil {
+			Fatalf("Error: Can not parse the " + hook + " command " + command + " of " + name + " Error: " + err.Error() + ". In " + configFile)
+		}
+	}
+	return hooks
+}
+
+// hooksOfSource returns the global hooks overridden by the hooks of the given source with the default timeout and failure handling
+func hooksOfSource(source string) Hooks {
+	h := config.Hooks
+	sh := config.Sources[source].Hooks
+	if len(sh.PreDeploy) > 0 {
+		h.PreDeploy = sh.PreDeploy
+	}
+	if len(sh.PostDeploy) > 0 {
+		h.PostDeploy = sh.PostDeploy
+	}
+	if len(sh.PostPurge) > 0 {
+		h.PostPurge = sh.PostPurge
+	}
+	if sh.Timeout > 0 {
+		h.Timeout = sh.Timeout
+	}
+	if len(sh.OnFailure) > 0 {
+		h.OnFailure = sh.OnFailure
+	}
+	if h.Timeout == 0 {
+		h.Timeout = defaultHookTimeout
+	}
+	if len(h.OnFailure) == 0 {
+		h.OnFailure = "warn"
+	}
+	return h
+}
+
+// command returns the configured command of the given hook
+func (h Hooks) command(hook string) string {
+	switch hook {
+	case hookPreDeploy:
+		return h.PreDeploy
+	case hookPostDeploy:
+		return h.PostDeploy
+	case hookPostPurge:
+		return h.PostPurge
+	}
+	return ""
+}
+
+// runEnvironmentHook runs the hook of the source of the Puppet environment env with the payload on stdin if it is configured
+// and returns false if the Puppet environment has to be treated as failed, because the hook failed with on_failure fail_environment
+func runEnvironmentHook(hook string, source string, payload HookPayload) bool {
+	h := hooksOfSource(source)
+	command := h.command(hook)
+	if len(command) == 0 || dryRun || interrupted() {
+		return true
+	}
+	payload.Hook = hook
+	if payload.ChangedModules == nil {
+		payload.ChangedModules = []*ReportModule{}
+	}
+	err := executeHook(command, h.Timeout, payload)
+	if err == nil {
+		return true
+	}
+	if interrupted() {
+		return false
+	}
+	message := hook + " hook " + command + " of Puppet environment " + payload.Environment + " failed: " + err.Error()
+	logAttrs := []slog.Attr{slog.String("environment", payload.Environment), slog.String("source", source), slog.String("hook", hook)}
+	switch h.OnFailure {
+	case "fail_run":
+		Fatalf("Error: "+message, logAttrs...)
+	case "fail_environment":
+		Warnf("WARN: "+message+", marking the Puppet environment as failed", logAttrs...)
+		runReport.recordEnvironmentFailure(payload.Environment, message)
+		mutex.Lock()
+		failedHookEnvironments[payload.Environment] = empty
+		mutex.Unlock()
+		return false
+	default:
+		Warnf("WARN: "+message, logAttrs...)
+	}
+	return true
+}
+
+// executeHook runs the hook command with the JSON payload on stdin and fails if the command does not exit with 0 within the timeout
+// the number of concurrently running hooks is limited by the max_concurrency setting of the global hooks
+func executeHook(command string, timeout time.Duration, payload HookPayload) error {
+	hookSlotsOnce.Do(func() {
+		maxConcurrency := config.Hooks.MaxConcurrency
+		if maxConcurrency == 0 {
+			maxConcurrency = defaultHookMaxConcurrency
+		}
+		hookSlots = make(chan struct{}, maxConcurrency)
+	})
+	select {
+	case hookSlots <- struct{}{}:
+	case <-runCtx.Done():
+		return runCtx.Err()
+	}
+	defer func() { <-hookSlots }()
+
+	args, err := shellquote.Split(command)
+	if err != nil || len(args) == 0 {
+		return errors.New("can not parse command")
+	}
+	input, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(runCtx, timeout)
+	defer cancel()
+	cmd := newCancelableCommandContext(ctx, args[0], args[1:]...)
+	// terminate the whole process group, otherwise the children of a hook script keep the output open after a timeout
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGTERM)
+	}
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Env = append(os.Environ(), "G10K_HOOK="+payload.Hook, "G10K_ENVIRONMENT="+payload.Environment, "G10K_SOURCE="+payload.Source)
+	before := time.Now()
+	out, err := cmd.CombinedOutput()
+	duration := time.Since(before).Seconds()
+	Verbosef("Executing "+payload.Hook+" hook "+command+" for Puppet environment "+payload.Environment+" took "+strconv.FormatFloat(duration, 'f', 5, 64)+"s", slog.String("hook", payload.Hook), slog.String("command", command), slog.String("environment", payload.Environment), slog.Float64("duration", duration))
+	if len(out) > 0 {
+		Debugf(payload.Hook + " hook output of Puppet environment " + payload.Environment + ": " + strings.TrimSpace(string(out)))
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return errors.New("timed out after " + timeout.String())
+	}
+	if err != nil {
+		return errors.New(err.Error() + " " + strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// environmentPayload returns the hook payload of the Puppet environment env with the changed modules of this run
+func environmentPayload(env string) HookPayload {
+	re := runReport.environmentSnapshot(env)
+	payload := HookPayload{Environment: env, Source: re.Source, Dir: re.Dir, GitURL: re.GitURL, Ref: re.Ref, Action: re.Action, Commit: re.Commit, OldCommit: re.OldCommit, ChangedModules: []*ReportModule{}}
+	for _, rm := range re.Modules {
+		if rm.Action != actionUnchanged {
+			payload.ChangedModules = append(payload.ChangedModules, rm)
+		}
+	}
+	return payload
+}
+
+// runPreDeployHook runs the pre_deploy hook before the Puppet environment env in targetDir gets updated to a new commit
+// of the branch of the control repository gitDir and returns false if the Puppet environment must not be deployed
+func runPreDeployHook(env string, source string, gitDir string, branch string, targetDir string) bool {
+	if len(hooksOfSource(source).PreDeploy) == 0 || dryRun {
+		return true
+	}
+	commit, err := resolvedRefs.resolve(gitDir, branch, true)
+	if err != nil {
+		// syncToModuleDir reports the unresolvable branch
+		return true
+	}
+	payload := environmentPayload(env)
+	payload.Commit = commit
+	payload.Action = actionCreated
+	deployFile := filepath.Join(targetDir, ".g10k-deploy.json")
+	if isDir(targetDir) {
+		payload.Action = actionUpdated
+		if fileExists(deployFile) {
+			dr := readDeployResultFile(deployFile)
+			payload.OldCommit = dr.Signature
+			if dr.Signature == commit && dr.DeploySuccess && !force {
+				// the changed modules are not known before the Puppetfile is read, so unlike post_deploy this hook does not run for module-only changes
+				Debugf("Skipping " + hookPreDeploy + " hook of Puppet environment " + env + ", because it is already deployed with commit " + commit)
+				return true
+			}
+		}
+	}
+	return runEnvironmentHook(hookPreDeploy, source, payload)
+}
+
+// runPostDeployHook runs the post_deploy hook of the Puppet environment env if it or one of its modules changed
+// and marks the Puppet environment as not successfully deployed if the hook failed with on_failure fail_environment,
+// so that it gets synced again on the next run
+func runPostDeployHook(env string, source string, deployFile string) {
+	if interrupted() {
+		return
+	}
+	payload := environmentPayload(env)
+	if payload.Action == actionFailed || (payload.Action == actionUnchanged && len(payload.ChangedModules) == 0) {
+		return
+	}
+	if !runEnvironmentHook(hookPostDeploy, source, payload) && fileExists(deployFile) {
+		dr := readDeployResultFile(deployFile)
+		dr.DeploySuccess = false
+		writeStructJSONFile(deployFile, dr)
+	}
+}
+
+// exitIfHooksFailed terminates g10k with exit code 1 if a hook with on_failure fail_environment failed
+func exitIfHooksFailed() {
+	mutex.Lock()
+	failed := []string{}
+	for env := range failedHookEnvironments {
+		failed = append(failed, env)
+	}
+	mutex.Unlock()
+	sort.Strings(failed)
+	if len(failed) > 0 {
+		Warnf("WARN: Hooks failed for the Puppet environments " + strings.Join(failed, ", "))
+		os.Exit(1)
+	}
+}
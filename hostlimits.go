@@ -0,0 +1,101 @@
+package main
+
+import (
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HostLimit limits the concurrent git commands and HTTP requests g10k sends to a git server, Forge or Git LFS server
+// The limits are shared by all git repositories, Forge modules and Git LFS objects of the host
+type HostLimit struct {
+	MaxConcurrency    int     `yaml:"max_concurrency"`
+	RequestsPerSecond float64 `yaml:"requests_per_second"`
+	limiter           *hostLimiter
+}
+
+// hostLimiter enforces the HostLimit of a host
+type hostLimiter struct {
+	// slots contains a value for each running request if max_concurrency is set
+	slots chan struct{}
+	// interval is the time between the start of two requests if requests_per_second is set
+	interval time.Duration
+	mu       sync.Mutex
+	next     time.Time
+}
+
+// validateHostLimits checks the host_limits config settings and returns them by lower case host name with the limiter of each host
+func validateHostLimits(limits map[string]HostLimit, configFile string) map[string]HostLimit {
+	if len(limits) == 0 {
+		return limits
+	}
+	validated := make(map[string]HostLimit)
+	for host, l := range limits {
+		if len(host) == 0 || strings.ContainsAny(host, "/:@") {
+			Fatalf("Error: invalid host " + host + " in host_limits, use the host name of the git URL or Forge base URL, e.g. gitlab.example.com. In " + configFile)
+		}
+		if l.MaxConcurrency < 0 || l.RequestsPerSecond < 0 {
+			Fatalf("Error: max_concurrency and requests_per_second of host_limits entry " + host + " must not be negative. In " + configFile)
+		}
+		if l.MaxConcurrency == 0 && l.RequestsPerSecond == 0 {
+			Fatalf("Error: host_limits entry " + host + " needs max_concurrency or requests_per_second. In " + configFile)
+		}
+		l.limiter = &hostLimiter{}
+		if l.MaxConcurrency > 0 {
+			l.limiter.slots = make(chan struct{}, l.MaxConcurrency)
+		}
+		if l.RequestsPerSecond > 0 {
+			l.limiter.interval = time.Duration(float64(time.Second) / l.RequestsPerSecond)
+		}
+		if _, ok := validated[strings.ToLower(host)]; ok {
+			Fatalf("Error: found multiple host_limits entries for host " + strings.ToLower(host) + ". In " + configFile)
+		}
+		validated[strings.ToLower(host)] = l
+	}
+	return validated
+}
+
+// acquireHostLimit waits until the host_limits entry of the host of the git URL or http(s) URL allows another request
+// and returns the function that has to be called once the request has finished
+func acquireHostLimit(rawURL string) func() {
+	host, _ := splitGitURL(rawURL)
+	l, ok := config.HostLimits[host]
+	if !ok || l.limiter == nil {
+		return func() {}
+	}
+	before := time.Now()
+	if l.limiter.slots != nil {
+		select {
+		case l.limiter.slots <- struct{}{}:
+		case <-runCtx.Done():
+			return func() {}
+		}
+	}
+	release := func() {
+		if l.limiter.slots != nil {
+			<-l.limiter.slots
+		}
+	}
+	if l.limiter.interval > 0 {
+		l.limiter.mu.Lock()
+		now := time.Now()
+		if l.limiter.next.Before(now) {
+			l.limiter.next = now
+		}
+		wait := l.limiter.next.Sub(now)
+		l.limiter.next = l.limiter.next.Add(l.limiter.interval)
+		l.limiter.mu.Unlock()
+		if wait > 0 {
+			select {
+			case <-time.After(wait):
+			case <-runCtx.Done():
+			}
+		}
+	}
+	if waited := time.Since(before); waited > time.Millisecond {
+		Debugf("Waited "+strconv.FormatFloat(waited.Seconds(), 'f', 3, 64)+"s for the host_limits of "+host+" for "+redactGitURL(rawURL), slog.String("host", host), slog.Float64("duration", waited.Seconds()))
+	}
+	return release
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+var (
+	// runCtx gets cancelled as soon as g10k receives SIGINT or SIGTERM
+	// everything that spawns processes, does HTTP requests or schedules new work should use it
+	runCtx              = context.Background()
+	interruptedExitCode atomic.Int32
+)
+
+// handleSignals cancels runCtx on the first SIGINT or SIGTERM and exits immediately on the second one
+func handleSignals() {
+	ctx, cancel := context.WithCancel(context.Background())
+	runCtx = ctx
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		// use the shell convention 128 + signal number as exit code
+		exitCode := 128 + int(sig.(syscall.Signal))
+		interruptedExitCode.Store(int32(exitCode))
+		Warnf("Received " + sig.String() + ", stopping g10k. No new work will be scheduled, running git commands will be terminated. Send the signal again to exit immediately")
+		cancel()
+		<-sigs
+		os.Exit(exitCode)
+	}()
+}
+
+// interrupted returns true if g10k received SIGINT or SIGTERM
+func interrupted() bool {
+	return runCtx.Err() != nil
+}
+
+// exitIfInterrupted terminates g10k with the signal specific exit code if g10k was interrupted
+func exitIfInterrupted() {
+	if interrupted() {
+		Warnf("g10k was interrupted, affected Puppet environments are marked as not successfully deployed and will be synced again on the next run")
+		writeRunResults("")
+		os.Exit(int(interruptedExitCode.Load()))
+	}
+}
+
+// newCancelableCommand returns an exec.Cmd which gets a SIGTERM when g10k is interrupted
+// git then removes its temporary files and lock files itself. If the command does not exit
+// in time it gets killed
+func newCancelableCommand(name string, args ...string) *exec.Cmd {
+	return newCancelableCommandContext(runCtx, name, args...)
+}
+
+// newCancelableCommandContext returns an exec.Cmd like newCancelableCommand, which also gets terminated when ctx is done,
+// e.g. because of a timeout derived from runCtx
+func newCancelableCommandContext(ctx context.Context, name string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Cancel = func() error {
+		return cmd.Process.Signal(syscall.SIGTERM)
+	}
+	cmd.WaitDelay = 10 * time.Second
+	return cmd
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// lfsPointerMaxSize is the maximum size of a Git LFS pointer file, larger files are never treated as pointers
+const lfsPointerMaxSize = 1024
+
+// lfsBatchSize is the maximum number of LFS objects g10k requests with one call of the LFS batch API
+const lfsBatchSize = 100
+
+var (
+	reLFSPointerOid  = regexp.MustCompile(`^oid sha256:([0-9a-f]{64})$`)
+	reLFSPointerSize = regexp.MustCompile(`^size ([0-9]+)$`)
+	reLFSConfigURL   = regexp.MustCompile(`^\s*url\s*=\s*"?([^"\s]+)"?\s*$`)
+)
+
+// lfsPointer is a Git LFS pointer file, which git archive extracts instead of the content of the file
+type lfsPointer struct {
+	oid  string
+	size int64
+}
+
+// lfsBatchRequest is the body of a request to the Git LFS batch API
+// See https://github.com/git-lfs/git-lfs/blob/main/docs/api/batch.md
+type lfsBatchRequest struct {
+	Operation string           `json:"operation"`
+	Transfers []string         `json:"transfers"`
+	Objects   []lfsBatchObject `json:"objects"`
+}
+
+// lfsBatchResponse is the response of the Git LFS batch API
+type lfsBatchResponse struct {
+	Objects []lfsBatchObject `json:"objects"`
+	Message string           `json:"message"`
+}
+
+// lfsBatchObject is an LFS object in a request or response of the Git LFS batch API
+type lfsBatchObject struct {
+	Oid     string                    `json:"oid"`
+	Size    int64                     `json:"size"`
+	Actions map[string]lfsBatchAction `json:"actions,omitempty"`
+	Error   *lfsBatchError            `json:"error,omitempty"`
+}
+
+// lfsBatchAction is the URL and the HTTP headers to download an LFS object from
+// git-lfs-authenticate returns the same for the LFS server of an SSH git URL
+type lfsBatchAction struct {
+	Href   string            `json:"href"`
+	Header map[string]string `json:"header"`
+}
+
+// lfsBatchError is the error the Git LFS batch API returns for a single LFS object
+type lfsBatchError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// parseLFSPointer returns the LFS object of the content of a Git LFS pointer file
+// the bool is false if content is not an LFS pointer
+func parseLFSPointer(content []byte) (lfsPointer, bool) {
+	if len(content) > lfsPointerMaxSize {
+		return lfsPointer{}, false
+	}
+	lines := strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+	if len(lines) < 3 || (lines[0] != "version https://git-lfs.github.com/spec/v1" && lines[0] != "version https://hawser.github.com/spec/v1") {
+		return lfsPointer{}, false
+	}
+	p := lfsPointer{size: -1}
+	for _, line := range lines[1:] {
+		if m := reLFSPointerOid.FindStringSubmatch(line); len(m) > 1 {
+			p.oid = m[1]
+		} else if m := reLFSPointerSize.FindStringSubmatch(line); len(m) > 1 {
+			p.size, _ = strconv.ParseInt(m[1], 10, 64)
+		}
+	}
+	return p, len(p.oid) > 0 && p.size >= 0
+}
+
+// lfsObjectFile returns the file of the LFS object in the LFS object cache, which uses the same layout as git-lfs
+func lfsObjectFile(oid string) string {
+	return filepath.Join(config.LFSCacheDir, "objects", oid[0:2], oid[2:4], oid)
+}
+
+// fetchLFSObjects downloads all LFS objects of the branch, tag or commit tree of the cached git repository srcDir
+// which are not in the LFS object cache yet
+func fetchLFSObjects(gitModule GitModule, srcDir string, tree string) error {
+	pointers, err := gitBackend.lfsPointers(srcDir, tree)
+	if err != nil {
+		return err
+	}
+	missing := []lfsPointer{}
+	for _, p := range pointers {
+		if !fileExists(lfsObjectFile(p.oid)) {
+			missing = append(missing, p)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	defer timeTrack(time.Now(), funcName())
+	Debugf("Fetching " + strconv.Itoa(len(missing)) + " LFS objects of " + tree + " of " + redactGitURL(gitModule.git))
+	if objectsDir := lfsLocalObjectsDir(gitModule.git); len(objectsDir) > 0 {
+		for _, p := range missing {
+			if err := copyLFSObject(p, filepath.Join(objectsDir, p.oid[0:2], p.oid[2:4], p.oid)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	endpoint, err := lfsEndpoint(gitModule, srcDir, tree)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < len(missing); i += lfsBatchSize {
+		objects, err := lfsBatch(endpoint, missing[i:min(i+lfsBatchSize, len(missing))])
+		if err != nil {
+			return err
+		}
+		for _, o := range objects {
+			if o.Error != nil {
+				return errors.New("LFS server " + redactGitURL(endpoint.Href) + " returned error " + strconv.Itoa(o.Error.Code) + " for LFS object " + o.Oid + ": " + o.Error.Message)
+			}
+			download, ok := o.Actions["download"]
+			if !ok {
+				// the LFS server does not return actions for objects the client already has
+				continue
+			}
+			if err := downloadLFSObject(lfsPointer{oid: o.Oid, size: o.Size}, download); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// lfsLocalObjectsDir returns the LFS object directory of a git repository on the local file system,
+// for which git-lfs does not use an LFS server either, or an empty string for remote git repositories
+func lfsLocalObjectsDir(gitURL string) string {
+	dir := strings.TrimPrefix(gitURL, "file://")
+	if !filepath.IsAbs(dir) {
+		return ""
+	}
+	for _, objectsDir := range []string{filepath.Join(dir, ".git", "lfs", "objects"), filepath.Join(dir, "lfs", "objects")} {
+		if isDir(objectsDir) {
+			return objectsDir
+		}
+	}
+	return filepath.Join(dir, "lfs", "objects")
+}
+
+// lfsEndpoint returns the URL and the HTTP headers of the LFS server of the git module
+// like git-lfs it uses the lfs.url of the .lfsconfig file of the tree, asks git-lfs-authenticate for SSH git URLs
+// and appends /info/lfs to http(s) git URLs
+func lfsEndpoint(gitModule GitModule, srcDir string, tree string) (lfsBatchAction, error) {
+	endpoint := lfsBatchAction{Header: make(map[string]string)}
+	gitURL := gitModule.git
+	if content, ok := gitBackend.showFile(srcDir, tree, ".lfsconfig"); ok {
+		if lfsURL := parseLFSConfigURL(content); len(lfsURL) > 0 {
+			Debugf("Using LFS server " + redactGitURL(lfsURL) + " from .lfsconfig of " + redactGitURL(gitModule.git))
+			endpoint.Href = lfsURL
+			gitURL = lfsURL
+		}
+	}
+	if !isHTTPGitURL(gitURL) {
+		gitModule.git = gitURL
+		return lfsAuthenticate(gitModule)
+	}
+	if len(endpoint.Href) == 0 {
+		endpoint.Href = strings.TrimSuffix(redactGitURL(gitURL), "/")
+		if !strings.HasSuffix(endpoint.Href, ".git") {
+			endpoint.Href += ".git"
+		}
+		endpoint.Href += "/info/lfs"
+	}
+	endpoint.Href = redactGitURL(endpoint.Href)
+	if username, password, ok := httpsCredentialsForGitURL(gitURL); ok {
+		endpoint.Header["Authorization"] = "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
+	}
+	return endpoint, nil
+}
+
+// parseLFSConfigURL returns the lfs.url setting of the content of an .lfsconfig file
+func parseLFSConfigURL(content string) string {
+	section := ""
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "[") {
+			section = strings.ToLower(strings.Trim(line, "[] "))
+		} else if m := reLFSConfigURL.FindStringSubmatch(line); len(m) > 1 && section == "lfs" {
+			return m[1]
+		}
+	}
+	return ""
+}
+
+// lfsAuthenticate returns the URL and the HTTP headers of the LFS server of an SSH git URL from git-lfs-authenticate on the git server
+func lfsAuthenticate(gitModule GitModule) (lfsBatchAction, error) {
+	endpoint := lfsBatchAction{}
+	userHost, port, repoPath := "", "", ""
+	if u, err := url.Parse(gitModule.git); err == nil && u.Scheme == "ssh" {
+		userHost = u.Host
+		if len(u.Port()) > 0 {
+			userHost = strings.TrimSuffix(u.Host, ":"+u.Port())
+			port = u.Port()
+		}
+		if u.User != nil {
+			userHost = u.User.Username() + "@" + userHost
+		}
+		repoPath = strings.TrimPrefix(u.Path, "/")
+	} else if m := reSCPLikeGitURL.FindString(gitModule.git); len(m) > 0 {
+		userHost = strings.TrimSuffix(m, ":")
+		repoPath = gitModule.git[len(m):]
+	} else {
+		return endpoint, errors.New("can not find the LFS server of git repository " + redactGitURL(gitModule.git))
+	}
+	privateKey, knownHosts := sshSettingsForGitModule(gitModule, false)
+	args := sshCommand(privateKey, knownHosts)
+	if len(args) == 0 {
+		args = []string{"ssh"}
+	}
+	if len(port) > 0 {
+		args = append(args, "-p", port)
+	}
+	args = append(args, userHost, "git-lfs-authenticate", repoPath, "download")
+	command := strings.Join(args, " ")
+	Debugf("Executing " + command)
+	before := time.Now()
+	out, err := newCancelableCommand(args[0], args[1:]...).Output()
+	Verbosef("Executing " + command + " took " + strconv.FormatFloat(time.Since(before).Seconds(), 'f', 5, 64) + "s")
+	if err != nil {
+		return endpoint, gitCommandError{command: command, output: err.Error()}
+	}
+	if err := json.Unmarshal(out, &endpoint); err != nil || len(endpoint.Href) == 0 {
+		return endpoint, gitCommandError{command: command, output: "invalid response " + string(out)}
+	}
+	for _, value := range endpoint.Header {
+		registerSecret(strings.TrimPrefix(strings.TrimPrefix(value, "Basic "), "RemoteAuth "))
+	}
+	return endpoint, nil
+}
+
+// lfsBatch requests the download URLs of the LFS objects from the Git LFS batch API of the LFS server
+func lfsBatch(endpoint lfsBatchAction, pointers []lfsPointer) ([]lfsBatchObject, error) {
+	batchURL := strings.TrimSuffix(endpoint.Href, "/") + "/objects/batch"
+	body := lfsBatchRequest{Operation: "download", Transfers: []string{"basic"}}
+	for _, p := range pointers {
+		body.Objects = append(body.Objects, lfsBatchObject{Oid: p.oid, Size: p.size})
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(runCtx, "POST", batchURL, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range endpoint.Header {
+		req.Header.Set(key, value)
+	}
+	req.Header.Set("Accept", "application/vnd.git-lfs+json")
+	req.Header.Set("Content-Type", "application/vnd.git-lfs+json")
+	req.Header.Set("User-Agent", "https://github.com/xorpaul/g10k/")
+	defer acquireHostLimit(batchURL)()
+	before := time.Now()
+	resp, err := lfsHTTPClient().Do(req)
+	Verbosef("Requesting " + strconv.Itoa(len(pointers)) + " LFS objects from " + batchURL + " took " + strconv.FormatFloat(time.Since(before).Seconds(), 'f', 5, 64) + "s")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var batch lfsBatchResponse
+	if err := json.NewDecoder(resp.Body).Decode(&batch); err != nil && resp.StatusCode == http.StatusOK {
+		return nil, errors.New("could not parse the response of the LFS batch API " + batchURL + " Error: " + err.Error())
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("LFS batch API " + batchURL + " returned " + resp.Status + " " + batch.Message)
+	}
+	return batch.Objects, nil
+}
+
+// downloadLFSObject downloads the LFS object into the LFS object cache
+func downloadLFSObject(p lfsPointer, download lfsBatchAction) error {
+	req, err := http.NewRequestWithContext(runCtx, "GET", download.Href, nil)
+	if err != nil {
+		return err
+	}
+	for key, value := range download.Header {
+		req.Header.Set(key, value)
+	}
+	req.Header.Set("User-Agent", "https://github.com/xorpaul/g10k/")
+	Debugf("Downloading LFS object " + p.oid)
+	defer acquireHostLimit(download.Href)()
+	resp, err := lfsHTTPClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("could not download LFS object " + p.oid + ", because the LFS server returned " + resp.Status)
+	}
+	return storeLFSObject(p, resp.Body)
+}
+
+// copyLFSObject copies the LFS object from the LFS object directory of a local git repository into the LFS object cache
+func copyLFSObject(p lfsPointer, file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return errors.New("could not find LFS object " + p.oid + " Error: " + err.Error())
+	}
+	defer f.Close()
+	return storeLFSObject(p, f)
+}
+
+// storeLFSObject writes the content of the LFS object to the LFS object cache after verifying its size and SHA-256 sum
+func storeLFSObject(p lfsPointer, r io.Reader) error {
+	dir := checkDirAndCreate(filepath.Dir(lfsObjectFile(p.oid)), "LFS object cache")
+	tmp, err := os.CreateTemp(dir, p.oid+".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hash), io.LimitReader(r, p.size+1))
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if size != p.size || fmt.Sprintf("%x", hash.Sum(nil)) != p.oid {
+		return errors.New("LFS object " + p.oid + " has a different size or SHA-256 sum than expected")
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), lfsObjectFile(p.oid))
+}
+
+// lfsObjectContent returns the content of the LFS object from the LFS object cache if the file of the module is a Git LFS pointer file
+// and the content of the file otherwise
+func lfsObjectContent(r io.Reader, module string, filename string) (io.ReadCloser, error) {
+	content, err := io.ReadAll(io.LimitReader(r, lfsPointerMaxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	p, ok := parseLFSPointer(content)
+	if !ok {
+		return io.NopCloser(bytes.NewReader(content)), nil
+	}
+	f, err := os.Open(lfsObjectFile(p.oid))
+	if err != nil {
+		Warnf("WARN: Could not find LFS object " + p.oid + " of " + filename + " of module " + module + " in " + config.LFSCacheDir + ", extracting the LFS pointer file instead")
+		return io.NopCloser(bytes.NewReader(content)), nil
+	}
+	return f, nil
+}
+
+// lfsHTTPClient returns the HTTP client for the LFS servers, which uses the HTTP proxy settings of the environment like the Forge requests
+// and aborts requests after the timeout of the g10k config, so that a stalled LFS server does not block an extract worker forever
+func lfsHTTPClient() *http.Client {
+	return &http.Client{Transport: &http.Transport{Proxy: http.ProxyFromEnvironment}, Timeout: time.Duration(config.Timeout) * time.Second}
+}
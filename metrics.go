@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	metricsFile         string
+	metricsOnce         sync.Once
+	forgeHTTPRequests   = make(map[string]int)
+	forgeHTTPRequestsMu sync.Mutex
+	reLastSuccessMetric = regexp.MustCompile(`^g10k_environment_last_success_timestamp_seconds\{environment="((?:[^"\\]|\\.)*)"\} (\S+)$`)
+)
+
+// countForgeHTTPRequest counts the requests to the Forge by HTTP status code for the Prometheus metrics
+// requests without a response are counted with code "error"
+func countForgeHTTPRequest(resp *http.Response, err error) {
+	code := "error"
+	if err == nil {
+		code = strconv.Itoa(resp.StatusCode)
+	} else if interrupted() {
+		return
+	}
+	forgeHTTPRequestsMu.Lock()
+	forgeHTTPRequests[code]++
+	forgeHTTPRequestsMu.Unlock()
+}
+
+// escapeMetricLabel escapes a Prometheus label value
+func escapeMetricLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+// unescapeMetricLabel reverts escapeMetricLabel
+func unescapeMetricLabel(s string) string {
+	return strings.NewReplacer(`\\`, `\`, `\"`, `"`, `\n`, "\n").Replace(s)
+}
+
+// readLastSuccessTimestamps reads the last successful deploy timestamps of all Puppet environments from a previously written metrics file
+// otherwise environments which were not part of this run, e.g. because of -branch, would vanish from the metrics
+func readLastSuccessTimestamps(file string) map[string]float64 {
+	timestamps := make(map[string]float64)
+	f, err := os.Open(file)
+	if err != nil {
+		return timestamps
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if m := reLastSuccessMetric.FindStringSubmatch(scanner.Text()); len(m) > 2 {
+			if ts, err := strconv.ParseFloat(m[2], 64); err == nil {
+				timestamps[unescapeMetricLabel(m[1])] = ts
+			}
+		}
+	}
+	return timestamps
+}
+
+// cacheSize returns the size of all regular files inside of the given directory in bytes
+func cacheSize(dir string) int64 {
+	var size int64
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.Type().IsRegular() {
+			if fi, err := d.Info(); err == nil {
+				size += fi.Size()
+			}
+		}
+		return nil
+	})
+	return size
+}
+
+// writeMetric writes a single Prometheus metric family in the text exposition format
+func writeMetric(w io.Writer, name string, help string, samples map[string]float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+	labels := []string{}
+	for l := range samples {
+		labels = append(labels, l)
+	}
+	sort.Strings(labels)
+	for _, l := range labels {
+		fmt.Fprintf(w, "%s%s %s\n", name, l, strconv.FormatFloat(samples[l], 'f', -1, 64))
+	}
+}
+
+// writeMetrics writes the Prometheus metrics of the current g10k run
+// lastSuccess contains the last successful deploy timestamp of each Puppet environment
+func writeMetrics(w io.Writer, success bool, duration float64, lastSuccess map[string]float64) {
+	b := func(v bool) float64 {
+		if v {
+			return 1
+		}
+		return 0
+	}
+	writeMetric(w, "g10k_run_duration_seconds", "Duration of the last g10k run in seconds.", map[string]float64{"": duration})
+	writeMetric(w, "g10k_run_success", "Whether the last g10k run was successful.", map[string]float64{"": b(success)})
+	writeMetric(w, "g10k_run_timestamp_seconds", "Unix timestamp of the end of the last g10k run.", map[string]float64{"": float64(time.Now().Unix())})
+	// the counters are read without the global mutex, because Fatalf might get called while it is held
+	writeMetric(w, "g10k_synced_git_repositories", "Number of git repositories which were synced in the last g10k run.", map[string]float64{"": float64(syncGitCount)})
+	writeMetric(w, "g10k_synced_forge_modules", "Number of Forge modules which were synced in the last g10k run.", map[string]float64{"": float64(syncForgeCount)})
+	writeMetric(w, "g10k_changed_git_repositories", "Number of git repositories which needed to be updated in the last g10k run.", map[string]float64{"": float64(needSyncGitCount)})
+	writeMetric(w, "g10k_changed_forge_modules", "Number of Forge modules which needed to be updated in the last g10k run.", map[string]float64{"": float64(needSyncForgeCount)})
+
+	environments := make(map[string]float64)
+	for env, ts := range lastSuccess {
+		environments[`{environment="`+escapeMetricLabel(env)+`"}`] = ts
+	}
+	writeMetric(w, "g10k_environment_last_success_timestamp_seconds", "Unix timestamp of the last successful deploy of the Puppet environment.", environments)
+
+	requests := make(map[string]float64)
+	forgeHTTPRequestsMu.Lock()
+	for code, count := range forgeHTTPRequests {
+		requests[`{code="`+code+`"}`] = float64(count)
+	}
+	forgeHTTPRequestsMu.Unlock()
+	writeMetric(w, "g10k_forge_http_requests", "Number of HTTP requests to the Forge in the last g10k run by status code.", requests)
+
+	caches := make(map[string]float64)
+	for name, dir := range map[string]string{"environments": config.EnvCacheDir, "modules": config.ModulesCacheDir, "forge": config.ForgeCacheDir} {
+		if len(dir) > 0 {
+			caches[`{cache="`+name+`"}`] = float64(cacheSize(dir))
+		}
+	}
+	writeMetric(w, "g10k_cache_size_bytes", "Size of the g10k cache directories in bytes.", caches)
+}
+
+// serveMetrics serves the Prometheus metrics on /metrics of long running g10k processes like -serve-forge
+// the last successful deploy timestamps are read from the -metrics-file of the g10k runs, if it is set
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	writeMetrics(w, !interrupted(), time.Since(runStartedAt).Seconds(), readLastSuccessTimestamps(metricsFile))
+}
+
+// writeMetricsFile writes the Prometheus metrics once to the -metrics-file for the node_exporter textfile collector
+func writeMetricsFile(errorMessage string) {
+	if len(metricsFile) == 0 {
+		return
+	}
+	metricsOnce.Do(func() {
+		runSuccess := len(errorMessage) == 0 && !interrupted()
+		success := runSuccess
+		lastSuccess := readLastSuccessTimestamps(metricsFile)
+		now := float64(time.Now().Unix())
+		for _, re := range runReport.build() {
+			if re.Action == actionPurged {
+				delete(lastSuccess, re.Name)
+				continue
+			}
+			envSuccess := re.Action != actionFailed
+			for _, rm := range re.Modules {
+				if rm.Action == actionFailed {
+					envSuccess = false
+				}
+			}
+			if !envSuccess {
+				success = false
+			} else if runSuccess && !dryRun {
+				lastSuccess[re.Name] = now
+			}
+		}
+
+		// write to a temporary file first, the textfile collector must never read a partially written file
+		tmpFile := metricsFile + ".tmp"
+		f, err := os.Create(tmpFile)
+		if err != nil {
+			Warnf("Could not create metrics file " + tmpFile + " " + err.Error())
+			return
+		}
+		w := bufio.NewWriter(f)
+		writeMetrics(w, success, time.Since(runStartedAt).Seconds(), lastSuccess)
+		if err := w.Flush(); err != nil {
+			Warnf("Could not write metrics file " + tmpFile + " " + err.Error())
+		}
+		f.Close()
+		if err := os.Rename(tmpFile, metricsFile); err != nil {
+			Warnf("Could not rename " + tmpFile + " to " + metricsFile + " " + err.Error())
+		}
+	})
+}
@@ -4,20 +4,56 @@ import (
 	"archive/tar"
 	"fmt"
 	"io"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"strings"
 )
 
-func unTar(r io.Reader, targetBaseDir string) {
+// unTar extracts the tar stream r into targetBaseDir
+// module is the git module or the Forge module archive file name, e.g. puppetlabs-stdlib-6.0.0.tar.gz
+// archive entries which would end up outside of the module directory abort g10k
+func unTar(r io.Reader, targetBaseDir string, module string, lfs bool) {
 	funcName := funcName()
 	tarBallReader := tar.NewReader(r)
+	resolvedBaseDir, err := filepath.EvalSymlinks(targetBaseDir)
+	if err != nil {
+		Fatalf(funcName + "(): Failed to resolve possible symlink " + targetBaseDir + " Error: " + err.Error())
+	}
+	// git archives get extracted directly into the module directory, Forge module archives contain a top level
+	// directory named after the module and version, e.g. puppetlabs-stdlib-6.0.0/ which gets extracted into the Forge cache directory
+	isForgeArchive := targetBaseDir == config.ForgeCacheDir
+	moduleRoot := targetBaseDir
+	resolvedModuleRoot := resolvedBaseDir
+	if isForgeArchive {
+		moduleRoot = filepath.Join(targetBaseDir, strings.TrimSuffix(module, ".tar.gz"))
+		resolvedModuleRoot = filepath.Join(resolvedBaseDir, strings.TrimSuffix(module, ".tar.gz"))
+	}
+	// parent directories which are known to resolve to a path inside of the module directory
+	// this needs to be reset after each created symlink, because the symlink could change where a path leads to
+	verifiedDirs := make(map[string]bool)
+	// symlinks are checked again after the extraction, because later entries can change where a relative symlink leads to
+	createdSymlinks := []string{}
+	reject := func(entry string, reason string) {
+		if isForgeArchive {
+			// do not leave a partially extracted Forge module behind, which the next run would use as cache
+			purgeDir(moduleRoot, funcName+"(), because of a rejected archive entry")
+		}
+		Fatalf(funcName+"(): Refusing to extract "+entry+" of module "+module+", because "+reason, slog.String("module", module), slog.String("dir", moduleRoot))
+	}
 	for {
+		if interrupted() {
+			// the caller cleans up the partially written target
+			return
+		}
 		header, err := tarBallReader.Next()
 		if err != nil {
 			if err == io.EOF {
 				break
 			}
+			if interrupted() {
+				return
+			}
 			Fatalf(funcName + "(): error while tar reader.Next() for io.Reader with targetBaseDir " + targetBaseDir + " Error: " + err.Error())
 		}
 
@@ -37,7 +73,37 @@ func unTar(r io.Reader, targetBaseDir string) {
 		if matchSkiplistContent(skiplistFilename) {
 			continue
 		}
-		targetFilename := filepath.Join(targetBaseDir, filename)
+		// Skip pax_global_header with the commit ID this archive was created from
+		if header.Typeflag == tar.TypeXGlobalHeader {
+			continue
+		}
+
+		targetFilename, ok := safeJoin(targetBaseDir, filename)
+		if !ok || !isInsideDir(targetFilename, moduleRoot) {
+			reject(filename, "its path leads outside of "+moduleRoot)
+		}
+		if targetFilename == targetBaseDir {
+			// e.g. a ./ entry, the target directory exists already
+			continue
+		}
+		// the parent of the top level directory of a Forge module archive is the Forge cache directory
+		parentRoot := resolvedModuleRoot
+		if targetFilename == moduleRoot {
+			parentRoot = resolvedBaseDir
+		}
+		if !verifyParentDir(targetFilename, parentRoot, verifiedDirs) {
+			reject(filename, "one of its parent directories is a symlink pointing outside of the module directory")
+		}
+		if fi, err := os.Lstat(targetFilename); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+			if header.Typeflag == tar.TypeDir {
+				if resolved, err := filepath.EvalSymlinks(targetFilename); err != nil || !isInsideDir(resolved, resolvedModuleRoot) {
+					reject(filename, "it is an existing symlink pointing outside of the module directory")
+				}
+			} else if err := os.Remove(targetFilename); err != nil {
+				// never write through an existing symlink
+				Fatalf(funcName + "(): error while removing existing symlink " + targetFilename + " Error: " + err.Error())
+			}
+		}
 
 		switch header.Typeflag {
 		case tar.TypeDir:
@@ -67,7 +133,26 @@ func unTar(r io.Reader, targetBaseDir string) {
 			if err != nil {
 				Fatalf(funcName + "(): error while Create() file: " + filename + " Error: " + err.Error())
 			}
-			if _, err = io.Copy(writer, tarBallReader); err != nil {
+			content := io.NopCloser(tarBallReader)
+			if lfs && header.Size <= lfsPointerMaxSize {
+				// replace Git LFS pointer files with the LFS object from the LFS object cache
+				lfsContent, err := lfsObjectContent(tarBallReader, module, filename)
+				if err != nil {
+					writer.Close()
+					if interrupted() {
+						return
+					}
+					Fatalf(funcName + "(): error while reading file: " + filename + " Error: " + err.Error())
+				}
+				content = lfsContent
+			}
+			_, err = io.Copy(writer, content)
+			content.Close()
+			if err != nil {
+				writer.Close()
+				if interrupted() {
+					return
+				}
 				Fatalf(funcName + "(): error while io.copy() file: " + filename + " Error: " + err.Error())
 			}
 			if err = os.Chmod(targetFilename, os.FileMode(header.Mode)); err != nil {
@@ -80,6 +165,12 @@ func unTar(r io.Reader, targetBaseDir string) {
 			writer.Close()
 
 		case tar.TypeSymlink:
+			if filepath.IsAbs(header.Linkname) {
+				reject(filename, "it is a symlink pointing to the absolute path "+header.Linkname)
+			}
+			if !isInsideDir(filepath.Join(filepath.Dir(targetFilename), header.Linkname), moduleRoot) {
+				reject(filename, "it is a symlink pointing to "+header.Linkname+" outside of the module directory")
+			}
 			if fileExists(targetFilename) {
 				if err = os.Remove(targetFilename); err != nil {
 					Fatalf(funcName + "(): error while removing existing file " + targetFilename + " to be replaced with symlink pointing to " + header.Linkname + " Error: " + err.Error())
@@ -88,21 +179,27 @@ func unTar(r io.Reader, targetBaseDir string) {
 			if err = os.Symlink(header.Linkname, targetFilename); err != nil {
 				Fatalf(funcName + "(): error while creating symlink " + targetFilename + " pointing to " + header.Linkname + " Error: " + err.Error())
 			}
+			clear(verifiedDirs)
+			createdSymlinks = append(createdSymlinks, targetFilename)
 
 		case tar.TypeLink:
+			// the link name of a hardlink is relative to the root of the archive
+			linkTarget, ok := safeJoin(targetBaseDir, header.Linkname)
+			if !ok || !isInsideDir(linkTarget, moduleRoot) || linkTarget == moduleRoot {
+				reject(filename, "it is a hardlink pointing to "+header.Linkname+" outside of the module directory")
+			}
+			if !verifyParentDir(linkTarget, resolvedModuleRoot, verifiedDirs) {
+				reject(filename, "it is a hardlink pointing to "+header.Linkname+" through a symlink outside of the module directory")
+			}
 			if fileExists(targetFilename) {
 				if err = os.Remove(targetFilename); err != nil {
 					Fatalf(funcName + "(): error while removing existing file " + targetFilename + " to be replaced with hardlink pointing to " + header.Linkname + " Error: " + err.Error())
 				}
 			}
-			if err = os.Link(header.Linkname, targetFilename); err != nil {
+			if err = os.Link(linkTarget, targetFilename); err != nil {
 				Fatalf(funcName + "(): error while creating hardlink " + targetFilename + " pointing to " + header.Linkname + " Error: " + err.Error())
 			}
 
-		// Skip pax_global_header with the commit ID this archive was created from
-		case tar.TypeXGlobalHeader:
-			continue
-
 		default:
 			Fatalf(funcName + "(): Unable to untar type: " + string(header.Typeflag) + " in file " + filename)
 		}
@@ -117,6 +214,103 @@ func unTar(r io.Reader, targetBaseDir string) {
 		Debugf(fmt.Sprintf("Discarded %d bytes of trailing data from tar", nread))
 		nread, err = r.Read(buf)
 	}
+	for _, symlink := range createdSymlinks {
+		if _, ok := resolveSymlink(symlink, resolvedModuleRoot); !ok {
+			reject(strings.TrimPrefix(symlink, targetBaseDir+"/"), "it is a symlink which resolves to a path outside of the module directory")
+		}
+	}
+}
+
+// safeJoin joins the archive entry name onto dir and returns false if the result would be outside of dir
+func safeJoin(dir string, name string) (string, bool) {
+	if filepath.IsAbs(name) {
+		return "", false
+	}
+	cleaned := filepath.Clean(name)
+	if cleaned == ".." || strings.HasPrefix(cleaned, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return filepath.Join(dir, cleaned), true
+}
+
+// isInsideDir returns true if path is dir or lexically inside of dir
+func isInsideDir(path string, dir string) bool {
+	path = filepath.Clean(path)
+	dir = filepath.Clean(dir)
+	return path == dir || strings.HasPrefix(path, dir+string(filepath.Separator))
+}
+
+// verifyParentDir checks that the parent directory of path, after resolving all symlinks, is inside of resolvedRoot
+// parent directories which do not exist yet are resolved starting from their closest existing ancestor
+func verifyParentDir(path string, resolvedRoot string, verifiedDirs map[string]bool) bool {
+	dir := filepath.Dir(path)
+	if verifiedDirs[dir+"\x00"+resolvedRoot] {
+		return true
+	}
+	existing := dir
+	missing := ""
+	for {
+		if _, err := os.Lstat(existing); err == nil {
+			break
+		}
+		parent := filepath.Dir(existing)
+		if parent == existing {
+			return false
+		}
+		missing = filepath.Join(filepath.Base(existing), missing)
+		existing = parent
+	}
+	resolved, err := filepath.EvalSymlinks(existing)
+	if err != nil {
+		return false
+	}
+	if !isInsideDir(filepath.Join(resolved, missing), resolvedRoot) {
+		return false
+	}
+	verifiedDirs[dir+"\x00"+resolvedRoot] = true
+	return true
+}
+
+// resolveSymlink resolves the symlink path one path component at a time and returns false if it leads outside of resolvedRoot at any point
+// in contrast to filepath.EvalSymlinks this also works for symlinks pointing to paths which do not exist
+func resolveSymlink(path string, resolvedRoot string) (string, bool) {
+	parent, err := filepath.EvalSymlinks(filepath.Dir(path))
+	if err != nil {
+		return "", false
+	}
+	return resolveRelativePath(filepath.Join(parent, filepath.Base(path)), ".", resolvedRoot, 0)
+}
+
+func resolveRelativePath(current string, rel string, resolvedRoot string, depth int) (string, bool) {
+	// same limit as the Linux kernel uses for nested symlinks
+	if depth > 40 {
+		return "", false
+	}
+	for _, component := range strings.Split(rel, "/") {
+		switch component {
+		case "", ".":
+		case "..":
+			current = filepath.Dir(current)
+		default:
+			current = filepath.Join(current, component)
+		}
+		if !isInsideDir(current, resolvedRoot) {
+			return "", false
+		}
+		fi, err := os.Lstat(current)
+		if err != nil || fi.Mode()&os.ModeSymlink == 0 {
+			continue
+		}
+		linkname, err := os.Readlink(current)
+		if err != nil || filepath.IsAbs(linkname) {
+			return "", false
+		}
+		var ok bool
+		if current, ok = resolveRelativePath(filepath.Dir(current), linkname, resolvedRoot, depth+1); !ok {
+			return "", false
+		}
+	}
+	return current, true
 }
 
 func matchSkiplistContent(filePath string) bool {
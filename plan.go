@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var planFormat string
+
+// planEnvironmentActions and planModuleActions map the actions of the run report to the wording of the -plan output
+var planEnvironmentActions = map[string]string{actionCreated: "create", actionUpdated: "update", actionPurged: "purge", actionFailed: "fail", actionUnchanged: "keep"}
+var planModuleActions = map[string]string{actionCreated: "add", actionUpdated: "change", actionPurged: "remove", actionFailed: "fail"}
+
+// Plan is the deployment plan printed with -dryrun -plan json|text
+type Plan struct {
+	Target       string            `json:"target"`
+	Environments []PlanEnvironment `json:"environments"`
+}
+
+// PlanEnvironment contains what a g10k run would do with a Puppet environment
+// Old and New contain the commit of the control repository branch
+type PlanEnvironment struct {
+	Name    string       `json:"name"`
+	Source  string       `json:"source,omitempty"`
+	Dir     string       `json:"dir,omitempty"`
+	Action  string       `json:"action"`
+	Old     string       `json:"old,omitempty"`
+	New     string       `json:"new,omitempty"`
+	Error   string       `json:"error,omitempty"`
+	Modules []PlanModule `json:"modules"`
+}
+
+// PlanModule contains what a g10k run would do with a Puppet module
+// Old and New contain the commit for git modules and the version for Forge modules
+// Files contains the files which would be deleted by the puppetfile purge level
+type PlanModule struct {
+	Name   string   `json:"name"`
+	Type   string   `json:"type,omitempty"`
+	Dir    string   `json:"dir"`
+	Action string   `json:"action"`
+	Old    string   `json:"old,omitempty"`
+	New    string   `json:"new,omitempty"`
+	Error  string   `json:"error,omitempty"`
+	Files  []string `json:"files,omitempty"`
+}
+
+// buildPlan derives the deployment plan from the outcomes collected for the run report
+// unchanged environments without module changes are left out
+func buildPlan() Plan {
+	plan := Plan{Target: reportTarget, Environments: []PlanEnvironment{}}
+	for _, re := range runReport.build() {
+		pe := PlanEnvironment{Name: re.Name, Source: re.Source, Dir: re.Dir, Action: planEnvironmentActions[re.Action], Old: re.OldCommit, New: re.Commit, Error: re.Error, Modules: []PlanModule{}}
+		if re.Action == actionUnchanged {
+			pe.Old = ""
+			pe.New = ""
+		}
+		for _, rm := range re.Modules {
+			if rm.Action == actionUnchanged {
+				continue
+			}
+			pm := PlanModule{Name: rm.Name, Type: rm.Type, Dir: rm.Dir, Action: planModuleActions[rm.Action], Old: rm.OldCommit, New: rm.Commit, Error: rm.Error}
+			if rm.Type == "forge" {
+				pm.Old = rm.OldVersion
+				pm.New = rm.Version
+			}
+			if rm.Action == actionPurged {
+				pm.Files = filesBelow(rm.Dir)
+			}
+			pe.Modules = append(pe.Modules, pm)
+		}
+		if re.Action == actionUnchanged && len(pe.Modules) == 0 {
+			continue
+		}
+		plan.Environments = append(plan.Environments, pe)
+	}
+	return plan
+}
+
+// filesBelow returns all files inside of the given directory or the path itself if it is not a directory
+func filesBelow(dir string) []string {
+	files := []string{}
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if !d.IsDir() {
+			files = append(files, path)
+		}
+		return nil
+	})
+	sort.Strings(files)
+	return files
+}
+
+// writePlan writes the deployment plan in the -plan format
+func writePlan(w io.Writer, plan Plan) {
+	if planFormat == "json" {
+		content, err := json.MarshalIndent(plan, "", "  ")
+		if err != nil {
+			Fatalf("writePlan(): Could not encode plan to JSON " + err.Error())
+		}
+		fmt.Fprintln(w, string(content))
+		return
+	}
+
+	symbols := map[string]string{"create": "+", "add": "+", "update": "~", "change": "~", "purge": "-", "remove": "-", "fail": "!", "keep": " "}
+	oldNew := func(old string, new string) string {
+		if len(old) > 0 && len(new) > 0 {
+			return " " + old + " -> " + new
+		}
+		return strings.TrimRight(" "+old+new, " ")
+	}
+	counts := make(map[string]int)
+	fmt.Fprintln(w, "Plan for "+plan.Target+":")
+	for _, pe := range plan.Environments {
+		counts["environment "+pe.Action]++
+		line := symbols[pe.Action] + " " + pe.Action + " environment " + pe.Name
+		if len(pe.Source) > 0 {
+			line += " (source " + pe.Source + ")"
+		}
+		fmt.Fprintln(w, line+oldNew(pe.Old, pe.New))
+		if len(pe.Error) > 0 {
+			fmt.Fprintln(w, "    error: "+pe.Error)
+		}
+		for _, pm := range pe.Modules {
+			counts["module "+pm.Action]++
+			line := "    " + symbols[pm.Action] + " " + pm.Action + " module " + pm.Name
+			if len(pm.Type) > 0 {
+				line += " (" + pm.Type + ")"
+			}
+			fmt.Fprintln(w, line+oldNew(pm.Old, pm.New))
+			if len(pm.Error) > 0 {
+				fmt.Fprintln(w, "        error: "+pm.Error)
+			}
+			for _, f := range pm.Files {
+				fmt.Fprintln(w, "        - "+f)
+			}
+		}
+	}
+	summary := []string{}
+	for _, c := range []string{"environment create", "environment update", "environment purge", "environment fail", "module add", "module change", "module remove", "module fail"} {
+		if counts[c] > 0 {
+			parts := strings.SplitN(c, " ", 2)
+			if parts[1] == "fail" {
+				summary = append(summary, strconv.Itoa(counts[c])+" "+parts[0]+"(s) failed")
+			} else {
+				summary = append(summary, strconv.Itoa(counts[c])+" "+parts[0]+"(s) to "+parts[1])
+			}
+		}
+	}
+	if len(summary) == 0 {
+		fmt.Fprintln(w, "No changes.")
+	} else {
+		fmt.Fprintln(w, "Plan: "+strings.Join(summary, ", "))
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// populationStrategies contains the valid values of the population_strategy setting, an empty value means hardlink
+var populationStrategies = []string{"hardlink", "reflink", "copy"}
+
+// populationFallbackWarning makes sure that the fallback from hardlinks to reflinks or copies gets logged only once per g10k run
+var populationFallbackWarning sync.Once
+
+// checkPopulationStrategy exits if strategy is not a valid population strategy
+func checkPopulationStrategy(strategy string, source string) {
+	if len(strategy) == 0 {
+		return
+	}
+	for _, s := range populationStrategies {
+		if strategy == s {
+			return
+		}
+	}
+	Fatalf("Error: Unknown population strategy " + strategy + " in " + source + ", valid values are " + strings.Join(populationStrategies, ", "))
+}
+
+// populateFile creates the file dst with the content and permissions of the cached file src with the configured population strategy
+// hardlinks fall back to a reflink and then to a copy if src and dst are on different file systems
+// and reflinks fall back to a copy if the file system does not support them
+func populateFile(src string, dst string) error {
+	switch config.PopulationStrategy {
+	case "copy":
+		return copyFile(src, dst)
+	case "reflink":
+		return reflinkOrCopyFile(src, dst)
+	}
+	err := os.Link(src, dst)
+	if errors.Is(err, syscall.EXDEV) {
+		populationFallbackWarning.Do(func() {
+			Warnf("WARN: Can not hardlink " + src + " to " + dst + ", because they are on different file systems. Falling back to reflinks or copies, consider setting population_strategy to reflink or copy")
+		})
+		return reflinkOrCopyFile(src, dst)
+	}
+	return err
+}
+
+// reflinkOrCopyFile creates dst as a reflink of src and copies src if the file systems do not support it
+func reflinkOrCopyFile(src string, dst string) error {
+	err := cloneFile(src, dst, reflinkFile)
+	if err == nil {
+		return nil
+	}
+	Debugf("Can not reflink " + src + " to " + dst + ", copying instead. Error: " + err.Error())
+	return copyFile(src, dst)
+}
+
+// copyFile creates dst as a copy of src
+func copyFile(src string, dst string) error {
+	return cloneFile(src, dst, func(dstFile *os.File, srcFile *os.File) error {
+		_, err := io.Copy(dstFile, srcFile)
+		return err
+	})
+}
+
+// cloneFile creates dst with the permissions and modification time of src and fills it with clone
+// dst gets removed again if clone fails
+func cloneFile(src string, dst string, clone func(dstFile *os.File, srcFile *os.File) error) error {
+	srcFile, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+	info, err := srcFile.Stat()
+	if err != nil {
+		return err
+	}
+	dstFile, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if err := clone(dstFile, srcFile); err != nil {
+		dstFile.Close()
+		os.Remove(dst)
+		return err
+	}
+	if err := dstFile.Close(); err != nil {
+		os.Remove(dst)
+		return err
+	}
+	// the permissions of a hardlink are not affected by the umask either
+	if err := os.Chmod(dst, info.Mode().Perm()); err != nil {
+		return err
+	}
+	return os.Chtimes(dst, info.ModTime(), info.ModTime())
+}
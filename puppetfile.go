@@ -2,16 +2,18 @@ package main
 
 import (
 	"fmt"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/remeh/sizedwaitgroup"
 	"github.com/xorpaul/uiprogress"
-	"golang.org/x/term"
 )
 
 // sourceSanityCheck is a validation function that checks if the given source has all necessary attributes (basedir, remote, SSH key exists if given)
@@ -56,27 +58,32 @@ func resolvePuppetEnvironment(tags bool, outputNameTag string) {
 			controlRepoGit := GitModule{}
 			controlRepoGit.git = sa.Remote
 			controlRepoGit.privateKey = sa.PrivateKey
-			if success := doMirrorOrUpdate(controlRepoGit, workDir, 0); success {
+			before := time.Now()
+			success := doMirrorOrUpdate(controlRepoGit, workDir, 0)
+			runReport.recordFetch(redactGitURL(sa.Remote), time.Since(before).Seconds())
+			if success {
 
 				// get all branches
-				er := executeCommand("git --git-dir "+workDir+" branch", "", config.Timeout, false, false)
-				outputBranches := er.output
-				outputTags := ""
+				branches, err := gitBackend.listBranches(workDir)
+				if err != nil {
+					Warnf("WARN: Could not list branches of git repository "+workDir+" Error: "+err.Error(), slog.String("source", source))
+				}
 
 				if tags {
-					er := executeCommand("git --git-dir "+workDir+" tag", "", config.Timeout, false, false)
-					outputTags = er.output
+					foundTags, err := gitBackend.listTags(workDir)
+					if err != nil {
+						Warnf("WARN: Could not list tags of git repository "+workDir+" Error: "+err.Error(), slog.String("source", source))
+					}
+					branches = append(branches, foundTags...)
 				}
-
-				branches := strings.Split(strings.TrimSpace(outputBranches+outputTags), "\n")
+				resolvedRefs.prefetch(workDir, branches)
 
 				foundBranch := false
 				prefix := resolveSourcePrefix(source, sa)
 				for _, branch := range branches {
-					branch = strings.TrimLeft(branch, "* ")
 					reInvalidCharacters := regexp.MustCompile(`\W`)
 					if sa.AutoCorrectEnvironmentNames == "error" && reInvalidCharacters.MatchString(branch) {
-						Warnf("Ignoring branch " + branch + ", because it contains invalid characters")
+						Warnf("Ignoring branch "+branch+", because it contains invalid characters", slog.String("source", source), slog.String("ref", branch))
 						continue
 					}
 					// XXX: maybe make this user configurable (either with dedicated file or as YAML array in g10k config)
@@ -118,8 +125,11 @@ func resolvePuppetEnvironment(tags bool, outputNameTag string) {
 
 					go func(branch string, sa Source, prefix string) {
 						defer wg.Done()
+						if interrupted() {
+							return
+						}
 						if len(branch) != 0 {
-							Debugf("Resolving environment " + prefix + branch + " of source " + source)
+							Debugf("Resolving environment "+prefix+branch+" of source "+source, slog.String("environment", prefix+branch), slog.String("source", source), slog.String("ref", branch))
 
 							renamedBranch := branch
 							if (len(outputNameTag) > 0) && (len(branchParam) > 0) {
@@ -142,7 +152,7 @@ func resolvePuppetEnvironment(tags bool, outputNameTag string) {
 								renamedBranch = reInvalidCharacters.ReplaceAllString(renamedBranch, "_")
 								if oldBranch != renamedBranch {
 									if sa.AutoCorrectEnvironmentNames == "correct_and_warn" {
-										Warnf("Renaming branch " + oldBranch + " to " + renamedBranch + " from source " + source + " " + sa.Remote)
+										Warnf("Renaming branch "+oldBranch+" to "+renamedBranch+" from source "+source+" "+sa.Remote, slog.String("source", source), slog.String("ref", branch), slog.String("environment", prefix+renamedBranch))
 									} else {
 										Debugf("Renaming branch " + oldBranch + " to " + renamedBranch + " from source " + source + " " + sa.Remote)
 									}
@@ -160,29 +170,50 @@ func resolvePuppetEnvironment(tags bool, outputNameTag string) {
 							targetDir = normalizeDir(targetDir)
 
 							env := strings.Replace(strings.Replace(targetDir, sa.Basedir, "", 1), "/", "", -1)
+							runReport.recordEnvironment(env, source, targetDir, sa.Remote, branch)
+							if !runPreDeployHook(env, source, workDir, branch, targetDir) {
+								Debugf("Not deploying Puppet environment " + env + ", because its " + hookPreDeploy + " hook failed")
+								return
+							}
 							if len(moduleParam) == 0 {
 								gitModule := GitModule{}
 								gitModule.tree = branch
+								gitModule.verifySignatures = sa.VerifySignatures
+								if sa.Submodules {
+									// submodules with relative URLs are resolved against the remote of the control repository
+									gitModule.git = sa.Remote
+									gitModule.privateKey = sa.PrivateKey
+									gitModule.submodules = true
+								}
 								syncToModuleDir(gitModule, workDir, targetDir, env)
 							}
 							pf := filepath.Join(targetDir, "Puppetfile")
 							mutex.Lock()
 							allBasedirs[sa.Basedir] = true
 							mutex.Unlock()
-							if !fileExists(pf) {
+							var puppetfile Puppetfile
+							foundPuppetfile := false
+							if dryRun && len(moduleParam) == 0 {
+								// the environment did not get populated, so read the Puppetfile directly from the control repository
+								puppetfile, foundPuppetfile = readPuppetfileFromGit(workDir, branch, sa.PrivateKey, source, sa.ForceForgeVersions)
+							} else if fileExists(pf) {
+								puppetfile = readPuppetfile(pf, sa.PrivateKey, source, branch, sa.ForceForgeVersions, false)
+								foundPuppetfile = true
+							}
+							if !foundPuppetfile {
 								Debugf("resolvePuppetEnvironment(): Skipping branch " + source + "_" + branch + " because " + pf + " does not exist")
 								deployFile := filepath.Join(targetDir, ".g10k-deploy.json")
-								if fileExists(deployFile) {
+								if fileExists(deployFile) && !dryRun {
 									Debugf("Finishing writing to deploy file " + deployFile)
 									dr := readDeployResultFile(deployFile)
-									dr.DeploySuccess = true
+									dr.DeploySuccess = !interrupted()
 									dr.FinishedAt = time.Now()
 									dr.GitDir = sa.Basedir
-									dr.GitURL = sa.Remote
+									dr.GitURL = redactGitURL(sa.Remote)
 									writeStructJSONFile(deployFile, dr)
+									runPostDeployHook(env, source, deployFile)
 								}
 							} else {
-								puppetfile := readPuppetfile(pf, sa.PrivateKey, source, branch, sa.ForceForgeVersions, false)
 								puppetfile.workDir = normalizeDir(targetDir)
 								puppetfile.controlRepoBranch = branch
 								puppetfile.gitDir = workDir
@@ -201,12 +232,13 @@ func resolvePuppetEnvironment(tags bool, outputNameTag string) {
 
 				if sa.ErrorMissingBranch && !foundBranch {
 					Fatalf("Couldn't find specified branch '" + branchParam + "' anywhere in source '" + source + "' (" + sa.Remote + ")")
-				} else if sa.WarnMissingBranch && !foundBranch {
-					Warnf("WARNING: Couldn't find specified branch '" + branchParam + "' anywhere in source '" + source + "' (" + sa.Remote + ")")
+				} else if sa.WarnMissingBranch && !foundBranch && !interrupted() {
+					Warnf("WARNING: Couldn't find specified branch '"+branchParam+"' anywhere in source '"+source+"' ("+sa.Remote+")", slog.String("source", source), slog.String("git_url", sa.Remote), slog.String("ref", branchParam))
 				}
-			} else {
-				Warnf("WARNING: Could not resolve git repository in source '" + source + "' (" + sa.Remote + ")")
+			} else if !interrupted() {
+				Warnf("WARNING: Could not resolve git repository in source '"+source+"' ("+sa.Remote+")", slog.String("source", source), slog.String("git_url", sa.Remote))
 				if sa.ExitIfUnreachable {
+					writeRunResults("Could not resolve git repository in source '" + source + "' (" + sa.Remote + ")")
 					os.Exit(1)
 				}
 			}
@@ -216,14 +248,15 @@ func resolvePuppetEnvironment(tags bool, outputNameTag string) {
 	wg.Wait()
 	if len(environmentParam) > 0 {
 		if !foundMatch {
-			Warnf("WARNING: Environment '" + environmentParam + "' cannot be found in any source and will not be deployed.")
+			Warnf("WARNING: Environment '"+environmentParam+"' cannot be found in any source and will not be deployed.", slog.String("environment", environmentParam))
 		}
 	}
 	//fmt.Println("allPuppetfiles: ", allPuppetfiles, len(allPuppetfiles))
 	//fmt.Println("allPuppetfiles[0]: ", allPuppetfiles["postinstall"])
 	resolvePuppetfile(allPuppetfiles)
 	// fmt.Printf("%+v\n", allEnvironments)
-	if len(moduleParam) == 0 {
+	// an interrupted run did not see all environments, so it must not purge anything
+	if len(moduleParam) == 0 && !interrupted() {
 		purgeUnmanagedContent(allBasedirs, allEnvironments)
 	}
 }
@@ -241,8 +274,236 @@ func resolveSourcePrefix(source string, sa Source) string {
 
 func resolvePuppetfile(allPuppetfiles map[string]Puppetfile) {
 	wg := sizedwaitgroup.New(config.MaxExtractworker)
-	exisitingModuleDirs := make(map[string]struct{})
+	uniqueGitModules, gitModuleTrees := uniqueModules(allPuppetfiles)
+	// each git repository and Forge module gets closed as soon as it is resolved,
+	// so that the Puppet environments can populate the modules they need without waiting for all others
+	gitReady := make(map[string]chan struct{})
+	for url := range uniqueGitModules {
+		gitReady[url] = make(chan struct{})
+	}
+	forgeReady := make(map[string]chan struct{})
+	for name := range uniqueForgeModules {
+		forgeReady[name] = make(chan struct{})
+	}
+	if showProgressBars() {
+		uiprogress.Start()
+	}
+	var wgResolve sync.WaitGroup
+	wgResolve.Add(2)
+	go func() {
+		defer wgResolve.Done()
+		resolveGitRepositories(uniqueGitModules, gitModuleTrees, func(url string) {
+			close(gitReady[url])
+		})
+	}()
+	go func() {
+		defer wgResolve.Done()
+		resolveForgeModules(uniqueForgeModules, func(name string) {
+			close(forgeReady[name])
+		})
+	}()
+	var wgEnvs sync.WaitGroup
+	for env, pf := range allPuppetfiles {
+		wgEnvs.Add(1)
+		go func(env string, pf Puppetfile) {
+			defer wgEnvs.Done()
+			populateEnvironment(env, pf, &wg, gitReady, forgeReady)
+		}(env, pf)
+	}
+	wgEnvs.Wait()
+	wgResolve.Wait()
+	wg.Wait()
+	if showProgressBars() {
+		uiprogress.Stop()
+	}
+}
+
+// populateEnvironment syncs the modules of the Puppetfile of the Puppet environment env as soon as each of them is resolved
+// and finishes the Puppet environment once all of its modules are synced, independently of the other Puppet environments
+func populateEnvironment(env string, pf Puppetfile, wg *sizedwaitgroup.SizedWaitGroup, gitReady map[string]chan struct{}, forgeReady map[string]chan struct{}) {
+	before := time.Now()
+	existingModuleDirs := make(map[string]struct{})
+	var wgModules sync.WaitGroup
+	Debugf("Syncing " + env + " with workDir " + pf.workDir)
+	// this prevents g10k from purging module directories on the subsequent run in -puppetfile mode
+	basedir := ""
+	if !pfMode {
+		basedir = checkDirAndCreate(pf.workDir, "basedir 2 for source "+pf.source)
+	}
+
+	for _, moduleDir := range pf.moduleDirs {
+		moduleDir = normalizeDir(filepath.Join(pf.workDir, moduleDir))
+		existingModuleDirsFI, _ := os.ReadDir(moduleDir)
+		mutex.Lock()
+		for _, exisitingModuleDir := range existingModuleDirsFI {
+			// fmt.Println("adding dir: ", filepath.Join(moduleDir, exisitingModuleDir.Name()))
+			existingModuleDirs[filepath.Join(moduleDir, exisitingModuleDir.Name())] = empty
+		}
+		mutex.Unlock()
+	}
+
+	for gitName, gitModule := range pf.gitModules {
+		moduleDir := filepath.Join(pf.workDir, gitModule.moduleDir)
+		moduleDir = normalizeDir(moduleDir)
+		if gitModule.local {
+			moduleDirectory := filepath.Join(moduleDir, gitName)
+			Debugf("Not deleting " + moduleDirectory + " as it is declared as a local module")
+			// remove this module from the existingModuleDirs map
+			if len(gitModule.installPath) > 0 {
+				moduleDirectory = filepath.Join(normalizeDir(basedir), normalizeDir(gitModule.installPath), gitName)
+			}
+			moduleDirectory = normalizeDir(moduleDirectory)
+			mutex.Lock()
+			delete(existingModuleDirs, moduleDirectory)
+			for existingDir := range existingModuleDirs {
+				rel, _ := filepath.Rel(existingDir, moduleDirectory)
+				if len(rel) > 0 && !strings.Contains(rel, "..") {
+					Debugf("not removing moduleDirectory " + moduleDirectory + " because it's a subdirectory to existingDir " + existingDir)
+					delete(existingModuleDirs, existingDir)
+				}
+			}
+			mutex.Unlock()
+			continue
+		}
+		wgModules.Add(1)
+		go func(gitName string, gitModule GitModule, env string, pf Puppetfile) {
+			defer wgModules.Done()
+			// wait until the git repository is mirrored, not until all git repositories and Forge modules are resolved
+			<-gitReady[redactGitURL(gitModule.git)]
+			wg.Add()
+			defer wg.Done()
+			if interrupted() {
+				return
+			}
+			targetDir := normalizeDir(filepath.Join(moduleDir, gitName))
+			moduleCacheDir := gitCacheDir(gitModule.git)
+			tree := gitModuleTree(gitName, gitModule, pf)
+			if len(tree) == 0 {
+				tree = detectDefaultBranch(gitModule, moduleCacheDir)
+				Debugf("Setting " + tree + " as default branch for " + gitModule.git)
+			}
+
+			if len(gitModule.installPath) > 0 {
+				targetDir = filepath.Join(basedir, normalizeDir(gitModule.installPath), gitName)
+			}
+			targetDir = normalizeDir(targetDir)
+			success := false
+
+			if gitModule.link {
+				Debugf("Trying to resolve " + moduleCacheDir + " with branch " + tree)
+				gitModule.tree = tree
+				success = syncToModuleDir(gitModule, moduleCacheDir, targetDir, env)
+			}
+
+			if len(gitModule.fallback) > 0 {
+				if !success {
+					for i, fallbackBranch := range gitModule.fallback {
+						if i == len(gitModule.fallback)-1 {
+							// last try
+							gitModule.ignoreUnreachable = true
+						}
+						Debugf("Trying to resolve " + moduleCacheDir + " with branch " + fallbackBranch)
+						gitModule.tree = fallbackBranch
+						success = syncToModuleDir(gitModule, moduleCacheDir, targetDir, env)
+						if success || interrupted() {
+							break
+						}
+					}
+					// possible TODO: shouldn't this fail if all fallback branches fail?
+				}
+			} else {
+				gitModule.tree = tree
+				success = syncToModuleDir(gitModule, moduleCacheDir, targetDir, env)
+				if !success && !config.IgnoreUnreachableModules && !interrupted() {
+					Fatalf("Failed to resolve git module '"+gitName+"' with repository "+gitModule.git+" and branch/reference '"+tree+"' used in control repository branch '"+pf.sourceBranch+"' or Puppet environment '"+env+"'", slog.String("environment", env), slog.String("source", pf.source), slog.String("module", gitName), slog.String("git_url", gitModule.git), slog.String("ref", tree))
+				}
+			}
+
+			// remove this module from the existingModuleDirs map
+			moduleDirectory := filepath.Join(moduleDir, gitName)
+			if len(gitModule.installPath) > 0 {
+				moduleDirectory = filepath.Join(normalizeDir(basedir), normalizeDir(gitModule.installPath), gitName)
+			}
+			moduleDirectory = normalizeDir(moduleDirectory)
+			mutex.Lock()
+			delete(existingModuleDirs, moduleDirectory)
+			for existingDir := range existingModuleDirs {
+				rel, _ := filepath.Rel(existingDir, moduleDirectory)
+				if len(rel) > 0 && !strings.Contains(rel, "..") {
+					Debugf("not removing moduleDirectory " + moduleDirectory + " because it's a subdirectory to existingDir " + existingDir)
+					delete(existingModuleDirs, existingDir)
+				}
+			}
+			mutex.Unlock()
+		}(gitName, gitModule, env, pf)
+	}
+	for forgeModuleName, fm := range pf.forgeModules {
+		wgModules.Add(1)
+		moduleDir := filepath.Join(pf.workDir, fm.moduleDir)
+		moduleDir = normalizeDir(moduleDir)
+		go func(forgeModuleName string, fm ForgeModule, moduleDir string, env string) {
+			defer wgModules.Done()
+			// wait until the Forge module is downloaded
+			<-forgeReady[forgeModuleKey(forgeModuleName, fm)]
+			wg.Add()
+			defer wg.Done()
+			if interrupted() {
+				return
+			}
+			syncForgeToModuleDir(forgeModuleName, fm, moduleDir, env)
+			// remove this module from the existingModuleDirs map
+			mutex.Lock()
+			mDir := filepath.Join(moduleDir, fm.name)
+			delete(existingModuleDirs, mDir)
+			mutex.Unlock()
+		}(forgeModuleName, fm, moduleDir, env)
+	}
+	wgModules.Wait()
+
+	hooksSucceeded := true
+	// unprocessed modules of an interrupted run are still in existingModuleDirs and must not be purged
+	if stringSliceContains(config.PurgeLevels, "puppetfile") && !interrupted() {
+		if len(existingModuleDirs) > 0 && len(moduleParam) == 0 {
+			purgedDirs := []string{}
+			for d := range existingModuleDirs {
+				Infof("Removing unmanaged path "+d, slog.String("dir", d))
+				runReport.recordModulePurge(env, d)
+				purgedDirs = append(purgedDirs, d)
+				if !dryRun {
+					purgeDir(d, "purge_level puppetfile")
+				}
+			}
+			sort.Strings(purgedDirs)
+			payload := environmentPayload(env)
+			payload.PurgedDirs = purgedDirs
+			hooksSucceeded = runEnvironmentHook(hookPostPurge, pf.source, payload)
+		}
+	}
+
+	deployFile := filepath.Join(pf.workDir, ".g10k-deploy.json")
+	if fileExists(deployFile) && !dryRun {
+		Debugf("Finishing writing to deploy file " + deployFile)
+		dr := readDeployResultFile(deployFile)
+		dr.DeploySuccess = !interrupted() && hooksSucceeded
+		dr.FinishedAt = time.Now()
+		dr.PuppetfileChecksum = getSha256sumFile(filepath.Join(pf.workDir, "Puppetfile"))
+		dr.GitDir = pf.gitDir
+		dr.GitURL = redactGitURL(pf.gitURL)
+		dr.ModuleSignatureVerifications = moduleSignatureVerifications(pf.workDir, dr.ModuleSignatureVerifications)
+		writeStructJSONFile(deployFile, dr)
+		if hooksSucceeded {
+			runPostDeployHook(env, pf.source, deployFile)
+		}
+	}
+	Verbosef("Finished Puppet environment "+env+" in "+strconv.FormatFloat(time.Since(before).Seconds(), 'f', 5, 64)+"s", slog.String("environment", env), slog.Float64("duration", time.Since(before).Seconds()))
+}
+
+// uniqueModules returns the git modules of all Puppetfiles by git URL with the branches, tags and commits each git repository needs
+// and adds the Forge modules of all Puppetfiles to uniqueForgeModules
+func uniqueModules(allPuppetfiles map[string]Puppetfile) (map[string]GitModule, map[string]map[string]struct{}) {
 	uniqueGitModules := make(map[string]GitModule)
+	// all branches, tags and commits of each git repository that the Puppet environments need
+	gitModuleTrees := make(map[string]map[string]struct{})
 	// if we made it this far initialize the global maps
 	latestForgeModules.m = make(map[string]string)
 	for env, pf := range allPuppetfiles {
@@ -261,8 +522,16 @@ func resolvePuppetfile(allPuppetfiles map[string]Puppetfile) {
 			}
 
 			gitModule.privateKey = pf.privateKey
-			if _, ok := uniqueGitModules[gitModule.git]; !ok {
-				uniqueGitModules[gitModule.git] = gitModule
+			// git URLs with different credentials share the same cached repository
+			url := redactGitURL(gitModule.git)
+			if _, ok := uniqueGitModules[url]; !ok {
+				uniqueGitModules[url] = gitModule
+				gitModuleTrees[url] = make(map[string]struct{})
+			}
+			// an empty tree stands for the default branch of the git repository
+			gitModuleTrees[url][gitModuleTree(gitName, gitModule, pf)] = empty
+			for _, fallbackBranch := range gitModule.fallback {
+				gitModuleTrees[url][fallbackBranch] = empty
 			}
 		}
 		for forgeModuleName, fm := range pf.forgeModules {
@@ -280,8 +549,7 @@ func resolvePuppetfile(allPuppetfiles map[string]Puppetfile) {
 				fm.cacheTTL = config.ForgeCacheTTL
 			}
 			// fmt.Println("Found Forge module", fm.author, "/", forgeModuleName, "with version", fm.version, "and cacheTTL", fm.cacheTTL)
-			forgeModuleName = strings.Replace(forgeModuleName, "/", "-", -1)
-			uniqueForgeModuleName := fm.author + "/" + forgeModuleName + "-" + fm.version
+			uniqueForgeModuleName := forgeModuleKey(forgeModuleName, fm)
 			if _, ok := uniqueForgeModules[uniqueForgeModuleName]; !ok {
 				uniqueForgeModules[uniqueForgeModuleName] = fm
 			} else {
@@ -293,193 +561,58 @@ func resolvePuppetfile(allPuppetfiles map[string]Puppetfile) {
 			}
 		}
 	}
-	if !debug && !verbose && !info && !quiet && term.IsTerminal(int(os.Stdout.Fd())) {
-		uiprogress.Start()
-	}
-	var wgResolve sync.WaitGroup
-	wgResolve.Add(2)
-	go func() {
-		defer wgResolve.Done()
-		resolveGitRepositories(uniqueGitModules)
-	}()
-	go func() {
-		defer wgResolve.Done()
-		resolveForgeModules(uniqueForgeModules)
-	}()
-	wgResolve.Wait()
-	//log.Println(config.Sources["cmdlineparam"])
-	for env, pf := range allPuppetfiles {
-		Debugf("Syncing " + env + " with workDir " + pf.workDir)
-		// this prevents g10k from purging module directories on the subsequent run in -puppetfile mode
-		basedir := ""
-		if !pfMode {
-			basedir = checkDirAndCreate(pf.workDir, "basedir 2 for source "+pf.source)
-		}
+	return uniqueGitModules, gitModuleTrees
+}
 
-		for _, moduleDir := range pf.moduleDirs {
-			moduleDir = normalizeDir(filepath.Join(pf.workDir, moduleDir))
-			exisitingModuleDirsFI, _ := os.ReadDir(moduleDir)
-			mutex.Lock()
-			for _, exisitingModuleDir := range exisitingModuleDirsFI {
-				// fmt.Println("adding dir: ", filepath.Join(moduleDir, exisitingModuleDir.Name()))
-				exisitingModuleDirs[filepath.Join(moduleDir, exisitingModuleDir.Name())] = empty
-			}
-			mutex.Unlock()
-		}
+// forgeModuleKey returns the name of the Forge module in uniqueForgeModules
+func forgeModuleKey(forgeModuleName string, fm ForgeModule) string {
+	return fm.author + "/" + strings.Replace(forgeModuleName, "/", "-", -1) + "-" + fm.version
+}
 
-		for gitName, gitModule := range pf.gitModules {
-			moduleDir := filepath.Join(pf.workDir, gitModule.moduleDir)
-			moduleDir = normalizeDir(moduleDir)
-			if gitModule.local {
-				moduleDirectory := filepath.Join(moduleDir, gitName)
-				Debugf("Not deleting " + moduleDirectory + " as it is declared as a local module")
-				// remove this module from the exisitingModuleDirs map
-				if len(gitModule.installPath) > 0 {
-					moduleDirectory = filepath.Join(normalizeDir(basedir), normalizeDir(gitModule.installPath), gitName)
-				}
-				moduleDirectory = normalizeDir(moduleDirectory)
-				mutex.Lock()
-				delete(exisitingModuleDirs, moduleDirectory)
-				for existingDir := range exisitingModuleDirs {
-					rel, _ := filepath.Rel(existingDir, moduleDirectory)
-					if len(rel) > 0 && !strings.Contains(rel, "..") {
-						Debugf("not removing moduleDirectory " + moduleDirectory + " because it's a subdirectory to existingDir " + existingDir)
-						delete(exisitingModuleDirs, existingDir)
-					}
-				}
-				mutex.Unlock()
-				continue
+// gitModuleTree returns the branch, commit, tag or ref of the git module that gets deployed to the Puppet environment of the Puppetfile
+// it is empty if the git module should use the default branch of its git repository
+func gitModuleTree(gitName string, gitModule GitModule, pf Puppetfile) string {
+	if len(gitModule.branch) > 0 {
+		return gitModule.branch
+	} else if len(gitModule.commit) > 0 {
+		return gitModule.commit
+	} else if len(gitModule.tag) > 0 {
+		return gitModule.tag
+	} else if len(gitModule.ref) > 0 {
+		return gitModule.ref
+	} else if gitModule.link {
+		if pfMode {
+			if len(os.Getenv("g10k_branch")) > 0 {
+				return os.Getenv("g10k_branch")
+			} else if len(branchParam) > 0 {
+				return branchParam
 			}
-			wg.Add()
-			go func(gitName string, gitModule GitModule, env string, pf Puppetfile) {
-				defer wg.Done()
-				targetDir := normalizeDir(filepath.Join(moduleDir, gitName))
-				moduleCacheDir := filepath.Join(config.ModulesCacheDir, strings.Replace(strings.Replace(gitModule.git, "/", "_", -1), ":", "-", -1))
-				tree := detectDefaultBranch(moduleCacheDir)
-				Debugf("Setting " + tree + " as default branch for " + gitModule.git)
-				if len(gitModule.branch) > 0 {
-					tree = gitModule.branch
-				} else if len(gitModule.commit) > 0 {
-					tree = gitModule.commit
-				} else if len(gitModule.tag) > 0 {
-					tree = gitModule.tag
-				} else if len(gitModule.ref) > 0 {
-					tree = gitModule.ref
-				} else if gitModule.link {
-					if pfMode {
-						if len(os.Getenv("g10k_branch")) > 0 {
-							tree = os.Getenv("g10k_branch")
-						} else if len(branchParam) > 0 {
-							tree = branchParam
-						} else {
-							Fatalf("resolvePuppetfile(): found module " + gitName + " with module link mode enabled and g10k in Puppetfile mode which is not supported, as g10k can not detect the environment branch of the Puppetfile. You can explicitly set the module link branch you want to use in Puppetfile mode by setting the environment variable 'g10k_branch' or using the -branch parameter")
-						}
-					} else {
-						// we want only the branch name of the control repo and not the resulting
-						// Puppet environment folder name, which could contain a prefix
-						tree = pf.controlRepoBranch
-					}
-				}
-
-				if len(gitModule.installPath) > 0 {
-					targetDir = filepath.Join(basedir, normalizeDir(gitModule.installPath), gitName)
-				}
-				targetDir = normalizeDir(targetDir)
-				success := false
-
-				if gitModule.link {
-					Debugf("Trying to resolve " + moduleCacheDir + " with branch " + tree)
-					gitModule.tree = tree
-					success = syncToModuleDir(gitModule, moduleCacheDir, targetDir, env)
-				}
-
-				if len(gitModule.fallback) > 0 {
-					if !success {
-						for i, fallbackBranch := range gitModule.fallback {
-							if i == len(gitModule.fallback)-1 {
-								// last try
-								gitModule.ignoreUnreachable = true
-							}
-							Debugf("Trying to resolve " + moduleCacheDir + " with branch " + fallbackBranch)
-							gitModule.tree = fallbackBranch
-							success = syncToModuleDir(gitModule, moduleCacheDir, targetDir, env)
-							if success {
-								break
-							}
-						}
-						// possible TODO: shouldn't this fail if all fallback branches fail?
-					}
-				} else {
-					gitModule.tree = tree
-					success = syncToModuleDir(gitModule, moduleCacheDir, targetDir, env)
-					if !success && !config.IgnoreUnreachableModules {
-						Fatalf("Failed to resolve git module '" + gitName + "' with repository " + gitModule.git + " and branch/reference '" + tree + "' used in control repository branch '" + pf.sourceBranch + "' or Puppet environment '" + env + "'")
-					}
-				}
-
-				// remove this module from the exisitingModuleDirs map
-				moduleDirectory := filepath.Join(moduleDir, gitName)
-				if len(gitModule.installPath) > 0 {
-					moduleDirectory = filepath.Join(normalizeDir(basedir), normalizeDir(gitModule.installPath), gitName)
-				}
-				moduleDirectory = normalizeDir(moduleDirectory)
-				mutex.Lock()
-				delete(exisitingModuleDirs, moduleDirectory)
-				for existingDir := range exisitingModuleDirs {
-					rel, _ := filepath.Rel(existingDir, moduleDirectory)
-					if len(rel) > 0 && !strings.Contains(rel, "..") {
-						Debugf("not removing moduleDirectory " + moduleDirectory + " because it's a subdirectory to existingDir " + existingDir)
-						delete(exisitingModuleDirs, existingDir)
-					}
-				}
-				mutex.Unlock()
-			}(gitName, gitModule, env, pf)
-		}
-		for forgeModuleName, fm := range pf.forgeModules {
-			wg.Add()
-			moduleDir := filepath.Join(pf.workDir, fm.moduleDir)
-			moduleDir = normalizeDir(moduleDir)
-			go func(forgeModuleName string, fm ForgeModule, moduleDir string, env string) {
-				defer wg.Done()
-				syncForgeToModuleDir(forgeModuleName, fm, moduleDir, env)
-				// remove this module from the exisitingModuleDirs map
-				mutex.Lock()
-				mDir := filepath.Join(moduleDir, fm.name)
-				delete(exisitingModuleDirs, mDir)
-				mutex.Unlock()
-			}(forgeModuleName, fm, moduleDir, env)
+			Fatalf("resolvePuppetfile(): found module " + gitName + " with module link mode enabled and g10k in Puppetfile mode which is not supported, as g10k can not detect the environment branch of the Puppetfile. You can explicitly set the module link branch you want to use in Puppetfile mode by setting the environment variable 'g10k_branch' or using the -branch parameter")
 		}
+		// we want only the branch name of the control repo and not the resulting
+		// Puppet environment folder name, which could contain a prefix
+		return pf.controlRepoBranch
 	}
-	wg.Wait()
+	return ""
+}
 
-	if stringSliceContains(config.PurgeLevels, "puppetfile") {
-		if len(exisitingModuleDirs) > 0 && len(moduleParam) == 0 {
-			for d := range exisitingModuleDirs {
-				Infof("Removing unmanaged path " + d)
-				if !dryRun {
-					purgeDir(d, "purge_level puppetfile")
-				}
-			}
-		}
+// readPuppetfileFromGit parses the Puppetfile of the given branch of the control repository gitDir without checking it out
+// the bool is false if the branch does not contain a Puppetfile
+func readPuppetfileFromGit(gitDir string, branch string, sshKey string, source string, forceForgeVersions bool) (Puppetfile, bool) {
+	content, ok := gitShowFile(gitDir, branch, "Puppetfile")
+	if !ok {
+		return Puppetfile{}, false
 	}
-	if !debug && !verbose && !info && !quiet && term.IsTerminal(int(os.Stdout.Fd())) {
-		uiprogress.Stop()
+	f, err := os.CreateTemp("", "g10k-Puppetfile-")
+	if err != nil {
+		Fatalf("readPuppetfileFromGit(): Could not create temporary file for the Puppetfile of branch " + branch + " of " + gitDir + " Error: " + err.Error())
 	}
-
-	for _, pf := range allPuppetfiles {
-		deployFile := filepath.Join(pf.workDir, ".g10k-deploy.json")
-		if fileExists(deployFile) {
-			Debugf("Finishing writing to deploy file " + deployFile)
-			dr := readDeployResultFile(deployFile)
-			dr.DeploySuccess = true
-			dr.FinishedAt = time.Now()
-			dr.PuppetfileChecksum = getSha256sumFile(filepath.Join(pf.workDir, "Puppetfile"))
-			dr.GitDir = pf.gitDir
-			dr.GitURL = pf.gitURL
-			writeStructJSONFile(deployFile, dr)
-		}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString(content); err != nil {
+		Fatalf("readPuppetfileFromGit(): Could not write temporary file " + f.Name() + " Error: " + err.Error())
 	}
-
+	f.Close()
+	return readPuppetfile(f.Name(), sshKey, source, branch, forceForgeVersions, false), true
 }
 
 func skipBasedOnFilterCommand(branch string, sourceName string, sa Source, workDir string) bool {
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+)
+
+// resolvedRefs caches the object names of the branches, tags and commits of the cached git repositories,
+// so that syncing a git module to every Puppet environment is a lookup instead of a git process
+var resolvedRefs = refCache{refs: make(map[string]map[string]string), defaultBranches: make(map[string]string)}
+
+// refCache contains the resolved references and the default branch per cached git repository
+type refCache struct {
+	sync.RWMutex
+	refs            map[string]map[string]string
+	defaultBranches map[string]string
+}
+
+// invalidate forgets everything about the cached git repository gitDir, e.g. because it got updated
+func (c *refCache) invalidate(gitDir string) {
+	c.Lock()
+	defer c.Unlock()
+	delete(c.refs, gitDir)
+	delete(c.defaultBranches, gitDir)
+}
+
+// prefetch resolves all trees of the cached git repository gitDir with one batched git operation
+func (c *refCache) prefetch(gitDir string, trees []string) {
+	if len(trees) == 0 || !isDir(gitDir) {
+		return
+	}
+	resolved, err := gitBackend.resolveRefs(gitDir, trees)
+	if err != nil {
+		// every reference gets resolved on its own later on
+		Debugf("Could not resolve " + strconv.Itoa(len(trees)) + " references of " + gitDir + " Error: " + err.Error())
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	if _, ok := c.refs[gitDir]; !ok {
+		c.refs[gitDir] = make(map[string]string)
+	}
+	for tree, objectName := range resolved {
+		c.refs[gitDir][tree] = objectName
+	}
+}
+
+// resolve returns the object name of the branch, tag or commit tree of the cached git repository gitDir
+// references that were not prefetched or could not be found by the batched git operation are resolved on their own,
+// so that the error message of the git backend ends up in the logs and the run report
+func (c *refCache) resolve(gitDir string, tree string, allowFail bool) (string, error) {
+	c.RLock()
+	objectName, ok := c.refs[gitDir][tree]
+	c.RUnlock()
+	if ok {
+		Debugf("Found " + tree + " of " + gitDir + " in the reference cache: " + objectName)
+		return objectName, nil
+	}
+	objectName, err := gitBackend.resolveRef(gitDir, tree, allowFail)
+	if err != nil {
+		return "", err
+	}
+	c.Lock()
+	defer c.Unlock()
+	if _, ok := c.refs[gitDir]; !ok {
+		c.refs[gitDir] = make(map[string]string)
+	}
+	c.refs[gitDir][tree] = objectName
+	return objectName, nil
+}
+
+// defaultBranch returns the default branch of the cached git repository gitDir and detects it only once
+func (c *refCache) defaultBranch(gitModule GitModule, gitDir string) string {
+	c.RLock()
+	defaultBranch, ok := c.defaultBranches[gitDir]
+	c.RUnlock()
+	if ok {
+		return defaultBranch
+	}
+	defaultBranch = gitBackend.defaultBranch(gitModule, gitDir)
+	c.Lock()
+	defer c.Unlock()
+	c.defaultBranches[gitDir] = defaultBranch
+	return defaultBranch
+}
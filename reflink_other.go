@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// reflinkFile is only supported on Linux, so population_strategy reflink always falls back to copies
+func reflinkFile(dstFile *os.File, srcFile *os.File) error {
+	return errors.ErrUnsupported
+}
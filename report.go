@@ -0,0 +1,241 @@
+package main
+
+import (
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// actions recorded in the -report file for environments and modules
+const (
+	actionUnchanged = "unchanged"
+	actionUpdated   = "updated"
+	actionCreated   = "created"
+	actionPurged    = "purged"
+	actionFailed    = "failed"
+)
+
+var (
+	reportFile   string
+	reportTarget string
+	runStartedAt = time.Now()
+	runReport    = newReportCollector()
+	reportOnce   sync.Once
+)
+
+// Report is the JSON document written to the file given with the -report parameter
+type Report struct {
+	Target       string               `json:"target"`
+	StartedAt    time.Time            `json:"started_at"`
+	FinishedAt   time.Time            `json:"finished_at"`
+	Duration     float64              `json:"duration"`
+	Success      bool                 `json:"success"`
+	Interrupted  bool                 `json:"interrupted"`
+	DryRun       bool                 `json:"dry_run"`
+	Error        string               `json:"error,omitempty"`
+	Environments []*ReportEnvironment `json:"environments"`
+}
+
+// ReportEnvironment contains what g10k did with a Puppet environment and its modules
+type ReportEnvironment struct {
+	Name            string          `json:"name"`
+	Source          string          `json:"source,omitempty"`
+	Dir             string          `json:"dir,omitempty"`
+	Action          string          `json:"action"`
+	GitURL          string          `json:"git_url,omitempty"`
+	Ref             string          `json:"ref,omitempty"`
+	Commit          string          `json:"commit,omitempty"`
+	OldCommit       string          `json:"old_commit,omitempty"`
+	FetchDuration   float64         `json:"fetch_duration"`
+	ExtractDuration float64         `json:"extract_duration"`
+	Error           string          `json:"error,omitempty"`
+	Modules         []*ReportModule `json:"modules"`
+	modules         map[string]*ReportModule
+}
+
+// ReportModule contains what g10k did with a Puppet module inside of a Puppet environment
+// Git modules are reported with the resolved commit, Forge modules with the resolved version
+type ReportModule struct {
+	Name            string  `json:"name"`
+	Type            string  `json:"type"`
+	Dir             string  `json:"dir"`
+	Action          string  `json:"action"`
+	GitURL          string  `json:"git_url,omitempty"`
+	Ref             string  `json:"ref,omitempty"`
+	Commit          string  `json:"commit,omitempty"`
+	OldCommit       string  `json:"old_commit,omitempty"`
+	Version         string  `json:"version,omitempty"`
+	OldVersion      string  `json:"old_version,omitempty"`
+	FetchDuration   float64 `json:"fetch_duration"`
+	ExtractDuration float64 `json:"extract_duration"`
+	Error           string  `json:"error,omitempty"`
+	fetchKey        string
+}
+
+// reportCollector gathers the outcome of every environment and module while g10k is running
+// it uses its own mutex, because Fatalf writes the report and might get called while the global mutex is held
+type reportCollector struct {
+	sync.Mutex
+	envs    map[string]*ReportEnvironment
+	fetches map[string]float64
+}
+
+func newReportCollector() *reportCollector {
+	return &reportCollector{envs: make(map[string]*ReportEnvironment), fetches: make(map[string]float64)}
+}
+
+// environment returns the report entry for the given Puppet environment and creates it if necessary
+// the caller needs to hold the lock
+func (rc *reportCollector) environment(env string) *ReportEnvironment {
+	re, ok := rc.envs[env]
+	if !ok {
+		re = &ReportEnvironment{Name: env, Action: actionUnchanged, modules: make(map[string]*ReportModule)}
+		rc.envs[env] = re
+	}
+	return re
+}
+
+// recordEnvironment stores the source information of a Puppet environment
+func (rc *reportCollector) recordEnvironment(env string, source string, dir string, gitURL string, ref string) {
+	rc.Lock()
+	defer rc.Unlock()
+	re := rc.environment(env)
+	re.Source = source
+	re.Dir = dir
+	re.GitURL = redactGitURL(gitURL)
+	re.Ref = ref
+}
+
+// recordEnvironmentSync stores the outcome of syncing the control repository branch of a Puppet environment
+func (rc *reportCollector) recordEnvironmentSync(env string, action string, commit string, oldCommit string, extractDuration float64, errorMessage string) {
+	rc.Lock()
+	defer rc.Unlock()
+	re := rc.environment(env)
+	re.Action = action
+	re.Commit = commit
+	re.OldCommit = oldCommit
+	re.ExtractDuration = extractDuration
+	re.Error = errorMessage
+}
+
+// recordEnvironmentPurge stores that an unmanaged Puppet environment got removed
+func (rc *reportCollector) recordEnvironmentPurge(env string, source string, dir string) {
+	rc.Lock()
+	defer rc.Unlock()
+	re := rc.environment(env)
+	re.Source = source
+	re.Dir = dir
+	re.Action = actionPurged
+}
+
+// recordEnvironmentFailure marks a Puppet environment as failed, e.g. because one of its hooks failed
+func (rc *reportCollector) recordEnvironmentFailure(env string, errorMessage string) {
+	rc.Lock()
+	defer rc.Unlock()
+	re := rc.environment(env)
+	re.Action = actionFailed
+	re.Error = errorMessage
+}
+
+// recordModule stores the outcome of syncing a module into a Puppet environment
+// a module which gets synced multiple times, e.g. because of fallback branches, keeps the last outcome
+func (rc *reportCollector) recordModule(env string, rm ReportModule) {
+	rc.Lock()
+	defer rc.Unlock()
+	re := rc.environment(env)
+	re.modules[rm.Dir] = &rm
+}
+
+// recordModulePurge stores that an unmanaged module directory got removed from a Puppet environment
+func (rc *reportCollector) recordModulePurge(env string, dir string) {
+	rc.recordModule(env, ReportModule{Name: filepath.Base(dir), Dir: dir, Action: actionPurged})
+}
+
+// recordFetch adds the time spent to fetch a git repository or a Forge module
+// the fetch happens only once per run, but the time is reported for every environment which uses it
+func (rc *reportCollector) recordFetch(key string, duration float64) {
+	rc.Lock()
+	defer rc.Unlock()
+	rc.fetches[key] += duration
+}
+
+// build returns a sorted snapshot of the collected environments and modules
+func (rc *reportCollector) build() []*ReportEnvironment {
+	rc.Lock()
+	defer rc.Unlock()
+	envs := []*ReportEnvironment{}
+	for _, re := range rc.envs {
+		env := rc.snapshot(re)
+		envs = append(envs, &env)
+	}
+	sort.Slice(envs, func(i, j int) bool {
+		return envs[i].Name < envs[j].Name
+	})
+	return envs
+}
+
+// environmentSnapshot returns a copy of the report entry of the given Puppet environment with its sorted modules
+func (rc *reportCollector) environmentSnapshot(env string) ReportEnvironment {
+	rc.Lock()
+	defer rc.Unlock()
+	return rc.snapshot(rc.environment(env))
+}
+
+// snapshot returns a copy of the report entry with the fetch durations and the modules sorted by directory
+// the caller needs to hold the lock
+func (rc *reportCollector) snapshot(re *ReportEnvironment) ReportEnvironment {
+	env := *re
+	env.FetchDuration = rc.fetches[env.GitURL]
+	env.Modules = []*ReportModule{}
+	for _, rm := range re.modules {
+		module := *rm
+		if len(module.fetchKey) > 0 {
+			module.FetchDuration = rc.fetches[module.fetchKey]
+		}
+		env.Modules = append(env.Modules, &module)
+	}
+	sort.Slice(env.Modules, func(i, j int) bool {
+		return env.Modules[i].Dir < env.Modules[j].Dir
+	})
+	return env
+}
+
+// forgeFetchKey returns the key under which the fetch time of a Forge module gets recorded
+func forgeFetchKey(fm ForgeModule) string {
+	return "forge:" + fm.author + "-" + fm.name + "-" + fm.version
+}
+
+// writeReport writes the -report file once, either at the end of the run or when g10k exits early
+// errorMessage contains the reason if g10k had to exit because of a fatal error
+func writeReport(errorMessage string) {
+	if len(reportFile) == 0 {
+		return
+	}
+	reportOnce.Do(func() {
+		finishedAt := time.Now()
+		r := Report{
+			Target:       reportTarget,
+			StartedAt:    runStartedAt,
+			FinishedAt:   finishedAt,
+			Duration:     finishedAt.Sub(runStartedAt).Seconds(),
+			Success:      len(errorMessage) == 0 && !interrupted(),
+			Interrupted:  interrupted(),
+			DryRun:       dryRun,
+			Error:        errorMessage,
+			Environments: runReport.build(),
+		}
+		for _, re := range r.Environments {
+			if re.Action == actionFailed {
+				r.Success = false
+			}
+			for _, rm := range re.Modules {
+				if rm.Action == actionFailed {
+					r.Success = false
+				}
+			}
+		}
+		Debugf("Writing report file " + reportFile)
+		writeStructJSONFile(reportFile, r)
+	})
+}
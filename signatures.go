@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"golang.org/x/crypto/ssh"
+)
+
+// signatureModes contains the valid values of the verify_signatures settings ordered by their strictness, an empty value means off
+var signatureModes = []string{"off", "warn", "enforce"}
+
+var (
+	// trustedGPGKeys contains the public keys of the gpg_keyring file
+	trustedGPGKeys openpgp.EntityList
+	// trustedSSHSigners contains the entries of the allowed_signers file
+	trustedSSHSigners []allowedSigner
+	// signatureResults caches the verification results of the commits and tag objects by cached git repository and object name,
+	// because the same commit is usually deployed to many Puppet environments
+	signatureResults sync.Map
+	// signatureVerifications contains the verification results of the git modules deployed in this run by their module directory
+	signatureVerifications = make(map[string]SignatureVerification)
+)
+
+// allowedSigner is an entry of an SSH allowed signers file, see ssh-keygen(1)
+type allowedSigner struct {
+	principals string
+	key        ssh.PublicKey
+}
+
+// signatureResult is the cached result of a signature verification
+type signatureResult struct {
+	signatureType string
+	signer        string
+	err           error
+}
+
+// checkSignatureMode exits if mode is not a valid verify_signatures value
+func checkSignatureMode(mode string, source string) {
+	if len(mode) > 0 && signatureModeLevel(mode) < 0 {
+		Fatalf("Error: Unknown verify_signatures mode " + mode + " in " + source + ", valid values are " + strings.Join(signatureModes, ", "))
+	}
+}
+
+// signatureModeLevel returns the strictness of the verify_signatures mode or -1 for invalid modes
+func signatureModeLevel(mode string) int {
+	if len(mode) == 0 {
+		return 0
+	}
+	for i, m := range signatureModes {
+		if mode == m {
+			return i
+		}
+	}
+	return -1
+}
+
+// stricterSignatureMode returns the stricter of both verify_signatures modes,
+// so that a Puppetfile can not weaken the mode of its source
+func stricterSignatureMode(a string, b string) string {
+	if signatureModeLevel(b) > signatureModeLevel(a) {
+		return b
+	}
+	return a
+}
+
+// loadSignatureKeys reads the gpg_keyring and allowed_signers files of the git section of the g10k config
+func loadSignatureKeys(git Git, configFile string) {
+	trustedGPGKeys = nil
+	trustedSSHSigners = nil
+	if len(git.GPGKeyring) > 0 {
+		content, err := os.ReadFile(git.GPGKeyring)
+		if err != nil {
+			Fatalf("Error: Could not read gpg_keyring " + git.GPGKeyring + " in " + configFile + " Error: " + err.Error())
+		}
+		trustedGPGKeys, err = openpgp.ReadArmoredKeyRing(bytes.NewReader(content))
+		if err != nil {
+			// binary keyrings like the ones exported by gpg --export
+			trustedGPGKeys, err = openpgp.ReadKeyRing(bytes.NewReader(content))
+		}
+		if err != nil || len(trustedGPGKeys) == 0 {
+			Fatalf("Error: Could not find any public keys in gpg_keyring " + git.GPGKeyring + " in " + configFile)
+		}
+	}
+	if len(git.AllowedSigners) > 0 {
+		content, err := os.ReadFile(git.AllowedSigners)
+		if err != nil {
+			Fatalf("Error: Could not read allowed_signers " + git.AllowedSigners + " in " + configFile + " Error: " + err.Error())
+		}
+		trustedSSHSigners, err = parseAllowedSigners(string(content))
+		if err != nil {
+			Fatalf("Error: Could not parse allowed_signers " + git.AllowedSigners + " in " + configFile + " Error: " + err.Error())
+		}
+	}
+}
+
+// parseAllowedSigners returns the entries of an SSH allowed signers file which are valid for git signatures
+func parseAllowedSigners(content string) ([]allowedSigner, error) {
+	signers := []allowedSigner{}
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		// principals [options] keytype base64-key [comment]
+		principals, rest, _ := strings.Cut(line, " ")
+		key, _, options, _, err := ssh.ParseAuthorizedKey([]byte(rest))
+		if err != nil {
+			return nil, errors.New("invalid line " + line + ": " + err.Error())
+		}
+		valid := true
+		for _, option := range options {
+			name, value, _ := strings.Cut(option, "=")
+			switch strings.ToLower(name) {
+			case "namespaces":
+				valid = false
+				for _, namespace := range strings.Split(strings.Trim(value, `"`), ",") {
+					if namespace == "git" {
+						valid = true
+					}
+				}
+			case "cert-authority", "valid-after", "valid-before":
+				Warnf("WARN: Ignoring allowed_signers entry for " + principals + ", because option " + name + " is not supported")
+				valid = false
+			}
+		}
+		if valid {
+			signers = append(signers, allowedSigner{principals: principals, key: key})
+		}
+	}
+	return signers, scanner.Err()
+}
+
+// verifySignature verifies the signature of the commit or annotated tag objectName of the cached git repository srcDir
+// with the verify_signatures mode of the git module
+// it returns nil if the mode is off and an error if the mode is enforce and the signature is missing or not trusted
+func verifySignature(gitModule GitModule, srcDir string, objectName string) (*SignatureVerification, error) {
+	if signatureModeLevel(gitModule.verifySignatures) <= 0 {
+		return nil, nil
+	}
+	key := srcDir + "\x00" + objectName
+	cached, ok := signatureResults.Load(key)
+	if !ok {
+		cached = verifyObjectSignature(srcDir, objectName)
+		signatureResults.Store(key, cached)
+	}
+	result := cached.(signatureResult)
+	verification := &SignatureVerification{Mode: gitModule.verifySignatures, Object: objectName, Type: result.signatureType, Signer: result.signer, Valid: result.err == nil}
+	if result.err == nil {
+		Debugf("Found valid " + result.signatureType + " signature of " + result.signer + " for " + gitModule.tree + " (" + objectName + ") of " + srcDir)
+		return verification, nil
+	}
+	verification.Error = result.err.Error()
+	if gitModule.verifySignatures == "warn" {
+		Warnf("WARN: Could not verify the signature of "+gitModule.tree+" ("+objectName+") of "+srcDir+": "+result.err.Error(), slog.String("ref", gitModule.tree), slog.String("commit", objectName))
+		return verification, nil
+	}
+	return verification, errors.New("could not verify the signature of " + gitModule.tree + " (" + objectName + "): " + result.err.Error())
+}
+
+// verifyObjectSignature verifies the GPG or SSH signature of the commit or annotated tag objectName of the git repository gitDir
+func verifyObjectSignature(gitDir string, objectName string) signatureResult {
+	objectType, content, err := gitBackend.catObject(gitDir, objectName)
+	if err != nil {
+		return signatureResult{err: err}
+	}
+	if objectType != "commit" && objectType != "tag" {
+		return signatureResult{err: errors.New(objectName + " is a " + objectType + " and not a commit or tag")}
+	}
+	payload, signature := splitSignature(objectType, content)
+	switch {
+	case len(signature) == 0:
+		return signatureResult{err: errors.New("the " + objectType + " is not signed")}
+	case bytes.HasPrefix(signature, []byte("-----BEGIN PGP SIGNATURE-----")):
+		signer, err := verifyGPGSignature(payload, signature)
+		return signatureResult{signatureType: "gpg", signer: signer, err: err}
+	case bytes.HasPrefix(signature, []byte("-----BEGIN SSH SIGNATURE-----")):
+		signer, err := verifySSHSignature(payload, signature)
+		return signatureResult{signatureType: "ssh", signer: signer, err: err}
+	}
+	return signatureResult{err: errors.New("the " + objectType + " has an unsupported signature type")}
+}
+
+// splitSignature returns the signed content and the signature of a raw commit or tag object
+// commits contain the signature in the gpgsig header, tags append it to the tag message
+func splitSignature(objectType string, content []byte) ([]byte, []byte) {
+	if objectType == "tag" {
+		for _, begin := range []string{"-----BEGIN PGP SIGNATURE-----", "-----BEGIN SSH SIGNATURE-----"} {
+			if i := bytes.LastIndex(content, []byte("\n"+begin)); i >= 0 {
+				return content[:i+1], content[i+1:]
+			}
+			if bytes.HasPrefix(content, []byte(begin)) {
+				return nil, content
+			}
+		}
+		return content, nil
+	}
+	header, message, _ := bytes.Cut(content, []byte("\n\n"))
+	payload := []byte{}
+	signature := []byte{}
+	inSignature := false
+	for _, line := range bytes.Split(header, []byte("\n")) {
+		switch {
+		case bytes.HasPrefix(line, []byte("gpgsig ")):
+			inSignature = true
+			signature = append(signature, line[len("gpgsig "):]...)
+			signature = append(signature, '\n')
+		case inSignature && bytes.HasPrefix(line, []byte(" ")):
+			signature = append(signature, line[1:]...)
+			signature = append(signature, '\n')
+		default:
+			// the gpgsig-sha256 header of SHA-256 repositories is part of the signed content of SHA-1 signatures
+			inSignature = false
+			payload = append(payload, line...)
+			payload = append(payload, '\n')
+		}
+	}
+	payload = append(payload, '\n')
+	return append(payload, message...), signature
+}
+
+// verifyGPGSignature verifies the armored OpenPGP signature of payload with the gpg_keyring and returns the signing key and its identity
+func verifyGPGSignature(payload []byte, signature []byte) (string, error) {
+	if len(trustedGPGKeys) == 0 {
+		return "", errors.New("found a GPG signature, but no gpg_keyring is configured")
+	}
+	entity, err := openpgp.CheckArmoredDetachedSignature(trustedGPGKeys, bytes.NewReader(payload), bytes.NewReader(signature), nil)
+	if err != nil {
+		return "", errors.New("invalid or untrusted GPG signature: " + err.Error())
+	}
+	signer := fmt.Sprintf("%X", entity.PrimaryKey.Fingerprint)
+	if identity := entity.PrimaryIdentity(); identity != nil {
+		signer += " " + identity.Name
+	}
+	return signer, nil
+}
+
+// verifySSHSignature verifies the armored SSH signature of payload with the git namespace against the allowed_signers
+// and returns the principals of the signing key
+// See https://github.com/openssh/openssh-portable/blob/master/PROTOCOL.sshsig
+func verifySSHSignature(payload []byte, signature []byte) (string, error) {
+	if len(trustedSSHSigners) == 0 {
+		return "", errors.New("found an SSH signature, but no allowed_signers are configured")
+	}
+	armored := strings.TrimSpace(string(signature))
+	armored = strings.TrimPrefix(armored, "-----BEGIN SSH SIGNATURE-----")
+	armored = strings.TrimSuffix(armored, "-----END SSH SIGNATURE-----")
+	blob, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(armored), ""))
+	if err != nil || !bytes.HasPrefix(blob, []byte("SSHSIG")) {
+		return "", errors.New("invalid SSH signature")
+	}
+	var sig struct {
+		Version       uint32
+		PublicKey     []byte
+		Namespace     string
+		Reserved      []byte
+		HashAlgorithm string
+		Signature     []byte
+	}
+	if err := ssh.Unmarshal(blob[len("SSHSIG"):], &sig); err != nil || sig.Version != 1 {
+		return "", errors.New("invalid SSH signature")
+	}
+	if sig.Namespace != "git" {
+		return "", errors.New("SSH signature has the namespace " + sig.Namespace + " instead of git")
+	}
+	var h hash.Hash
+	switch sig.HashAlgorithm {
+	case "sha256":
+		h = sha256.New()
+	case "sha512":
+		h = sha512.New()
+	default:
+		return "", errors.New("unsupported hash algorithm " + sig.HashAlgorithm + " of SSH signature")
+	}
+	h.Write(payload)
+	signed := []byte("SSHSIG")
+	signed = append(signed, ssh.Marshal(struct {
+		Namespace     string
+		Reserved      []byte
+		HashAlgorithm string
+		Hash          []byte
+	}{sig.Namespace, sig.Reserved, sig.HashAlgorithm, h.Sum(nil)})...)
+	key, err := ssh.ParsePublicKey(sig.PublicKey)
+	if err != nil {
+		return "", errors.New("invalid public key of SSH signature: " + err.Error())
+	}
+	var s ssh.Signature
+	if err := ssh.Unmarshal(sig.Signature, &s); err != nil {
+		return "", errors.New("invalid SSH signature: " + err.Error())
+	}
+	for _, signer := range trustedSSHSigners {
+		if bytes.Equal(signer.key.Marshal(), key.Marshal()) {
+			if err := key.Verify(signed, &s); err != nil {
+				return "", errors.New("invalid SSH signature of " + signer.principals + ": " + err.Error())
+			}
+			return signer.principals, nil
+		}
+	}
+	return "", errors.New("SSH signature of untrusted key " + ssh.FingerprintSHA256(key))
+}
+
+// recordSignatureVerification remembers the verification result of the git module in targetDir for its .g10k-deploy.json file
+func recordSignatureVerification(targetDir string, verification SignatureVerification) {
+	mutex.Lock()
+	signatureVerifications[targetDir] = verification
+	mutex.Unlock()
+}
+
+// moduleSignatureVerifications returns the verification results of the git modules of the Puppet environment in workDir
+// by their path relative to workDir, results of previous runs are kept for modules which did not change
+func moduleSignatureVerifications(workDir string, previous map[string]SignatureVerification) map[string]SignatureVerification {
+	verifications := make(map[string]SignatureVerification)
+	for dir, verification := range previous {
+		if isDir(filepath.Join(workDir, dir)) {
+			verifications[dir] = verification
+		}
+	}
+	mutex.Lock()
+	for targetDir, verification := range signatureVerifications {
+		if dir, ok := strings.CutPrefix(targetDir, filepath.Clean(workDir)+"/"); ok {
+			verifications[dir] = verification
+		}
+	}
+	mutex.Unlock()
+	if len(verifications) == 0 {
+		return nil
+	}
+	return verifications
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/kballard/go-shellquote"
+)
+
+// SSHKey maps git repositories to the SSH private key and known_hosts file that g10k should use for them
+type SSHKey struct {
+	GitURLPattern `yaml:",inline"`
+	PrivateKey    string `yaml:"private_key"`
+	KnownHosts    string `yaml:"known_hosts"`
+}
+
+// validateSSHKeys checks the ssh_keys config settings and compiles the configured regular expressions
+func validateSSHKeys(sshKeys map[string]SSHKey, configFile string) {
+	for name, key := range sshKeys {
+		if len(key.PrivateKey) == 0 && len(key.KnownHosts) == 0 {
+			Fatalf("Error: ssh_keys entry " + name + " needs at least one of private_key or known_hosts in config file " + configFile)
+		}
+		for _, file := range []string{key.PrivateKey, key.KnownHosts} {
+			if len(file) == 0 {
+				continue
+			}
+			if _, err := os.Stat(file); err != nil {
+				Fatalf("Error: could not find " + file + " of ssh_keys entry " + name + " in config file " + configFile + " Error: " + err.Error())
+			}
+		}
+		key.compile("ssh_keys", name, configFile)
+		sshKeys[name] = key
+	}
+}
+
+// sshKeyForURL returns the first ssh_keys entry in alphabetical order of their names that matches the git URL
+func sshKeyForURL(gitURL string) (string, SSHKey, bool) {
+	names := []string{}
+	for name := range config.SSHKeys {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if config.SSHKeys[name].matches(gitURL) {
+			return name, config.SSHKeys[name], true
+		}
+	}
+	return "", SSHKey{}, false
+}
+
+// sshSettingsForGitModule returns the SSH private key and known_hosts file to use for the git repository
+// The :ssh_key Puppetfile attribute takes precedence over :use_ssh_agent, which takes precedence over a matching ssh_keys entry,
+// which takes precedence over the private_key of the source. Only for control repositories the private_key of the source wins
+func sshSettingsForGitModule(gm GitModule, isControlRepo bool) (string, string) {
+	knownHosts := config.Git.KnownHosts
+	if len(gm.sshKey) > 0 {
+		key := config.SSHKeys[gm.sshKey]
+		Debugf("Using ssh_keys entry " + gm.sshKey + " for git repo url " + gm.git + " because of the :ssh_key attribute")
+		if len(key.KnownHosts) > 0 {
+			knownHosts = key.KnownHosts
+		}
+		return key.PrivateKey, knownHosts
+	}
+	privateKey := gm.privateKey
+	if !isControlRepo && (strings.Contains(gm.git, "github.com") || strings.HasPrefix(gm.git, "https://")) {
+		// GitHub deploy keys only grant access to a single repository, so the private_key of the source
+		// is not used for git modules on github.com
+		privateKey = ""
+	}
+	if name, key, ok := sshKeyForURL(gm.git); ok {
+		Debugf("Using ssh_keys entry " + name + " for git repo url " + gm.git)
+		if len(key.KnownHosts) > 0 {
+			knownHosts = key.KnownHosts
+		}
+		if len(key.PrivateKey) > 0 && !(isControlRepo && len(gm.privateKey) > 0) {
+			privateKey = key.PrivateKey
+		}
+	}
+	if gm.useSSHAgent {
+		return "", knownHosts
+	}
+	return privateKey, knownHosts
+}
+
+// sshEnv returns the GIT_SSH_COMMAND environment variable which makes git use the given SSH private key and known_hosts file
+func sshEnv(privateKey string, knownHosts string) []string {
+	sshCommand := sshCommand(privateKey, knownHosts)
+	if sshCommand == nil {
+		return nil
+	}
+	return []string{"GIT_SSH_COMMAND=" + shellquote.Join(sshCommand...)}
+}
+
+// sshCommand returns the ssh command line which uses the given SSH private key and known_hosts file
+// BatchMode makes ssh fail instead of waiting for a passphrase or a host key confirmation until the timeout kicks in,
+// keys with a passphrase need to be loaded into the ssh-agent of the user running g10k beforehand
+func sshCommand(privateKey string, knownHosts string) []string {
+	strictHostKeyChecking := config.Git.StrictHostKeyChecking
+	if len(strictHostKeyChecking) == 0 && len(knownHosts) > 0 {
+		strictHostKeyChecking = "yes"
+	}
+	if len(privateKey) == 0 && len(knownHosts) == 0 && len(strictHostKeyChecking) == 0 {
+		// keep the SSH settings of the user running g10k
+		return nil
+	}
+	sshCommand := []string{"ssh", "-o", "BatchMode=yes"}
+	if len(privateKey) > 0 {
+		sshCommand = append(sshCommand, "-i", privateKey, "-o", "IdentitiesOnly=yes")
+	}
+	if len(knownHosts) > 0 {
+		sshCommand = append(sshCommand, "-o", "UserKnownHostsFile="+knownHosts)
+	}
+	if len(strictHostKeyChecking) > 0 {
+		sshCommand = append(sshCommand, "-o", "StrictHostKeyChecking="+strictHostKeyChecking)
+	}
+	return sshCommand
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"log/slog"
 	"path/filepath"
 	"strings"
 )
@@ -59,15 +60,19 @@ func purgeUnmanagedContent(allBasedirs map[string]bool, allEnvironments map[stri
 							if checkRemoteSourceOfEnvironment(env, config.Sources) {
 								// TODO: add test for this using https://github.com/xorpaul/g10k_purge_env_test/branches
 								Debugf("Purging environment " + env + " because its remote source matches configured source remote")
-								Infof("Removing unmanaged environment " + env)
+								Infof("Removing unmanaged environment "+env, slog.String("source", source), slog.String("environment", envName))
+								runReport.recordEnvironmentPurge(envName, source, env)
 								if !dryRun {
 									purgeDir(env, "purgeStaleContent()")
+									runEnvironmentHook(hookPostPurge, source, HookPayload{Environment: envName, Source: source, Dir: env, Action: actionPurged, PurgedDirs: []string{env}})
 								}
 							} else {
 								Debugf("Purging environment " + env + " because its remote source belongs to a different source remote")
-								Infof("Removing unmanaged environment " + env)
+								Infof("Removing unmanaged environment "+env, slog.String("source", source), slog.String("environment", envName))
+								runReport.recordEnvironmentPurge(envName, source, env)
 								if !dryRun {
 									purgeDir(env, "purgeStaleContent()")
+									runEnvironmentHook(hookPostPurge, source, HookPayload{Environment: envName, Source: source, Dir: env, Action: actionPurged, PurgedDirs: []string{env}})
 								}
 							}
 						}
@@ -92,7 +97,8 @@ func checkRemoteSourceOfEnvironment(environmentDir string, configSources map[str
 
 	for _, source := range configSources {
 		Debugf("Comparing source remote " + source.Remote + " with deploy result git url " + dr.GitURL)
-		if dr.GitURL == source.Remote {
+		// deploy files contain the git url without credentials
+		if redactGitURL(dr.GitURL) == redactGitURL(source.Remote) {
 			return true
 		}
 	}
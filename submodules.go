@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	reGitmodulesSection = regexp.MustCompile(`^\s*\[\s*submodule\s+"(.+)"\s*\]`)
+	reGitmodulesSetting = regexp.MustCompile(`^\s*(path|url)\s*=\s*(.*?)\s*$`)
+	reSCPLikeGitURL     = regexp.MustCompile(`^([^/:]+@)?[^/:]+:`)
+)
+
+// submoduleMirrors makes sure that the cached git repository of every submodule gets updated only once per g10k run
+var submoduleMirrors sync.Map
+
+// parseGitmodules returns the URLs of the submodules in the content of a .gitmodules file by their path
+func parseGitmodules(content string) map[string]string {
+	paths := make(map[string]string)
+	urls := make(map[string]string)
+	name := ""
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if m := reGitmodulesSection.FindStringSubmatch(line); len(m) > 1 {
+			name = m[1]
+		} else if strings.HasPrefix(strings.TrimSpace(line), "[") {
+			name = ""
+		} else if m := reGitmodulesSetting.FindStringSubmatch(line); len(m) > 2 && len(name) > 0 {
+			value := strings.Trim(m[2], `"`)
+			if m[1] == "path" {
+				paths[name] = value
+			} else {
+				urls[name] = value
+			}
+		}
+	}
+	submodules := make(map[string]string)
+	for name, p := range paths {
+		if url, ok := urls[name]; ok {
+			submodules[strings.TrimSuffix(p, "/")] = url
+		}
+	}
+	return submodules
+}
+
+// resolveSubmoduleURL resolves a submodule URL relative to the URL of the parent git repository like git submodule does,
+// e.g. ../apt.git of git@github.com:puppetlabs/puppetlabs-stdlib.git becomes git@github.com:puppetlabs/apt.git
+func resolveSubmoduleURL(parentURL string, url string) string {
+	if !strings.HasPrefix(url, "./") && !strings.HasPrefix(url, "../") {
+		return url
+	}
+	prefix := ""
+	base := strings.TrimSuffix(parentURL, "/")
+	if i := strings.Index(base, "://"); i >= 0 {
+		if j := strings.Index(base[i+3:], "/"); j >= 0 {
+			prefix, base = base[:i+3+j], base[i+3+j:]
+		}
+	} else if m := reSCPLikeGitURL.FindString(base); len(m) > 0 {
+		prefix, base = m, base[len(m):]
+	}
+	rooted := strings.HasPrefix(base, "/")
+	resolved := path.Join(base, url)
+	if !rooted {
+		resolved = strings.TrimPrefix(resolved, "/")
+	}
+	return prefix + resolved
+}
+
+// submoduleParents returns the parentRepositories of the submodules of the git module at commit and fails if the submodule
+// is one of its own parents, because a cyclic submodule would otherwise get mirrored and extracted over and over again
+func submoduleParents(gitModule GitModule, commit string, submodule GitModule) ([]string, error) {
+	parents := append(append([]string{}, gitModule.parentRepositories...), gitCacheDir(gitModule.git)+"@"+commit)
+	for _, parent := range parents {
+		if parent == gitCacheDir(submodule.git)+"@"+submodule.tree {
+			return nil, errors.New("cyclic submodule " + redactGitURL(submodule.git) + " at commit " + submodule.tree + " in " + redactGitURL(gitModule.git))
+		}
+	}
+	return parents, nil
+}
+
+// extractSubmodules extracts the submodules of the branch, tag or commit tree of the cached git repository srcDir
+// at the commits recorded in tree into their paths inside of targetDir
+func extractSubmodules(gitModule GitModule, srcDir string, tree string, targetDir string) error {
+	commits, err := gitBackend.listSubmodules(srcDir, tree)
+	if err != nil || len(commits) == 0 {
+		return err
+	}
+	content, _ := gitBackend.showFile(srcDir, tree, ".gitmodules")
+	urls := parseGitmodules(content)
+	submodulePaths := []string{}
+	for submodulePath := range commits {
+		submodulePaths = append(submodulePaths, submodulePath)
+	}
+	sort.Strings(submodulePaths)
+	for _, submodulePath := range submodulePaths {
+		url, ok := urls[submodulePath]
+		if !ok {
+			return errors.New("could not find the URL of submodule " + submodulePath + " in the .gitmodules file of " + tree)
+		}
+		if !filepath.IsLocal(submodulePath) {
+			return errors.New("invalid submodule path " + submodulePath + " in " + tree)
+		}
+		// the :ssh_key of the parent is not used, because the submodule can be on a different git server
+		submodule := GitModule{
+			git:               resolveSubmoduleURL(gitModule.git, url),
+			tree:              commits[submodulePath],
+			privateKey:        gitModule.privateKey,
+			useSSHAgent:       gitModule.useSSHAgent,
+			ignoreUnreachable: gitModule.ignoreUnreachable,
+			submodules:        true,
+			lfs:               gitModule.lfs,
+		}
+		if submodule.parentRepositories, err = submoduleParents(gitModule, tree, submodule); err != nil {
+			return err
+		}
+		submoduleDir, err := mirrorSubmodule(submodule)
+		if err != nil {
+			return err
+		}
+		resolvedTargetDir, err := filepath.EvalSymlinks(targetDir)
+		if err != nil {
+			return err
+		}
+		submoduleTargetDir := filepath.Join(targetDir, submodulePath)
+		fi, err := os.Lstat(submoduleTargetDir)
+		if !verifyParentDir(submoduleTargetDir, resolvedTargetDir, make(map[string]bool)) || (err == nil && fi.Mode()&os.ModeSymlink != 0) {
+			return errors.New("submodule path " + submodulePath + " of " + tree + " leads outside of " + targetDir)
+		}
+		checkDirAndCreate(submoduleTargetDir, "submodule dir")
+		Debugf("Extracting submodule " + submodulePath + " (" + submodule.tree + ") of " + redactGitURL(submodule.git) + " to " + submoduleTargetDir)
+		if err := extractGitTree(submodule, submoduleDir, submodule.tree, submoduleTargetDir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mirrorSubmodule returns the cached git repository of the submodule and clones or updates it once per g10k run
+// if it does not contain the commit of the submodule yet
+func mirrorSubmodule(submodule GitModule) (string, error) {
+	workDir := gitCacheDir(submodule.git)
+	if isDir(workDir) {
+		if _, err := gitBackend.resolveRef(workDir, submodule.tree, true); err == nil {
+			return workDir, nil
+		}
+	}
+	once, _ := submoduleMirrors.LoadOrStore(redactGitURL(submodule.git), &sync.Once{})
+	once.(*sync.Once).Do(func() {
+		Debugf("Mirroring submodule " + redactGitURL(submodule.git) + " to " + workDir)
+		doMirrorOrUpdate(submodule, workDir, 0)
+	})
+	if _, err := gitBackend.resolveRef(workDir, submodule.tree, true); err != nil {
+		return "", errors.New("could not find commit " + submodule.tree + " of submodule " + redactGitURL(submodule.git) + " in " + workDir)
+	}
+	return workDir, nil
+}
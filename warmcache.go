@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/remeh/sizedwaitgroup"
+	"github.com/xorpaul/uiprogress"
+)
+
+// runWarmCache mirrors the git repositories and downloads the Forge modules the Puppetfiles of target need into the cachedir
+// without populating any Puppet environment.
+// Without Puppetfiles the control repositories of the g10k config get mirrored and the Puppetfiles of their branches are used
+func runWarmCache(target string, puppetfiles map[string]Puppetfile) {
+	defer timeTrack(time.Now(), funcName())
+	before := time.Now()
+	controlRepos := 0
+	if puppetfiles == nil {
+		sources := warmControlRepos()
+		controlRepos = len(sources)
+		puppetfiles = controlRepoPuppetfiles(sources, func(workDir string, branch string, sa Source) {
+			if sa.Submodules {
+				commit, _ := gitBackend.resolveRef(workDir, branch, true)
+				warmSubmodules(GitModule{git: sa.Remote, privateKey: sa.PrivateKey}, workDir, commit)
+			}
+		})
+	}
+	uniqueGitModules, gitModuleTrees := uniqueModules(puppetfiles)
+	if showProgressBars() {
+		uiprogress.Start()
+	}
+	var wgResolve sync.WaitGroup
+	wgResolve.Add(2)
+	go func() {
+		defer wgResolve.Done()
+		resolveGitRepositories(uniqueGitModules, gitModuleTrees, func(url string) {})
+	}()
+	go func() {
+		defer wgResolve.Done()
+		resolveForgeModules(uniqueForgeModules, func(name string) {})
+	}()
+	wgResolve.Wait()
+	if showProgressBars() {
+		uiprogress.Stop()
+	}
+
+	// the submodules and Git LFS objects are otherwise only fetched while populating the Puppet environments
+	wg := sizedwaitgroup.New(config.Maxworker)
+	for url, gm := range uniqueGitModules {
+		if !gm.submodules && !gm.lfs {
+			continue
+		}
+		for tree := range gitModuleTrees[url] {
+			wg.Add()
+			go func(gm GitModule, tree string) {
+				defer wg.Done()
+				if interrupted() {
+					return
+				}
+				workDir := gitCacheDir(gm.git)
+				if len(tree) == 0 {
+					tree = detectDefaultBranch(gm, workDir)
+				}
+				commit, err := gitBackend.resolveRef(workDir, tree, true)
+				if err != nil {
+					Debugf("Skipping submodules and Git LFS objects of " + redactGitURL(gm.git) + ", because " + tree + " could not be resolved")
+					return
+				}
+				if gm.submodules {
+					warmSubmodules(gm, workDir, commit)
+				}
+				if gm.lfs {
+					if err := fetchLFSObjects(gm, workDir, commit); err != nil {
+						Warnf("WARN: Could not fetch the Git LFS objects of "+tree+" of "+redactGitURL(gm.git)+" Error: "+err.Error(), slog.String("git_url", redactGitURL(gm.git)), slog.String("ref", tree))
+					}
+				}
+			}(gm, tree)
+		}
+	}
+	wg.Wait()
+	exitIfInterrupted()
+
+	if !quiet {
+		fmt.Println("Warmed the cache " + config.CacheDir + " for " + target + " with " + strconv.Itoa(controlRepos) + " control repositories, " + strconv.Itoa(len(uniqueGitModules)) + " git repositories and " + strconv.Itoa(len(uniqueForgeModules)) + " Forge modules of " + strconv.Itoa(len(puppetfiles)) + " Puppetfiles in " + strconv.FormatFloat(time.Since(before).Seconds(), 'f', 1, 64) + "s")
+	}
+}
+
+// warmControlRepos mirrors the control repositories of all sources of the g10k config into the cachedir
+// and returns the sources whose control repository is cached
+func warmControlRepos() map[string]Source {
+	sources := make(map[string]Source)
+	wg := sizedwaitgroup.New(config.Maxworker)
+	for source, sa := range config.Sources {
+		wg.Add()
+		go func(source string, sa Source) {
+			defer wg.Done()
+			sourceSanityCheck(source, sa)
+			workDir := filepath.Join(config.EnvCacheDir, source+".git")
+			controlRepoGit := GitModule{git: sa.Remote, privateKey: sa.PrivateKey}
+			success := doMirrorOrUpdate(controlRepoGit, workDir, 0)
+			if !success && config.UseCacheFallback && isDir(workDir) && !interrupted() {
+				Warnf("WARN: Using the cached git repository "+workDir+" for source "+source, slog.String("source", source), slog.String("git_url", sa.Remote))
+				success = true
+			}
+			if !success {
+				if !interrupted() {
+					Warnf("WARNING: Could not resolve git repository in source '"+source+"' ("+sa.Remote+")", slog.String("source", source), slog.String("git_url", sa.Remote))
+					if sa.ExitIfUnreachable {
+						Fatalf("Error: Could not resolve git repository in source '" + source + "' (" + sa.Remote + ")")
+					}
+				}
+				return
+			}
+			mutex.Lock()
+			sources[source] = sa
+			mutex.Unlock()
+		}(source, sa)
+	}
+	wg.Wait()
+	exitIfInterrupted()
+	return sources
+}
+
+// warmSubmodules mirrors the git repositories of the submodules of the commit of the cached git repository gitDir and of their submodules
+func warmSubmodules(gitModule GitModule, gitDir string, commit string) {
+	if len(commit) == 0 {
+		return
+	}
+	commits, err := gitBackend.listSubmodules(gitDir, commit)
+	if err != nil || len(commits) == 0 {
+		return
+	}
+	content, _ := gitBackend.showFile(gitDir, commit, ".gitmodules")
+	urls := parseGitmodules(content)
+	for submodulePath, submoduleCommit := range commits {
+		url, ok := urls[submodulePath]
+		if !ok {
+			Debugf("Skipping submodule " + submodulePath + " of " + gitDir + ", because it is not in the .gitmodules file of " + commit)
+			continue
+		}
+		submodule := GitModule{
+			git:         resolveSubmoduleURL(gitModule.git, url),
+			tree:        submoduleCommit,
+			privateKey:  gitModule.privateKey,
+			useSSHAgent: gitModule.useSSHAgent,
+			submodules:  true,
+			lfs:         gitModule.lfs,
+		}
+		if submodule.parentRepositories, err = submoduleParents(gitModule, commit, submodule); err != nil {
+			Warnf("WARN: Skipping submodule "+submodulePath+" of "+gitDir+" Error: "+err.Error(), slog.String("git_url", redactGitURL(submodule.git)))
+			continue
+		}
+		submoduleDir, err := mirrorSubmodule(submodule)
+		if err != nil {
+			Warnf("WARN: Could not mirror submodule "+submodulePath+" of "+gitDir+" Error: "+err.Error(), slog.String("git_url", redactGitURL(submodule.git)))
+			continue
+		}
+		warmSubmodules(submodule, submoduleDir, submoduleCommit)
+	}
+}